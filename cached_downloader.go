@@ -2,12 +2,12 @@ package cacheddownloader
 
 import (
 	"crypto/md5"
-	"encoding/json"
 	"fmt"
 	"io"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
@@ -92,6 +92,48 @@ func (c CachingInfoType) Equal(other CachingInfoType) bool {
 	return c.ETag == other.ETag && c.LastModified == other.LastModified
 }
 
+// Matches reports whether other identifies the same version as c, like Equal
+// but comparing ETags weakly, so that W/"abc" matches "abc".
+func (c CachingInfoType) Matches(other CachingInfoType) bool {
+	if c.ETag != "" || other.ETag != "" {
+		if !ETagMatches(c.ETag, other.ETag, false) {
+			return false
+		}
+	}
+	return c.LastModified == other.LastModified
+}
+
+// ETagMatches compares two ETag header values as described in RFC 7232. With
+// strong comparison they match only if neither is weak (W/"...") and their
+// opaque tags are the same; with weak comparison, as used for If-None-Match,
+// matching opaque tags are enough. Empty ETags never match.
+func ETagMatches(a, b string, strong bool) bool {
+	aWeak, aTag := parseETag(a)
+	bWeak, bTag := parseETag(b)
+	if aTag == "" || bTag == "" {
+		return false
+	}
+	if strong && (aWeak || bWeak) {
+		return false
+	}
+	return aTag == bTag
+}
+
+// parseETag splits an ETag into its weakness indicator and its opaque tag,
+// without the quotes. Unquoted values, which some servers send, are taken
+// as they are.
+func parseETag(etag string) (weak bool, tag string) {
+	etag = strings.TrimSpace(etag)
+	if strings.HasPrefix(etag, "W/") {
+		weak = true
+		etag = etag[len("W/"):]
+	}
+	if len(etag) >= 2 && strings.HasPrefix(etag, `"`) && strings.HasSuffix(etag, `"`) {
+		etag = etag[1 : len(etag)-1]
+	}
+	return weak, etag
+}
+
 // A transformer function can be used to do post-download
 // processing on the file before it is stored in the cache.
 func New(
@@ -135,74 +177,24 @@ func createTempCachedDir(path string) (string, error) {
 }
 
 func (c *cachedDownloader) SaveState(logger lager.Logger) error {
-	json, err := json.Marshal(c.cache)
-	if err != nil {
-		return err
-	}
-
-	return os.WriteFile(c.cacheLocation, json, 0600)
+	return c.cache.Save(logger, c.cacheLocation)
 }
 
 func (c *cachedDownloader) RecoverState(logger lager.Logger) error {
-	file, err := os.Open(c.cacheLocation)
-	if err != nil && !os.IsNotExist(err) {
-		return err
-	}
-
-	defer file.Close()
-
-	if err == nil {
-		// parse the file only if it exists
-		// #nosec G104 - we explicitly don't want json decoding errors to propagate here
-		json.NewDecoder(file).Decode(c.cache)
-		// #nosec G104 - we explicitly don't want file.Close errors to propagate here
-		file.Close()
-	}
-
-	// set the inuse count to 0 since all containers will be recreated
-	for _, entry := range c.cache.Entries {
-		// inuseCount starts at 1 (i.e. 1 == no references to the entry)
-		entry.directoryInUseCount = 0
-		entry.fileInUseCount = 0
-	}
-
-	// delete files that aren't in the cache. **note** if there is no
-	// saved_cache.json, then all files will be deleted
-	trackedFiles := map[string]struct{}{}
-
-	for _, entry := range c.cache.Entries {
-		trackedFiles[entry.FilePath] = struct{}{}
-		trackedFiles[entry.ExpandedDirectoryPath] = struct{}{}
-	}
-
-	files, err := os.ReadDir(c.cache.CachedPath)
-	if err != nil && !os.IsNotExist(err) {
-		return err
-	}
-
-	for _, file := range files {
-		path := filepath.Join(c.cache.CachedPath, file.Name())
-		if _, ok := trackedFiles[path]; ok {
-			continue
-		}
-
-		err = os.RemoveAll(path)
-		if err != nil {
-			return err
-		}
-	}
-
-	// free some disk space in case the maxSizeInBytes was changed
-	c.cache.makeRoom(logger, 0, "")
-
-	if err := os.Mkdir(c.uncachedPath, 0755); err != nil {
+	err := c.cache.Load(logger, c.cacheLocation)
+	if err != nil {
 		return err
 	}
 
-	return err
+	return os.Mkdir(c.uncachedPath, 0755)
 }
 
 func (c *cachedDownloader) CloseDirectory(logger lager.Logger, cacheKey, directoryPath string) error {
+	if filepath.Dir(directoryPath) == c.uncachedPath {
+		// directories that could not be cached belong to nobody else
+		return os.RemoveAll(directoryPath)
+	}
+
 	cacheKey = fmt.Sprintf("%x", md5.Sum([]byte(cacheKey)))
 	return c.cache.CloseDirectory(logger, cacheKey, directoryPath)
 }
@@ -262,6 +254,11 @@ func (c *cachedDownloader) fetchCachedFile(logger lager.Logger, url *url.URL, ca
 	var newReader *CachedFile
 	if download.cachingInfo.isCacheable() {
 		newReader, err = c.cache.Add(logger, cacheKey, download.path, download.size, download.cachingInfo)
+		if err == CacheBusyErr {
+			// the download is still good, it just cannot be cached right now
+			logger.Info("cache-busy", lager.Data{"cache_key": cacheKey})
+			newReader, err = tempFileRemoveOnClose(download.path)
+		}
 	} else {
 		c.cache.Remove(logger, cacheKey)
 		newReader, err = tempFileRemoveOnClose(download.path)
@@ -320,8 +317,18 @@ func (c *cachedDownloader) fetchCachedDirectory(logger lager.Logger, url *url.UR
 	var newDirectory string
 	if download.cachingInfo.isCacheable() {
 		newDirectory, err = c.cache.AddDirectory(logger, cacheKey, download.path, download.size, download.cachingInfo)
+		if err == CacheBusyErr {
+			// the download is still good, it just cannot be cached right now
+			logger.Info("cache-busy", lager.Data{"cache_key": cacheKey})
+			newDirectory, err = uncachedDirectory(download.path)
+		}
+		if err != nil {
+			// #nosec G104 - best effort at cleaning up the download we could not use
+			os.Remove(download.path)
+			return "", 0, err
+		}
 		// return newly fetched directory
-		return newDirectory, size, err
+		return newDirectory, size, nil
 	}
 
 	c.cache.Remove(logger, cacheKey)
@@ -374,6 +381,23 @@ func tempFileRemoveOnClose(path string) (*CachedFile, error) {
 	}), nil
 }
 
+// uncachedDirectory expands the tarball at path next to it and removes the
+// tarball, for directories that cannot be cached. The directory is removed
+// again if it cannot be expanded.
+func uncachedDirectory(path string) (string, error) {
+	dirPath := path + ".d"
+	err := extractTarToDirectory(path, dirPath)
+	if err != nil {
+		// #nosec G104 - best effort at cleaning up a partial extraction
+		os.RemoveAll(dirPath)
+		return "", err
+	}
+
+	// #nosec G104 - the tarball is no longer needed once expanded
+	os.Remove(path)
+	return dirPath, nil
+}
+
 type download struct {
 	path        string
 	size        int64
@@ -560,13 +560,13 @@ var _ = Describe("File cache", func() {
 					fetchFileOfSize("D", int(maxSizeInBytes/2)+1)
 				})
 
-				It("does not delete the cache entries from disk", func() {
-					expectCacheToHaveNEntries(cachedPath, 4)
+				It("does not delete the cache entries from disk and returns the new file uncached", func() {
+					expectCacheToHaveNEntries(cachedPath, 3)
 
 					Expect(filepath.Glob(filepath.Join(cachedPath, computeMd5("A")+"*"))).To(HaveLen(1))
 					Expect(filepath.Glob(filepath.Join(cachedPath, computeMd5("B")+"*"))).To(HaveLen(1))
 					Expect(filepath.Glob(filepath.Join(cachedPath, computeMd5("C")+"*"))).To(HaveLen(1))
-					Expect(filepath.Glob(filepath.Join(cachedPath, computeMd5("D")+"*"))).To(HaveLen(1))
+					Expect(filepath.Glob(filepath.Join(cachedPath, computeMd5("D")+"*"))).To(HaveLen(0))
 				})
 
 				Context("and an earlier cache key was fetched", func() {
@@ -996,6 +996,40 @@ var _ = Describe("File cache", func() {
 				})
 			})
 
+			Context("when the cache entries are still in use", func() {
+				var inUse []string
+
+				BeforeEach(func() {
+					inUse = nil
+					for _, name := range []string{"A", "B", "C"} {
+						dir, _, err := cache.GetDirectory(logger, computeMd5(name))
+						Expect(err).NotTo(HaveOccurred())
+						inUse = append(inUse, dir)
+					}
+				})
+
+				AfterEach(func() {
+					for i, name := range []string{"A", "B", "C"} {
+						Expect(cache.CloseDirectory(logger, computeMd5(name), inUse[i])).To(Succeed())
+					}
+				})
+
+				It("returns the new directory uncached and removes it when closed", func() {
+					dir, _, err := fetchDir("D", 18)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(filepath.Join(dir, "testdir", "file.txt")).To(BeARegularFile())
+
+					expectCacheToHaveNEntries(cachedPath, 3)
+					Expect(filepath.Glob(filepath.Join(cachedPath, computeMd5("D")+"*"))).To(HaveLen(0))
+					leftovers, err := os.ReadDir(uncachedPath)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(leftovers).To(HaveLen(1))
+
+					Expect(cachedDownloader.CloseDirectory(logger, "D", dir)).To(Succeed())
+					Expect(dir).NotTo(BeADirectory())
+				})
+			})
+
 			Describe("when one of the files has just been read", func() {
 				BeforeEach(func() {
 					server.AppendHandlers(ghttp.CombineHandlers(
@@ -1460,6 +1494,31 @@ var _ = Describe("File cache", func() {
 			Expect(err).NotTo(HaveOccurred())
 		})
 	})
+
+	Describe("ETagMatches", func() {
+		It("matches identical strong ETags either way", func() {
+			Expect(cacheddownloader.ETagMatches(`"abc"`, `"abc"`, true)).To(BeTrue())
+			Expect(cacheddownloader.ETagMatches(`"abc"`, `"abc"`, false)).To(BeTrue())
+			Expect(cacheddownloader.ETagMatches(`"abc"`, `"abd"`, false)).To(BeFalse())
+		})
+
+		It("only matches weak ETags with weak comparison", func() {
+			Expect(cacheddownloader.ETagMatches(`W/"abc"`, `"abc"`, false)).To(BeTrue())
+			Expect(cacheddownloader.ETagMatches(`W/"abc"`, `W/"abc"`, false)).To(BeTrue())
+			Expect(cacheddownloader.ETagMatches(`W/"abc"`, `"abc"`, true)).To(BeFalse())
+			Expect(cacheddownloader.ETagMatches(`W/"abc"`, `W/"abc"`, true)).To(BeFalse())
+		})
+
+		It("takes unquoted ETags as they are", func() {
+			Expect(cacheddownloader.ETagMatches("abc", `"abc"`, true)).To(BeTrue())
+			Expect(cacheddownloader.ETagMatches("abc", `W/"abc"`, false)).To(BeTrue())
+		})
+
+		It("never matches empty ETags", func() {
+			Expect(cacheddownloader.ETagMatches("", "", false)).To(BeFalse())
+			Expect(cacheddownloader.ETagMatches(`""`, `""`, false)).To(BeFalse())
+		})
+	})
 })
 
 func expectCacheToHaveNEntries(cachePath string, n int) {
@@ -0,0 +1,176 @@
+package cacheddownloader
+
+import (
+	"context"
+	"os"
+
+	"code.cloudfoundry.org/lager/v3"
+)
+
+// ColdTier is a slower, larger store that entries evicted to make room are
+// demoted to instead of being deleted, and promoted back from on a miss.
+type ColdTier interface {
+	// Store keeps the file at path as the content of cacheKey. It may move
+	// the file, or copy it; the cache removes whatever is left at path. It is
+	// called after the cache lock is released.
+	Store(cacheKey, path string) error
+	// Fetch returns the path of a file with the content stored for cacheKey,
+	// which the cache then moves into the cache directory, and whether there
+	// is such content. It is called without the cache lock held, when a read
+	// finds no entry for cacheKey.
+	Fetch(cacheKey string) (path string, ok bool, err error)
+	// Remove drops the content stored for cacheKey. The cache calls it once
+	// the content has been promoted, or when cacheKey is added or removed.
+	// It is called with the cache lock held.
+	Remove(cacheKey string)
+}
+
+// WithColdTier makes the cache demote the files of the entries it evicts to
+// make room to tier, and look in tier for the keys it misses. Entries stored
+// compressed, and expanded directories, are deleted on eviction as usual. The
+// caching info of demoted entries is kept in memory, so entries promoted
+// after a restart have none.
+func WithColdTier(tier ColdTier) CacheOption {
+	return func(c *FileCache) {
+		c.coldTier = tier
+	}
+}
+
+// NewCacheWithColdTier creates a cache that demotes evicted files to tier, as
+// NewCache(dir, maxSizeInBytes, WithColdTier(tier)) does.
+func NewCacheWithColdTier(dir string, maxSizeInBytes int64, tier ColdTier) *FileCache {
+	return NewCache(dir, maxSizeInBytes, WithColdTier(tier))
+}
+
+// demotion is the file of an evicted entry, waiting to be stored in the cold
+// tier.
+type demotion struct {
+	cacheKey    string
+	path        string
+	cachingInfo CachingInfoType
+}
+
+// demote moves the file of entry, which is being evicted to make room, aside
+// for notifyEvictions to store in the cold tier.
+func (c *FileCache) demote(logger lager.Logger, cacheKey string, entry *FileCacheEntry) {
+	if c.coldTier == nil || entry.Compressed || entry.fileDoesNotExist() {
+		return
+	}
+
+	placeholder, err := os.CreateTemp(c.CachedPath, cacheKey+"-demoting-")
+	if err != nil {
+		logger.Error("failed-to-demote-entry", err, lager.Data{"cache_key": cacheKey})
+		return
+	}
+	// #nosec G104 - the file is only a placeholder for the rename
+	placeholder.Close()
+
+	err = rename(entry.FilePath, placeholder.Name())
+	if err != nil {
+		logger.Error("failed-to-demote-entry", err, lager.Data{"cache_key": cacheKey})
+		os.Remove(placeholder.Name())
+		return
+	}
+	c.demotions = append(c.demotions, demotion{cacheKey: cacheKey, path: placeholder.Name(), cachingInfo: entry.CachingInfo})
+}
+
+// storeDemotions stores the files set aside by demote in the cold tier. It
+// must be called without the lock held.
+func (c *FileCache) storeDemotions(tier ColdTier, demotions []demotion) {
+	for _, d := range demotions {
+		err := tier.Store(d.cacheKey, d.path)
+		// #nosec G104 - the tier may have moved the file
+		os.Remove(d.path)
+		if err != nil {
+			continue
+		}
+
+		lock.Lock()
+		if c.demoted == nil {
+			c.demoted = map[string]CachingInfoType{}
+		}
+		c.demoted[d.cacheKey] = d.cachingInfo
+		lock.Unlock()
+	}
+}
+
+// fetchDemoted stages the content the cold tier has for cacheKey into the
+// cache directory, if the cache has no entry for it, before a read takes the
+// lock, so that a slow copy from the tier does not hold the lock and promote
+// only renames the file into place. The returned function must be called
+// once the lock is released; it moves the content back to the tier if it was
+// not promoted.
+func (c *FileCache) fetchDemoted(logger lager.Logger, cacheKey string) (done func()) {
+	if c.coldTier == nil {
+		return func() {}
+	}
+
+	lock.RLock()
+	_, cached := c.Entries[cacheKey]
+	lock.RUnlock()
+	if cached {
+		return func() {}
+	}
+
+	path, ok, err := c.coldTier.Fetch(cacheKey)
+	if err != nil {
+		logger.Error("failed-to-fetch-from-cold-tier", err)
+		return func() {}
+	}
+	if !ok {
+		return func() {}
+	}
+
+	stagedPath, restore, err := c.stage(context.Background(), logger, cacheKey, path)
+	if err != nil {
+		logger.Error("failed-to-stage-from-cold-tier", err)
+		return func() {}
+	}
+
+	lock.Lock()
+	if c.fetched == nil {
+		c.fetched = map[string]string{}
+	}
+	c.fetched[cacheKey] = stagedPath
+	lock.Unlock()
+
+	return func() {
+		lock.Lock()
+		if c.fetched[cacheKey] == stagedPath {
+			delete(c.fetched, cacheKey)
+		}
+		lock.Unlock()
+		restore()
+	}
+}
+
+// promote adds the content fetchDemoted staged for cacheKey back to the
+// cache, returning the new entry, or nil if there is none.
+func (c *FileCache) promote(logger lager.Logger, cacheKey string) *FileCacheEntry {
+	stagedPath, ok := c.fetched[cacheKey]
+	if !ok {
+		return nil
+	}
+	delete(c.fetched, cacheKey)
+
+	size, err := entrySize(stagedPath)
+	if err == nil {
+		logger.Info("promoting-entry")
+		_, err = c.add(context.Background(), logger, cacheKey, stagedPath, "", size, c.demoted[cacheKey], addRequest{})
+	}
+	if err != nil {
+		logger.Error("failed-to-promote-entry", err)
+		return nil
+	}
+	return c.Entries[cacheKey]
+}
+
+// forgetDemoted drops the content the cold tier has for cacheKey, which has
+// been superseded.
+func (c *FileCache) forgetDemoted(cacheKey string) {
+	if c.coldTier == nil {
+		return
+	}
+	c.coldTier.Remove(cacheKey)
+	delete(c.demoted, cacheKey)
+}
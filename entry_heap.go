@@ -0,0 +1,111 @@
+package cacheddownloader
+
+import "container/heap"
+
+// entryHeap is a binary min-heap of entries. Each entry records its position
+// in the heap in the field returned by position, so that it can be fixed or
+// removed when it changes or leaves the cache.
+type entryHeap struct {
+	entries  []*FileCacheEntry
+	less     func(a, b *FileCacheEntry) bool
+	position func(e *FileCacheEntry) *int
+}
+
+func (h *entryHeap) Len() int { return len(h.entries) }
+
+func (h *entryHeap) Less(i, j int) bool { return h.less(h.entries[i], h.entries[j]) }
+
+func (h *entryHeap) Swap(i, j int) {
+	h.entries[i], h.entries[j] = h.entries[j], h.entries[i]
+	*h.position(h.entries[i]) = i
+	*h.position(h.entries[j]) = j
+}
+
+func (h *entryHeap) Push(x any) {
+	e := x.(*FileCacheEntry)
+	*h.position(e) = len(h.entries)
+	h.entries = append(h.entries, e)
+}
+
+func (h *entryHeap) Pop() any {
+	last := len(h.entries) - 1
+	e := h.entries[last]
+	h.entries[last] = nil
+	h.entries = h.entries[:last]
+	return e
+}
+
+// contains reports whether e is in the heap.
+func (h *entryHeap) contains(e *FileCacheEntry) bool {
+	i := *h.position(e)
+	return i < len(h.entries) && h.entries[i] == e
+}
+
+func (h *entryHeap) add(e *FileCacheEntry) {
+	heap.Push(h, e)
+}
+
+func (h *entryHeap) remove(e *FileCacheEntry) {
+	if h.contains(e) {
+		heap.Remove(h, *h.position(e))
+	}
+}
+
+// fix restores the heap order after e changed.
+func (h *entryHeap) fix(e *FileCacheEntry) {
+	if h.contains(e) {
+		heap.Fix(h, *h.position(e))
+	}
+}
+
+func (h *entryHeap) reset() {
+	h.entries = nil
+}
+
+// walk calls visit with the entries in heap order, without changing the heap,
+// until visit returns false. The children of an entry for which prune returns
+// true are not visited. Visiting k entries takes O(k log k).
+func (h *entryHeap) walk(prune func(e *FileCacheEntry) bool, visit func(e *FileCacheEntry) bool) {
+	if len(h.entries) == 0 {
+		return
+	}
+
+	frontier := &heapFrontier{heap: h, indices: []int{0}}
+	for frontier.Len() > 0 {
+		i := heap.Pop(frontier).(int)
+		e := h.entries[i]
+		if prune != nil && prune(e) {
+			continue
+		}
+		if !visit(e) {
+			return
+		}
+		for _, child := range []int{2*i + 1, 2*i + 2} {
+			if child < len(h.entries) {
+				heap.Push(frontier, child)
+			}
+		}
+	}
+}
+
+// heapFrontier holds the positions in an entryHeap that walk visits next,
+// ordered like the heap.
+type heapFrontier struct {
+	heap    *entryHeap
+	indices []int
+}
+
+func (f *heapFrontier) Len() int { return len(f.indices) }
+
+func (f *heapFrontier) Less(i, j int) bool { return f.heap.Less(f.indices[i], f.indices[j]) }
+
+func (f *heapFrontier) Swap(i, j int) { f.indices[i], f.indices[j] = f.indices[j], f.indices[i] }
+
+func (f *heapFrontier) Push(x any) { f.indices = append(f.indices, x.(int)) }
+
+func (f *heapFrontier) Pop() any {
+	last := len(f.indices) - 1
+	i := f.indices[last]
+	f.indices = f.indices[:last]
+	return i
+}
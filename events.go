@@ -0,0 +1,96 @@
+package cacheddownloader
+
+import "time"
+
+// eventBufferSize is how many events the channel returned by Events holds
+// before further events are dropped.
+const eventBufferSize = 1024
+
+// CacheEventType is the kind of operation a CacheEvent describes.
+type CacheEventType int
+
+const (
+	// EventAdd means an entry was added to the cache.
+	EventAdd CacheEventType = iota
+	// EventHit means a lookup found the entry.
+	EventHit
+	// EventMiss means a lookup found no entry.
+	EventMiss
+	// EventEvict means an entry left the cache, for any EvictReason.
+	EventEvict
+)
+
+func (t CacheEventType) String() string {
+	switch t {
+	case EventAdd:
+		return "add"
+	case EventHit:
+		return "hit"
+	case EventMiss:
+		return "miss"
+	case EventEvict:
+		return "evict"
+	default:
+		return "unknown"
+	}
+}
+
+// CacheEvent describes an operation on the cache, for Events. Size is zero
+// for misses.
+type CacheEvent struct {
+	Type     CacheEventType
+	CacheKey string
+	Size     int64
+	Time     time.Time
+}
+
+// Events returns a channel of the operations on the cache from the first call
+// on, for feeding an asynchronous metrics pipeline. Every call returns the
+// same channel. The cache never waits for the consumer: once the channel's
+// buffer is full, events are dropped and counted by DroppedEvents. The channel
+// is closed by Close, which ends a range over it.
+func (c *FileCache) Events() <-chan CacheEvent {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if c.events == nil {
+		c.events = make(chan CacheEvent, eventBufferSize)
+		if c.closed {
+			close(c.events)
+		}
+	}
+	return c.events
+}
+
+// DroppedEvents returns how many events were dropped because the channel
+// returned by Events was full.
+func (c *FileCache) DroppedEvents() uint64 {
+	return c.droppedEvents.Load()
+}
+
+// emit sends an event to the channel returned by Events, if there is one,
+// without blocking. It must be called with the lock held, so that Close
+// cannot close the channel during the send.
+func (c *FileCache) emit(eventType CacheEventType, cacheKey string, size int64) {
+	if c.events == nil || c.closed {
+		return
+	}
+
+	select {
+	case c.events <- CacheEvent{Type: eventType, CacheKey: cacheKey, Size: size, Time: c.currentTime()}:
+	default:
+		c.droppedEvents.Add(1)
+	}
+}
+
+// recordHit counts a lookup that found entry.
+func (c *FileCache) recordHit(cacheKey string, entry *FileCacheEntry) {
+	c.hits.Add(1)
+	c.emit(EventHit, cacheKey, entry.Size)
+}
+
+// recordMiss counts a lookup that found no entry.
+func (c *FileCache) recordMiss(cacheKey string) {
+	c.misses.Add(1)
+	c.emit(EventMiss, cacheKey, 0)
+}
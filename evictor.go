@@ -0,0 +1,149 @@
+package cacheddownloader
+
+import (
+	"container/list"
+	"sort"
+	"time"
+)
+
+// Evictor is an eviction policy implemented outside the cache, for
+// WithEvictor. The cache tells it about entries as they are added,
+// accessed and removed, and asks it for victims when it needs room. Expired
+// entries are still evicted first, and namespaces over their quota still
+// evict their entries least recently accessed first.
+//
+// RecordAdd, RecordAccess and RecordRemove are called with the cache lock
+// held for writing. Victims is called with the lock held for writing or only
+// for reading, as EvictionOrder, NextVictim and WouldEvict do, so calls of
+// Victims may run concurrently with each other, though never with the other
+// methods, and must not change the evictor. No method may call back into the
+// cache.
+type Evictor interface {
+	// RecordAdd is called when an entry is added for cacheKey, replacing any
+	// previous entry, when the entry changes in a way that may change its
+	// rank, such as its size, and again for every entry when the cache
+	// recounts its entries, as Load does.
+	RecordAdd(cacheKey string, entry EntryInfo)
+	// RecordAccess is called when the entry for cacheKey is accessed.
+	RecordAccess(cacheKey string)
+	// RecordRemove is called when the entry for cacheKey leaves the cache.
+	RecordRemove(cacheKey string)
+	// Victims calls visit with the keys in the order they should be evicted
+	// until visit returns false. It lists keys rather than naming a single
+	// victim because the cache skips the keys of entries that are in use or
+	// pinned, and lists several to plan an eviction before making it.
+	Victims(visit func(cacheKey string) bool)
+}
+
+// WithEvictor makes the cache ask evictor which entries to evict to make
+// room, in place of its policy.
+func WithEvictor(evictor Evictor) CacheOption {
+	return func(c *FileCache) {
+		c.evictor = evictor
+	}
+}
+
+// NewCacheWithEvictor creates a cache that asks evictor for victims, as
+// NewCache(dir, maxSizeInBytes, WithEvictor(evictor)) does.
+func NewCacheWithEvictor(dir string, maxSizeInBytes int64, evictor Evictor) *FileCache {
+	return NewCache(dir, maxSizeInBytes, WithEvictor(evictor))
+}
+
+// lruEvictor keeps the keys in order of cost per byte, cheapest first, and
+// of access within the same cost per byte, least recent first. orders holds
+// the keys of each cost per byte, and costs the costs per byte in increasing
+// order.
+type lruEvictor struct {
+	orders   map[float64]*list.List
+	costs    []float64
+	elements map[string]*list.Element
+}
+
+// lruItem is an element of the order of an lruEvictor.
+type lruItem struct {
+	cacheKey    string
+	access      time.Time
+	costPerByte float64
+}
+
+// NewLRUEvictor returns an Evictor that evicts the entries with the lowest
+// cost per byte first, and among those the least recently added or
+// accessed, as the cache does by default. Its methods other than Victims are
+// not safe for concurrent use outside a cache.
+func NewLRUEvictor() Evictor {
+	return &lruEvictor{orders: map[float64]*list.List{}, elements: map[string]*list.Element{}}
+}
+
+// RecordAdd places the key by the access time of the entry, which for a new
+// entry is almost always after every other, so that the order survives the
+// entries being recounted in no particular order. A key that is already
+// placed is moved if its cost per byte or access time changed.
+func (l *lruEvictor) RecordAdd(cacheKey string, entry EntryInfo) {
+	item := lruItem{cacheKey: cacheKey, access: entry.Access, costPerByte: costPerByte(entry.Cost, entry.Size)}
+	if element, ok := l.elements[cacheKey]; ok {
+		// a recounted entry may carry the same access time without its
+		// monotonic reading, so the times are compared as instants
+		if old := element.Value.(lruItem); old.costPerByte == item.costPerByte && old.access.Equal(item.access) {
+			return
+		}
+		l.RecordRemove(cacheKey)
+	}
+
+	order := l.orders[item.costPerByte]
+	if order == nil {
+		order = list.New()
+		l.orders[item.costPerByte] = order
+		i := sort.SearchFloat64s(l.costs, item.costPerByte)
+		l.costs = append(l.costs, 0)
+		copy(l.costs[i+1:], l.costs[i:])
+		l.costs[i] = item.costPerByte
+	}
+	for element := order.Back(); element != nil; element = element.Prev() {
+		if !element.Value.(lruItem).access.After(item.access) {
+			l.elements[cacheKey] = order.InsertAfter(item, element)
+			return
+		}
+	}
+	l.elements[cacheKey] = order.PushFront(item)
+}
+
+func (l *lruEvictor) RecordAccess(cacheKey string) {
+	element, ok := l.elements[cacheKey]
+	if !ok {
+		return
+	}
+	// the access time is not known, but is no earlier than any other
+	item := element.Value.(lruItem)
+	order := l.orders[item.costPerByte]
+	if last := order.Back().Value.(lruItem); last.access.After(item.access) {
+		item.access = last.access
+	}
+	element.Value = item
+	order.MoveToBack(element)
+}
+
+func (l *lruEvictor) RecordRemove(cacheKey string) {
+	element, ok := l.elements[cacheKey]
+	if !ok {
+		return
+	}
+	costPerByte := element.Value.(lruItem).costPerByte
+	order := l.orders[costPerByte]
+	order.Remove(element)
+	delete(l.elements, cacheKey)
+	if order.Len() == 0 {
+		delete(l.orders, costPerByte)
+		i := sort.SearchFloat64s(l.costs, costPerByte)
+		l.costs = append(l.costs[:i], l.costs[i+1:]...)
+	}
+}
+
+func (l *lruEvictor) Victims(visit func(cacheKey string) bool) {
+	for _, cost := range l.costs {
+		for element := l.orders[cost].Front(); element != nil; element = element.Next() {
+			if !visit(element.Value.(lruItem).cacheKey) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package cacheddownloader
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// SetRename replaces the function used to move files into the cache and
+// returns a function that restores the original.
+func SetRename(f func(oldpath, newpath string) error) func() {
+	original := rename
+	rename = f
+	return func() {
+		rename = original
+	}
+}
+
+// SetLink replaces the function used to hard link cached files and returns a
+// function that restores the original.
+func SetLink(f func(oldname, newname string) error) func() {
+	original := link
+	link = f
+	return func() {
+		link = original
+	}
+}
+
+// SetFreeBytes replaces the function used to measure free disk space and
+// returns a function that restores the original.
+func SetFreeBytes(f func(path string) (int64, error)) func() {
+	original := freeBytes
+	freeBytes = f
+	return func() {
+		freeBytes = original
+	}
+}
+
+// SetRemoveAll replaces the function used to delete cached files and returns a
+// function that restores the original.
+func SetRemoveAll(f func(path string) error) func() {
+	original := removeAll
+	removeAll = f
+	return func() {
+		removeAll = original
+	}
+}
+
+// SetNow replaces the clock used to name cached files and returns a function
+// that restores the original.
+func SetNow(f func() time.Time) func() {
+	original := now
+	now = f
+	return func() {
+		now = original
+	}
+}
+
+// UsedBytesDrift returns how far the running count of used bytes is from the
+// sum over the entries.
+func (c *FileCache) UsedBytesDrift() int64 {
+	lock.RLock()
+	defer lock.RUnlock()
+	used, _ := c.usage()
+	return c.usedBytes - used
+}
+
+// VictimsAgree reports whether the next victim found through the heaps ranks
+// the same as the one found by scanning every entry.
+func (c *FileCache) VictimsAgree() bool {
+	lock.RLock()
+	defer lock.RUnlock()
+	if _, ok := c.evictor.(*lruEvictor); c.evictor != nil && !ok {
+		// victims picked by an Evictor follow its own order
+		return true
+	}
+	_, fromHeap := c.nextVictim("")
+	_, fromScan := c.victimAmong(c.Entries, "")
+	if fromHeap == nil || fromScan == nil {
+		return fromHeap == fromScan
+	}
+	return !c.evictsBefore(fromHeap, fromScan) && !c.evictsBefore(fromScan, fromHeap)
+}
+
+// ContentIndexAgrees reports whether the index of keys by content hash holds
+// exactly the entries that have a content hash.
+func (c *FileCache) ContentIndexAgrees() bool {
+	lock.RLock()
+	defer lock.RUnlock()
+	indexed := 0
+	for hash, keys := range c.byContent {
+		for cacheKey := range keys {
+			entry := c.Entries[cacheKey]
+			if entry == nil || entry.ContentHash != hash {
+				return false
+			}
+			indexed++
+		}
+	}
+	for _, entry := range c.Entries {
+		if entry.ContentHash != "" {
+			indexed--
+		}
+	}
+	return indexed == 0
+}
+
+// AddFakeEntries tracks n entries without files, accessed one after another,
+// for benchmarks.
+func (c *FileCache) AddFakeEntries(n int) {
+	lock.Lock()
+	defer lock.Unlock()
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		c.Seq++
+		entry := c.newFileCacheEntry(fmt.Sprintf("fake-%d", i), 1, CachingInfoType{})
+		entry.Access = start.Add(time.Duration(i))
+		entry.Seq = c.Seq
+		c.setEntry(fmt.Sprintf("fake-%d", i), entry)
+	}
+}
+
+// NextVictimByScan finds the next victim by scanning every entry, as the cache
+// did before it kept the victims heap.
+func (c *FileCache) NextVictimByScan() string {
+	lock.RLock()
+	defer lock.RUnlock()
+	cacheKey, _ := c.victimAmong(c.Entries, "")
+	return cacheKey
+}
+
+// SetSyncFile replaces the function used to flush files to disk and returns a
+// function that restores the original.
+func SetSyncFile(f func(file *os.File) error) func() {
+	original := syncFile
+	syncFile = f
+	return func() {
+		syncFile = original
+	}
+}
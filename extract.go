@@ -0,0 +1,246 @@
+package cacheddownloader
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"code.cloudfoundry.org/archiver/extractor"
+	"code.cloudfoundry.org/lager/v3"
+)
+
+type archiveFormat int
+
+const (
+	unknownArchive archiveFormat = iota
+	tarArchive
+	tgzArchive
+	zipArchive
+)
+
+// ExtractTo extracts the archive cached for cacheKey into destDir, leaving the
+// entry cached. Tar, gzipped tar and zip archives are told apart by their
+// first bytes; other files fail with UnsupportedArchiveErr. Archives with
+// entries that would land outside destDir, such as ones naming "../" paths,
+// links pointing outside it, or entries written through an earlier symlink,
+// are rejected with UnsafeArchivePathErr before anything is extracted.
+func (c *FileCache) ExtractTo(logger lager.Logger, cacheKey, destDir string) error {
+	logger = logger.Session("file-cache.extract-to", lager.Data{"cache_key": cacheKey, "dest_dir": destDir})
+	file, _, err := c.get(logger, cacheKey, nil)
+	if err != nil {
+		return err
+	}
+	// #nosec G104 - the file was only read
+	defer file.Close()
+
+	format, err := detectArchive(file)
+	if err != nil {
+		return err
+	}
+
+	var e extractor.Extractor
+	switch format {
+	case tarArchive:
+		e = extractor.NewTar()
+		err = checkTarPaths(file, false)
+	case tgzArchive:
+		e = extractor.NewTgz()
+		err = checkTarPaths(file, true)
+	case zipArchive:
+		e = extractor.NewZip()
+		err = checkZipPaths(file.Name())
+	default:
+		return UnsupportedArchiveErr
+	}
+	if err != nil {
+		logger.Error("unsafe-archive", err)
+		return err
+	}
+
+	err = e.Extract(file.Name(), destDir)
+	if err != nil {
+		logger.Error("failed-to-extract", err)
+		return err
+	}
+	return nil
+}
+
+// detectArchive reads the first bytes of f to tell which kind of archive it
+// holds and rewinds it.
+func detectArchive(f *CachedFile) (archiveFormat, error) {
+	header := make([]byte, 512)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return unknownArchive, err
+	}
+	header = header[:n]
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return unknownArchive, err
+	}
+
+	switch {
+	case bytes.HasPrefix(header, []byte{0x1f, 0x8b}):
+		return tgzArchive, nil
+	case bytes.HasPrefix(header, []byte("PK\x03\x04")), bytes.HasPrefix(header, []byte("PK\x05\x06")):
+		return zipArchive, nil
+	case len(header) >= 262 && string(header[257:262]) == "ustar":
+		return tarArchive, nil
+	default:
+		return unknownArchive, nil
+	}
+}
+
+// checkTarPaths reads the tar archive in f, gzipped if compressed, and fails
+// if any entry would be extracted outside the destination. f is rewound.
+func checkTarPaths(f *CachedFile, compressed bool) error {
+	var r io.Reader = f
+	if compressed {
+		gzipReader, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gzipReader.Close()
+		r = gzipReader
+	}
+
+	paths := archivePaths{symlinks: map[string]bool{}}
+	tarReader := tar.NewReader(r)
+	for {
+		hdr, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeSymlink:
+			err = paths.checkSymlink(hdr.Name, hdr.Linkname)
+		case tar.TypeLink:
+			err = paths.checkHardlink(hdr.Name, hdr.Linkname)
+		default:
+			_, err = paths.check(hdr.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := f.Seek(0, io.SeekStart)
+	return err
+}
+
+// checkZipPaths fails if any entry of the zip archive at path would be
+// extracted outside the destination.
+func checkZipPaths(path string) error {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	paths := archivePaths{symlinks: map[string]bool{}}
+	for _, file := range r.File {
+		if file.Mode()&os.ModeSymlink != 0 {
+			var target string
+			target, err = zipLinkTarget(file)
+			if err == nil {
+				err = paths.checkSymlink(file.Name, target)
+			}
+		} else {
+			_, err = paths.check(file.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// zipLinkTarget reads the target of a zip symlink entry, which is stored as
+// its content.
+func zipLinkTarget(file *zip.File) (string, error) {
+	r, err := file.Open()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	target, err := io.ReadAll(io.LimitReader(r, 4096))
+	if err != nil {
+		return "", err
+	}
+	return string(target), nil
+}
+
+// archivePaths checks the entries of an archive in order. It fails entries
+// that would be extracted outside the destination, and entries under a
+// symlink extracted before them, which would be written wherever the link
+// points.
+type archivePaths struct {
+	symlinks map[string]bool
+}
+
+// check fails if name would be extracted outside the destination or through
+// a symlink, and returns it cleaned.
+func (a *archivePaths) check(name string) (string, error) {
+	cleaned, ok := a.inside(name)
+	if !ok {
+		return "", fmt.Errorf("%w: %s", UnsafeArchivePathErr, name)
+	}
+	return cleaned, nil
+}
+
+// inside cleans name, reporting false if it is absolute, leaves the
+// destination or passes through a recorded symlink.
+func (a *archivePaths) inside(name string) (string, bool) {
+	name = strings.ReplaceAll(name, `\`, "/")
+	cleaned := path.Clean(name)
+	if path.IsAbs(name) || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", false
+	}
+	for p := cleaned; p != "."; p = path.Dir(p) {
+		if a.symlinks[p] {
+			return "", false
+		}
+	}
+	return cleaned, true
+}
+
+// checkSymlink checks a symlink named name, whose target is relative to the
+// directory holding it, and records it.
+func (a *archivePaths) checkSymlink(name, target string) error {
+	cleaned, err := a.check(name)
+	if err != nil {
+		return err
+	}
+	slashed := strings.ReplaceAll(target, `\`, "/")
+	_, ok := a.inside(path.Join(path.Dir(cleaned), slashed))
+	if cleaned == "." || path.IsAbs(slashed) || !ok {
+		return fmt.Errorf("%w: %s links to %s", UnsafeArchivePathErr, name, target)
+	}
+	a.symlinks[cleaned] = true
+	return nil
+}
+
+// checkHardlink checks a hard link named name, whose target is relative to
+// the destination.
+func (a *archivePaths) checkHardlink(name, target string) error {
+	_, err := a.check(name)
+	if err != nil {
+		return err
+	}
+	_, ok := a.inside(target)
+	if !ok {
+		return fmt.Errorf("%w: %s links to %s", UnsafeArchivePathErr, name, target)
+	}
+	return nil
+}
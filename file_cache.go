@@ -1,12 +1,24 @@
 package cacheddownloader
 
 import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"maps"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"code.cloudfoundry.org/archiver/compressor"
@@ -15,101 +27,707 @@ import (
 )
 
 var (
-	lock                   = &sync.Mutex{}
+	lock                   = &sync.RWMutex{}
 	EntryNotFound          = errors.New("Entry Not Found")
 	AlreadyClosed          = errors.New("Already closed directory")
+	AlreadyReleased        = errors.New("Already released file")
+	NotEnoughFreeSpaceErr  = errors.New("Not enough free disk space for the cache reserve")
+	OutsideCacheErr        = errors.New("Path is outside the cache directory")
+	DoesNotFitErr          = errors.New("File does not fit in the cache")
+	TooLargeErr            = errors.New("File is larger than the cache")
+	EntryTooLargeErr       = errors.New("File is larger than the maximum entry size")
+	InvalidFilenameErr     = errors.New("Cache file name must be a single path segment")
+	EntryInUseErr          = errors.New("Entry is in use")
+	ClosedErr              = errors.New("Cache is closed")
+	InvalidSourceErr       = errors.New("Source cannot be moved into the cache")
+	CacheBusyErr           = errors.New("Not enough room in the cache: remaining entries are in use or pinned")
+	UnsupportedArchiveErr  = errors.New("Cached file is not a tar, tgz or zip archive")
+	UnsafeArchivePathErr   = errors.New("Archive entry is outside the destination directory")
 	MissingCacheKeyErr     = errors.New("Not cacheable directory: cache key is missing")
+	EmptyCacheKeyErr       = errors.New("Cache key is empty")
+	CacheDirMissingErr     = errors.New("Cache directory is missing and could not be recreated")
 	MissingCacheHeadersErr = errors.New("Not cacheable directory: ETag and Last-Modified were missing from response")
 )
 
+// EvictionPolicy selects which entry is ejected when room is needed.
+type EvictionPolicy int
+
+const (
+	// LRU evicts the least recently accessed entry.
+	LRU EvictionPolicy = iota
+	// LFU evicts the least frequently accessed entry, breaking ties by
+	// evicting the least recently accessed one.
+	LFU
+	// SLRU is a segmented LRU. New entries are on probation until they are
+	// accessed again, which protects them. Entries on probation are evicted,
+	// least recently accessed first, before any protected entry, so a one-off
+	// scan of many keys does not push out the entries that are used repeatedly.
+	SLRU
+)
+
+// EvictReason describes why an entry was ejected from the cache.
+type EvictReason int
+
+const (
+	// EvictReasonCapacity means the entry was evicted to make room.
+	EvictReasonCapacity EvictReason = iota
+	// EvictReasonRemoved means the entry was removed with Remove or Take.
+	EvictReasonRemoved
+	// EvictReasonReplaced means a new entry was added with the same key.
+	EvictReasonReplaced
+	// EvictReasonExpired means the entry outlived its TTL.
+	EvictReasonExpired
+	// EvictReasonCorrupted means the cached file no longer matched its checksum.
+	EvictReasonCorrupted
+	// EvictReasonMissing means the files of the entry were gone from disk.
+	EvictReasonMissing
+)
+
+func (r EvictReason) String() string {
+	switch r {
+	case EvictReasonCapacity:
+		return "capacity"
+	case EvictReasonRemoved:
+		return "removed"
+	case EvictReasonReplaced:
+		return "replaced"
+	case EvictReasonExpired:
+		return "expired"
+	case EvictReasonCorrupted:
+		return "corrupted"
+	case EvictReasonMissing:
+		return "missing"
+	default:
+		return "unknown"
+	}
+}
+
+// Eviction describes an entry that left the cache, for OnEviction.
+type Eviction struct {
+	CacheKey string
+	Size     int64
+	Reason   EvictReason
+	// Age is how long the entry had gone without being accessed.
+	Age time.Duration
+}
+
+// evictionAgeBounds are the upper bounds of the buckets of
+// EvictionAgeHistogram.
+var evictionAgeBounds = [...]time.Duration{
+	time.Minute,
+	10 * time.Minute,
+	time.Hour,
+	6 * time.Hour,
+	24 * time.Hour,
+	7 * 24 * time.Hour,
+}
+
+// AgeHistogram counts entries by age. Counts[i] is the number of entries no
+// older than Bounds[i] (and older than Bounds[i-1]); the last count is the
+// number of entries older than every bound.
+type AgeHistogram struct {
+	Bounds []time.Duration
+	Counts []uint64
+}
+
 type FileCache struct {
 	CachedPath     string
 	maxSizeInBytes int64
 	Entries        map[string]*FileCacheEntry
 	OldEntries     map[string]*FileCacheEntry
 	Seq            uint64
+
+	// OnEvict, if set, is called for every entry that leaves the cache. It is
+	// called after the cache lock is released, so it may use the cache.
+	OnEvict func(cacheKey string, size int64, reason EvictReason) `json:"-"`
+
+	// OnEviction, if set, is called like OnEvict, with the age of the entry as
+	// well.
+	OnEviction func(eviction Eviction) `json:"-"`
+
+	// ThrashDetected, if set, is called with the rate of evictions to make
+	// room, in evictions per second over the last ThrashWindow, when it
+	// exceeds ThrashThreshold. Constant evictions suggest that the cache is
+	// too small for its working set. It is called at most once per window,
+	// after the cache lock is released. ThrashWindow defaults to a minute.
+	ThrashDetected  func(rate float64) `json:"-"`
+	ThrashThreshold float64            `json:"-"`
+	ThrashWindow    time.Duration      `json:"-"`
+
+	// VerifyOnRead, if set, re-hashes cached files that have a checksum before
+	// handing them out. Entries that fail verification are removed and treated
+	// as absent.
+	VerifyOnRead bool `json:"-"`
+
+	// BlockSize, if positive, rounds the size accounted to each entry up to a
+	// multiple of it, so that the limit reflects the disk space taken by many
+	// small files, each of which fills whole filesystem blocks. Entries keep
+	// the rounded size.
+	BlockSize int64 `json:"-"`
+
+	// Deduplicate, if set, hashes added files and hard links a file whose
+	// content is already cached under another key instead of storing it again.
+	// Shared content is accounted for once, and stays on disk until the last
+	// key referring to it is evicted.
+	Deduplicate bool `json:"-"`
+
+	// FilenameFunc, if set, derives the names of cached files from the cache
+	// key and the base name of the source, in place of DefaultFilename. The
+	// cache appends a unique suffix before the extension. The name must be a
+	// single path segment.
+	FilenameFunc func(cacheKey, sourceBase string) string `json:"-"`
+
+	// MaxEntryBytes, if positive, is the size of the largest file the cache
+	// accepts. Adding a larger file fails with EntryTooLargeErr even if it
+	// would fit, so that a single runaway download cannot evict the whole
+	// cache. Zero bounds files by the size of the cache alone.
+	MaxEntryBytes int64 `json:"-"`
+
+	// EvictFewest, if set, makes room by evicting the largest of the older
+	// half of the entries in line for eviction first, rather than strictly in
+	// eviction order, so that adding one large file does not evict many small
+	// entries where one large entry would do. Expired entries are still
+	// evicted first. Making room then goes through every entry.
+	EvictFewest bool `json:"-"`
+
+	// MaxEntries, if positive, limits the number of entries regardless of
+	// their size. Adding an entry beyond the limit evicts entries the same way
+	// as running out of space does.
+	MaxEntries int `json:"-"`
+
+	// Durable, if set, flushes added files and the cache directory to disk
+	// before an add returns, so that a cached file survives a crash or power
+	// loss. Flushing can take several milliseconds per add, so it is off by
+	// default: most callers can simply download a lost file again.
+	Durable bool `json:"-"`
+
+	// MoveAttempts, if greater than one, is how many times moving a file into
+	// the cache is attempted when the rename fails with EAGAIN or EBUSY, as it
+	// occasionally does on busy hosts. The wait between attempts starts at
+	// MoveBackoff and doubles after each one. A failed attempt leaves nothing
+	// behind at the destination, and the error of the last attempt is
+	// returned.
+	MoveAttempts int           `json:"-"`
+	MoveBackoff  time.Duration `json:"-"`
+
+	// FileMode, if set, is the mode given to cached files, and DirMode, if
+	// set, the mode given to the directories of directory entries and to the
+	// directories within them, whose files are given FileMode. Unset modes
+	// leave whatever mode the source had.
+	FileMode os.FileMode `json:"-"`
+	DirMode  os.FileMode `json:"-"`
+
+	// KeyValidator, if set, checks the keys of added entries in place of
+	// ValidateKey, failing the add with its error.
+	KeyValidator func(cacheKey string) error `json:"-"`
+
+	// StatePath, if set, is where Close saves the metadata of the cache, and
+	// where StartAutosave saves it as it changes.
+	StatePath string `json:"-"`
+
+	// ShardDepth, if positive, spreads new cached files over that many levels
+	// of subdirectories named by pairs of hex digits of a hash of the file
+	// name, as in ab/cd/name, so that no directory holds tens of thousands of
+	// files. Zero keeps every file directly in the cache directory. Files
+	// already cached keep their paths when it changes.
+	ShardDepth int `json:"-"`
+
+	policy   EvictionPolicy
+	compress bool
+	clock    Clock
+	tracer   Tracer
+	// loading holds the keys that GetOrLoad or AddStream are loading, and
+	// loadingURLs the URLs that GetOrLoadByURL is loading
+	loading      map[string]*load
+	loadingURLs  map[string]*load
+	minFreeBytes int64
+	evictions    []Eviction
+	// evictionAges counts the entries evicted for capacity by age, bucketed
+	// by evictionAgeBounds
+	evictionAges [len(evictionAgeBounds) + 1]uint64
+	// recentEvictions holds the times of the evictions for capacity within
+	// the thrash window, lastThrash when ThrashDetected was last due, and
+	// thrashRates the rates it is yet to be called with
+	recentEvictions []time.Time
+	lastThrash      time.Time
+	thrashRates     []float64
+
+	// usedBytes is the space accounted to the entries, kept up to date as they
+	// change; shared counts the shareable entries per content hash
+	usedBytes int64
+	shared    map[string]int
+	// byContent indexes the keys of the entries that have a content hash by
+	// the hash
+	byContent map[string]map[string]struct{}
+	// victims orders the entries by ranksBefore for the policies other than
+	// LRU, and expiring orders the entries that have an expiry by when they
+	// expire, so that finding the next victim does not scan every entry
+	victims  entryHeap
+	expiring entryHeap
+	// quotas holds the size limits of the namespaces created with Namespace
+	quotas map[string]int64
+	// knownMisses maps the keys marked with MarkMiss to when the mark expires
+	knownMisses map[string]time.Time
+	// batching is set while AddBatch adds its files, which defers making
+	// room until all of them have been added
+	batching bool
+	// janitors holds the stop functions of the janitors started with
+	// StartJanitor, and closed is set by Close
+	janitors []func()
+	closed   bool
+	// temporary is set for caches created by NewTempCache, whose directory
+	// is removed by Close
+	temporary bool
+
+	// keyLocks serialize adds of the same key while they stage files without
+	// holding lock. Keys are spread over the stripes by hash.
+	keyLocks [keyStripes]sync.Mutex
+
+	// evictor picks the victims in place of the victims heap: an lruEvictor
+	// for the LRU policy, or the one given to WithEvictor
+	evictor Evictor
+	// events is the channel returned by Events, created by its first call
+	events chan CacheEvent
+	// freed is closed to wake up the adds waiting for room, see roomFreed
+	freed chan struct{}
+	// coldTier is where evicted entries are demoted to, if set; demotions
+	// holds the files waiting to be stored there, demoted the caching info of
+	// the entries stored there, and fetched the files staged from there by
+	// fetchDemoted for promote, by key
+	coldTier  ColdTier
+	demotions []demotion
+	demoted   map[string]CachingInfoType
+	fetched   map[string]string
+
+	// dirty is set by mutated when the metadata changes, for StartAutosave
+	dirty atomic.Bool
+
+	hits          atomic.Uint64
+	misses        atomic.Uint64
+	evictionCount atomic.Uint64
+	droppedEvents atomic.Uint64
 }
 
 type FileCacheEntry struct {
-	Size                  int64
-	Access                time.Time
+	Size        int64
+	Access      time.Time
+	AccessCount uint64
+	// Seq orders entries by insertion, breaking ties between equal access
+	// times.
+	Seq         uint64
+	Expiry      time.Time
+	Cost        float64
+	ContentHash string
+	// Compressed is set for entries whose file is stored gzipped. Size is
+	// then the compressed size.
+	Compressed bool
+	// Namespace is the name of the namespace the entry was added through, if
+	// any.
+	Namespace string
+	// Pinned entries are never evicted, though they still take up space.
+	Pinned bool
+	// Tags is arbitrary metadata attached to the entry, such as its content
+	// type or origin URL.
+	Tags map[string]string
+	// Origin is the URL the entry was loaded from by GetOrLoadByURL, if any.
+	Origin                string
+	Checksum              ChecksumInfoType
 	CachingInfo           CachingInfoType
 	FilePath              string
 	ExpandedDirectoryPath string
 	directoryInUseCount   int
 	fileInUseCount        int
+	acquiredCount         int
+	// cache is the cache whose Entries hold the entry, if any, and cacheKey
+	// its key there
+	cache    *FileCache
+	cacheKey string
+	// victimIndex and expiryIndex are the positions of the entry in the
+	// victims and expiring heaps of the cache
+	victimIndex int
+	expiryIndex int
 }
 
-func NewCache(dir string, maxSizeInBytes int64) *FileCache {
-	return &FileCache{
+// CacheOption configures a cache as it is created by NewCache,
+// NewCacheWithValidation or NewTempCache. Options can be combined, and apply
+// in order.
+type CacheOption func(*FileCache)
+
+// NewCache creates a cache of at most maxSizeInBytes in dir, configured by
+// opts. Without options it evicts the least recently used entries first.
+func NewCache(dir string, maxSizeInBytes int64, opts ...CacheOption) *FileCache {
+	c := &FileCache{
 		CachedPath:     dir,
 		maxSizeInBytes: maxSizeInBytes,
 		Entries:        map[string]*FileCacheEntry{},
 		OldEntries:     map[string]*FileCacheEntry{},
 		Seq:            0,
+		policy:         LRU,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.evictor == nil && c.policy == LRU {
+		c.evictor = NewLRUEvictor()
+	}
+	return c
+}
+
+// WithPolicy makes the cache pick the entries to evict with policy instead
+// of LRU. It has no effect with WithEvictor.
+func WithPolicy(policy EvictionPolicy) CacheOption {
+	return func(c *FileCache) {
+		c.policy = policy
+	}
+}
+
+// NewCacheWithPolicy creates a cache that evicts by policy, as
+// NewCache(dir, maxSizeInBytes, WithPolicy(policy)) does.
+func NewCacheWithPolicy(dir string, maxSizeInBytes int64, policy EvictionPolicy) *FileCache {
+	return NewCache(dir, maxSizeInBytes, WithPolicy(policy))
+}
+
+// WithReserve makes the cache, besides staying under its size limit, keep at
+// least minFreeBytes free on the filesystem holding its directory. Entries
+// are evicted to keep the reserve, and an add that would still drop below it
+// fails with NotEnoughFreeSpaceErr.
+func WithReserve(minFreeBytes int64) CacheOption {
+	return func(c *FileCache) {
+		c.minFreeBytes = minFreeBytes
+	}
+}
+
+// NewCacheWithReserve creates a cache that keeps minFreeBytes free, as
+// NewCache(dir, maxSizeInBytes, WithReserve(minFreeBytes)) does.
+func NewCacheWithReserve(dir string, maxSizeInBytes int64, minFreeBytes int64) *FileCache {
+	return NewCache(dir, maxSizeInBytes, WithReserve(minFreeBytes))
+}
+
+// WithCompression makes the cache store added files gzipped and account for
+// them by their compressed size. Files handed out by Add and Get are
+// decompressed into temporary copies that are removed on Close, and
+// OpenForKey decompresses as it reads. Paths returned by Acquire and
+// GetOrLoad refer to the compressed file, so callers should prefer
+// OpenForKey.
+func WithCompression() CacheOption {
+	return func(c *FileCache) {
+		c.compress = true
+	}
+}
+
+// NewCacheWithCompression creates a cache that stores added files gzipped, as
+// NewCache(dir, maxSizeInBytes, WithCompression()) does.
+func NewCacheWithCompression(dir string, maxSizeInBytes int64) *FileCache {
+	return NewCache(dir, maxSizeInBytes, WithCompression())
+}
+
+// NewCacheWithValidation creates a cache like NewCache, but first creates dir
+// if needed and checks that files can be written to it, so that a bad
+// directory is reported here rather than by the first add.
+func NewCacheWithValidation(dir string, maxSizeInBytes int64, opts ...CacheOption) (*FileCache, error) {
+	err := os.MkdirAll(dir, 0750)
+	if err != nil {
+		return nil, fmt.Errorf("could not create cache directory: %w", err)
+	}
+
+	probe, err := os.CreateTemp(dir, "probe-")
+	if err != nil {
+		return nil, fmt.Errorf("cache directory is not writable: %w", err)
+	}
+	probe.Close()
+	err = os.Remove(probe.Name())
+	if err != nil {
+		return nil, fmt.Errorf("could not remove probe file from cache directory: %w", err)
 	}
+
+	return NewCache(dir, maxSizeInBytes, opts...), nil
+}
+
+// NewTempCache creates a cache in a new temporary directory, which Close
+// removes along with everything in it, for tests and other short-lived uses.
+func NewTempCache(maxSizeInBytes int64, opts ...CacheOption) (*FileCache, error) {
+	dir, err := os.MkdirTemp("", "cacheddownloader-")
+	if err != nil {
+		return nil, fmt.Errorf("could not create cache directory: %w", err)
+	}
+
+	c := NewCache(dir, maxSizeInBytes, opts...)
+	c.temporary = true
+	return c, nil
+}
+
+// Clock tells the cache the time, for access times and expiry.
+type Clock interface {
+	Now() time.Time
+}
+
+// WithClock makes the cache take the time from clock, so that tests can
+// control the order of accesses and when entries expire.
+func WithClock(clock Clock) CacheOption {
+	return func(c *FileCache) {
+		c.clock = clock
+	}
+}
+
+// NewCacheWithClock creates a cache that takes the time from clock, as
+// NewCache(dir, maxSizeInBytes, WithClock(clock)) does.
+func NewCacheWithClock(dir string, maxSizeInBytes int64, clock Clock) *FileCache {
+	return NewCache(dir, maxSizeInBytes, WithClock(clock))
+}
+
+// Tracer starts spans around cache operations, for latency debugging. It is
+// small enough to adapt OpenTelemetry or Zipkin tracers to. It must be safe
+// for concurrent use.
+type Tracer interface {
+	StartSpan(name string) Span
+}
+
+// Span is an operation being traced, which ends when End is called.
+type Span interface {
+	End()
+}
+
+// WithTracer makes the cache trace adds, reads and evictions with tracer.
+// Spans are named after the operation, such as "file-cache.get". Reads are
+// traced from before they wait for the cache lock. Adds, whichever method
+// makes them, are traced as "file-cache.add" once the file is staged and the
+// lock is held, and the entries evicted to make room for an add or under a
+// lower limit as "file-cache.evict".
+func WithTracer(tracer Tracer) CacheOption {
+	return func(c *FileCache) {
+		c.tracer = tracer
+	}
+}
+
+// NewCacheWithTracer creates a cache that traces its operations with tracer,
+// as NewCache(dir, maxSizeInBytes, WithTracer(tracer)) does.
+func NewCacheWithTracer(dir string, maxSizeInBytes int64, tracer Tracer) *FileCache {
+	return NewCache(dir, maxSizeInBytes, WithTracer(tracer))
+}
+
+type noopSpan struct{}
+
+func (noopSpan) End() {}
+
+// startSpan starts a span with the cache's tracer, if it has one.
+func (c *FileCache) startSpan(name string) Span {
+	if c.tracer == nil {
+		return noopSpan{}
+	}
+	return c.tracer.StartSpan(name)
+}
+
+// currentTime returns the time from the cache's clock.
+func (c *FileCache) currentTime() time.Time {
+	if c.clock == nil {
+		return time.Now()
+	}
+	return c.clock.Now()
 }
 
-func newFileCacheEntry(cachePath string, size int64, cachingInfo CachingInfoType) *FileCacheEntry {
+func (c *FileCache) newFileCacheEntry(cachePath string, size int64, cachingInfo CachingInfoType) *FileCacheEntry {
 	return &FileCacheEntry{
-		Size:                  size,
+		Size:                  c.roundToBlock(size),
 		FilePath:              cachePath,
-		Access:                time.Now(),
+		Access:                c.currentTime(),
+		AccessCount:           1,
 		CachingInfo:           cachingInfo,
 		ExpandedDirectoryPath: "",
 	}
 }
 
+// roundToBlock rounds size up to a multiple of BlockSize, if it is set.
+func (c *FileCache) roundToBlock(size int64) int64 {
+	if c.BlockSize <= 0 || size <= 0 {
+		return size
+	}
+	return (size + c.BlockSize - 1) / c.BlockSize * c.BlockSize
+}
+
+func (e *FileCacheEntry) recordAccess() {
+	e.Access = e.currentTime()
+	e.AccessCount++
+	if e.cache != nil {
+		e.cache.mutated()
+		e.cache.victims.fix(e)
+		if e.cache.evictor != nil {
+			e.cache.evictor.RecordAccess(e.cacheKey)
+		}
+	}
+}
+
+func (e *FileCacheEntry) expired() bool {
+	return !e.Expiry.IsZero() && !e.currentTime().Before(e.Expiry)
+}
+
+// currentTime returns the time from the clock of the entry's cache.
+func (e *FileCacheEntry) currentTime() time.Time {
+	if e.cache == nil {
+		return time.Now()
+	}
+	return e.cache.currentTime()
+}
+
+// checksumMatches re-hashes the cached file and compares it with the recorded
+// checksum. Entries without a checksum always match.
+func (e *FileCacheEntry) checksumMatches() (bool, error) {
+	if e.Checksum.Algorithm == "" && e.Checksum.Value == "" {
+		return true, nil
+	}
+
+	f, err := e.open()
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	err = validateChecksum(f, e.Checksum)
+	if _, ok := err.(*ChecksumFailedError); ok {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// validateChecksum hashes the content of r and checks it against checksum.
+func validateChecksum(r io.Reader, checksum ChecksumInfoType) error {
+	validator, err := NewHashValidator(checksum.Algorithm)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(validator.hash, r)
+	if err != nil {
+		return err
+	}
+	return validator.Validate(checksum.Value)
+}
+
+// shareable reports whether the entry only holds a file that may be hard
+// linked with other entries of the same content. Expanded directories are
+// never shared.
+func (e *FileCacheEntry) shareable() bool {
+	return e.ContentHash != "" && e.ExpandedDirectoryPath == ""
+}
+
+// change runs mutate, which may change any of the saved fields of the entry,
+// including its size and whether it shares content, keeping the used bytes
+// of the cache holding the entry up to date and marking its metadata as
+// changed.
+func (e *FileCacheEntry) change(mutate func()) {
+	if c := e.cache; c != nil {
+		c.account(e, -1)
+		defer func() {
+			c.account(e, 1)
+			// the cost per byte depends on the size
+			c.victims.fix(e)
+			if c.evictor != nil {
+				c.evictor.RecordAdd(e.cacheKey, e.info(e.cacheKey))
+			}
+			c.mutated()
+		}()
+	}
+	mutate()
+}
+
+// protected reports whether the entry has been accessed since it was added,
+// which moves it out of the probationary segment of SLRU.
+func (e *FileCacheEntry) protected() bool {
+	return e.AccessCount > 1
+}
+
+func (e *FileCacheEntry) costPerByte() float64 {
+	return costPerByte(e.Cost, e.Size)
+}
+
+// costPerByte is what evicting an entry of size bytes that costs cost to
+// load again costs per byte freed.
+func costPerByte(cost float64, size int64) float64 {
+	if size <= 0 {
+		return cost
+	}
+	return cost / float64(size)
+}
+
+func (e *FileCacheEntry) info(cacheKey string) EntryInfo {
+	return EntryInfo{
+		CacheKey:      cacheKey,
+		Size:          e.Size,
+		Access:        e.Access,
+		Cost:          e.Cost,
+		CachingInfo:   e.CachingInfo,
+		FilePath:      e.FilePath,
+		DirectoryPath: e.ExpandedDirectoryPath,
+	}
+}
+
 func (e *FileCacheEntry) inUse() bool {
 	return e.directoryInUseCount > 0 || e.fileInUseCount > 0
 }
 
-func (e *FileCacheEntry) decrementUse() {
-	e.decrementFileInUseCount()
-	e.decrementDirectoryInUseCount()
+// evictable reports whether the entry may be evicted to make room.
+func (e *FileCacheEntry) evictable() bool {
+	return !e.inUse() && !e.Pinned
+}
+
+func (e *FileCacheEntry) decrementUse() error {
+	return errors.Join(e.decrementFileInUseCount(), e.decrementDirectoryInUseCount())
 }
 
 func (e *FileCacheEntry) incrementDirectoryInUseCount() {
 	e.directoryInUseCount++
 }
 
-func (e *FileCacheEntry) decrementDirectoryInUseCount() {
+// decrementDirectoryInUseCount returns the error from deleting the directory,
+// if it was deleted.
+func (e *FileCacheEntry) decrementDirectoryInUseCount() error {
 	e.directoryInUseCount--
+	if e.cache != nil && !e.inUse() {
+		e.cache.signalRoomFreed()
+	}
 
 	// Delete the directory if the tarball is the only asset
 	// being used or if the directory has been removed (in use count -1)
+	var err error
 	if e.directoryInUseCount < 0 || (e.directoryInUseCount == 0 && e.fileInUseCount > 0) {
-		err := os.RemoveAll(e.ExpandedDirectoryPath)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, "Unable to delete cached directory", err)
+		if e.ExpandedDirectoryPath != "" {
+			err = removeAll(e.ExpandedDirectoryPath)
 		}
-		e.ExpandedDirectoryPath = ""
 
-		if e.fileInUseCount > 0 {
-			e.Size = e.Size / 2
-		}
+		e.change(func() {
+			e.ExpandedDirectoryPath = ""
+			if e.fileInUseCount > 0 {
+				e.Size = e.Size / 2
+			}
+		})
 	}
+	return err
 }
 
 func (e *FileCacheEntry) incrementFileInUseCount() {
 	e.fileInUseCount++
 }
 
-func (e *FileCacheEntry) decrementFileInUseCount() {
+// decrementFileInUseCount returns the error from deleting the file, if it was
+// deleted.
+func (e *FileCacheEntry) decrementFileInUseCount() error {
 	e.fileInUseCount--
+	if e.cache != nil && !e.inUse() {
+		e.cache.signalRoomFreed()
+	}
 
 	// Delete the file if the file is not being used and there is
 	// a directory of if the file has been removed (in use count -1)
+	var err error
 	if e.fileInUseCount < 0 || (e.fileInUseCount == 0 && e.directoryInUseCount > 0) {
-		err := os.RemoveAll(e.FilePath)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, "Unable to delete cached file", err)
-		}
+		err = removeAll(e.FilePath)
 
 		if e.directoryInUseCount > 0 {
-			e.Size = e.Size / 2
+			e.change(func() {
+				e.Size = e.Size / 2
+			})
 		}
 	}
+	return err
 }
 
 func (e *FileCacheEntry) fileDoesNotExist() bool {
@@ -125,37 +743,85 @@ func (e *FileCacheEntry) dirDoesNotExist() bool {
 	return os.IsNotExist(err)
 }
 
-// Can we change this to be an io.ReadCloser return
-func (e *FileCacheEntry) readCloser() (*CachedFile, error) {
-	var f *os.File
-	var err error
+// ensureFile recreates the cached file from the expanded directory if only
+// the directory is present.
+func (e *FileCacheEntry) ensureFile() error {
+	if !e.fileDoesNotExist() {
+		return nil
+	}
 
-	if e.fileDoesNotExist() {
-		f, err = os.Create(e.FilePath)
-		if err != nil {
-			return nil, err
-		}
+	f, err := os.Create(e.FilePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
 
-		err = compressor.WriteTar(e.ExpandedDirectoryPath+"/", f)
-		if err != nil {
-			return nil, err
+	if e.Compressed {
+		w := gzip.NewWriter(f)
+		err = compressor.WriteTar(e.ExpandedDirectoryPath+"/", w)
+		if err == nil {
+			err = w.Close()
 		}
+	} else {
+		err = compressor.WriteTar(e.ExpandedDirectoryPath+"/", f)
+	}
+	if err != nil {
+		return err
+	}
 
-		// If the directory is not used remove it
-		if e.directoryInUseCount == 0 {
-			err = os.RemoveAll(e.ExpandedDirectoryPath)
-			if err != nil {
-				fmt.Fprintln(os.Stderr, "Unable to remove cached directory", err)
-			}
-		} else {
-			// Double the size to account for both assets
-			e.Size = e.Size * 2
+	// If the directory is not used remove it
+	if e.directoryInUseCount == 0 {
+		err = os.RemoveAll(e.ExpandedDirectoryPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to remove cached directory", err)
 		}
 	} else {
-		f, err = os.Open(e.FilePath)
+		// Double the size to account for both assets
+		e.change(func() {
+			e.Size = e.Size * 2
+		})
+	}
+	return nil
+}
+
+// acquire marks the cached file as in use until it is released by path.
+func (e *FileCacheEntry) acquire() (string, error) {
+	err := e.ensureFile()
+	if err != nil {
+		return "", err
+	}
+
+	e.incrementFileInUseCount()
+	e.acquiredCount++
+	return e.FilePath, nil
+}
+
+// open opens the entry's file for reading, decompressing it if needed.
+func (e *FileCacheEntry) open() (io.ReadCloser, error) {
+	if e.Compressed {
+		return openCompressed(e.FilePath)
+	}
+	return os.Open(e.FilePath)
+}
+
+// Can we change this to be an io.ReadCloser return
+func (e *FileCacheEntry) readCloser() (*CachedFile, error) {
+	err := e.ensureFile()
+	if err != nil {
+		return nil, err
+	}
+
+	if e.Compressed {
+		path, err := decompressFile(e.FilePath)
 		if err != nil {
 			return nil, err
 		}
+		return tempFileRemoveOnClose(path)
+	}
+
+	f, err := os.Open(e.FilePath)
+	if err != nil {
+		return nil, err
 	}
 
 	e.incrementFileInUseCount()
@@ -166,8 +832,11 @@ func (e *FileCacheEntry) readCloser() (*CachedFile, error) {
 
 	readCloser := NewFileCloser(f, func(filePath string) {
 		lock.Lock()
-		e.decrementFileInUseCount()
+		err := e.decrementFileInUseCount()
 		lock.Unlock()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to delete cached file", err)
+		}
 	})
 
 	return readCloser, nil
@@ -176,8 +845,15 @@ func (e *FileCacheEntry) readCloser() (*CachedFile, error) {
 func (e *FileCacheEntry) expandedDirectory() (string, error) {
 	// if it has not been extracted before expand it!
 	if e.dirDoesNotExist() {
-		e.ExpandedDirectoryPath = e.FilePath + ".d"
-		err := extractTarToDirectory(e.FilePath, e.ExpandedDirectoryPath)
+		e.change(func() {
+			e.ExpandedDirectoryPath = e.FilePath + ".d"
+		})
+		var err error
+		if e.Compressed {
+			err = extractor.NewTgz().Extract(e.FilePath, e.ExpandedDirectoryPath)
+		} else {
+			err = extractTarToDirectory(e.FilePath, e.ExpandedDirectoryPath)
+		}
 		if err != nil {
 			return "", err
 		}
@@ -196,6 +872,61 @@ func (e *FileCacheEntry) expandedDirectory() (string, error) {
 	return e.ExpandedDirectoryPath, nil
 }
 
+// expandedDirectory is the entry's expandedDirectory, applying DirMode and
+// FileMode to the directory if it expands it.
+func (c *FileCache) expandedDirectory(e *FileCacheEntry) (string, error) {
+	expanding := e.dirDoesNotExist()
+	dir, err := e.expandedDirectory()
+	if err != nil || !expanding {
+		return dir, err
+	}
+
+	err = c.chmodDirectory(dir)
+	if err != nil {
+		// #nosec G104 - the directory was just handed out
+		e.decrementDirectoryInUseCount()
+		return "", err
+	}
+	return dir, nil
+}
+
+// chmodDirectory gives the directories under dir, dir included, DirMode and
+// the files FileMode, leaving the modes that are not set alone.
+func (c *FileCache) chmodDirectory(dir string) error {
+	if c.DirMode == 0 && c.FileMode == 0 {
+		return nil
+	}
+
+	type change struct {
+		path string
+		mode os.FileMode
+	}
+	changes := []change{}
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && c.DirMode != 0 {
+			changes = append(changes, change{path, c.DirMode})
+		} else if d.Type().IsRegular() && c.FileMode != 0 {
+			changes = append(changes, change{path, c.FileMode})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// children first, as a restrictive DirMode could lock out the rest
+	for i := len(changes) - 1; i >= 0; i-- {
+		err = os.Chmod(changes[i].path, changes[i].mode)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (c *FileCache) CloseDirectory(logger lager.Logger, cacheKey, dirPath string) error {
 	logger = logger.Session("file-cache.close-directory", lager.Data{"cache_key": cacheKey, "dir_path": dirPath})
 	lock.Lock()
@@ -211,8 +942,7 @@ func (c *FileCache) CloseDirectory(logger lager.Logger, cacheKey, dirPath string
 			return AlreadyClosed
 		}
 
-		entry.decrementDirectoryInUseCount()
-		return nil
+		return entry.decrementDirectoryInUseCount()
 	}
 
 	// Key didn't match anything in the current cache, so
@@ -222,149 +952,3413 @@ func (c *FileCache) CloseDirectory(logger lager.Logger, cacheKey, dirPath string
 		return EntryNotFound
 	}
 
-	entry.decrementDirectoryInUseCount()
+	err := entry.decrementDirectoryInUseCount()
 	if !entry.inUse() {
 		// done with this old entry, so clean it up
 		delete(c.OldEntries, cacheKey+dirPath)
+		c.mutated()
 	}
-	return nil
+	return err
 }
 
+// NoCache can be passed as the size to Add to move a file into the cache
+// directory without caching it. Any negative size has the same effect.
+const NoCache int64 = -1
+
+// Add moves sourcePath into the cache as the entry for cacheKey and returns
+// the cached file, opened for reading.
+//
+// If size is negative (see NoCache) the file is moved into the cache directory
+// but not tracked: it does not count toward the used space, it is never
+// returned for cacheKey, and any existing entry for cacheKey is kept. The
+// returned file is deleted when it is closed.
+//
+// If room for the file cannot be made because the entries that would have to
+// be evicted are in use, CacheBusyErr is returned and sourcePath is left
+// where it was. A file larger than the whole cache is still added.
 func (c *FileCache) Add(logger lager.Logger, cacheKey, sourcePath string, size int64, cachingInfo CachingInfoType) (*CachedFile, error) {
-	logger = logger.Session("file-cache.add", lager.Data{"cache_key": cacheKey, "source_path": sourcePath, "size": size})
-	lock.Lock()
-	defer lock.Unlock()
+	return c.AddWithOptions(context.Background(), logger, cacheKey, sourcePath, size, cachingInfo, AddOptions{})
+}
+
+// AddWithContext adds a file like Add. If ctx is done before the file has been
+// moved into the cache, the move is aborted, any partial copy is removed, and
+// ctx's error is returned.
+func (c *FileCache) AddWithContext(ctx context.Context, logger lager.Logger, cacheKey, sourcePath string, size int64, cachingInfo CachingInfoType) (*CachedFile, error) {
+	return c.AddWithOptions(ctx, logger, cacheKey, sourcePath, size, cachingInfo, AddOptions{})
+}
+
+// AddWithDeadline adds a file like AddWithContext, except that when room
+// cannot be made because the entries that would have to be evicted are in use
+// or pinned, it waits for them to be released, unpinned or removed, until ctx
+// is done, rather than failing straight away. CacheBusyErr is returned if ctx
+// is done first.
+func (c *FileCache) AddWithDeadline(ctx context.Context, logger lager.Logger, cacheKey, sourcePath string, size int64, cachingInfo CachingInfoType) (*CachedFile, error) {
+	return c.AddWithOptions(ctx, logger, cacheKey, sourcePath, size, cachingInfo, AddOptions{Wait: true})
+}
+
+// AddOptions are the settings of an entry added with AddWithOptions. They can
+// be combined, and the zero value adds a file like AddWithContext.
+type AddOptions struct {
+	// TTL, if positive, makes the entry expire once it has elapsed. Expired
+	// entries are treated as absent on lookup and are evicted before any
+	// other entry.
+	TTL time.Duration
+	// Cost is the cost of fetching the file again. The entry with the lowest
+	// cost per byte is evicted first; entries with the same cost per byte,
+	// such as entries added without a cost, are evicted by the cache's policy.
+	Cost float64
+	// Tags is arbitrary metadata attached to the entry, which can be read back
+	// with Tags and is saved with the entry. The tags are copied.
+	Tags map[string]string
+	// Checksum, if set, is recorded so that the cached file can later be
+	// checked with Verify.
+	Checksum ChecksumInfoType
+	// Wait, if set, makes an add that cannot make room because the entries
+	// that would have to be evicted are in use or pinned wait for them to be
+	// released, unpinned or removed until ctx is done, as AddWithDeadline
+	// does.
+	Wait bool
+}
 
+// AddWithOptions adds a file like AddWithContext, with the settings in opts.
+func (c *FileCache) AddWithOptions(ctx context.Context, logger lager.Logger, cacheKey, sourcePath string, size int64, cachingInfo CachingInfoType, opts AddOptions) (*CachedFile, error) {
+	logger = logger.Session("file-cache.add", lager.Data{"cache_key": cacheKey, "source_path": sourcePath, "size": size})
 	logger.Info("starting")
 	defer logger.Info("finished")
 
-	oldEntry := c.Entries[cacheKey]
-
-	c.makeRoom(logger, size, "")
+	if size < 0 {
+		return c.addUncached(ctx, logger, cacheKey, sourcePath)
+	}
 
-	c.Seq++
-	uniqueName := fmt.Sprintf("%s-%d-%d", cacheKey, time.Now().UnixNano(), c.Seq)
-	cachePath := filepath.Join(c.CachedPath, uniqueName)
+	file, _, err := c.addAndOpen(ctx, logger, cacheKey, sourcePath, size, cachingInfo, addRequest{AddOptions: opts})
+	return file, err
+}
 
-	err := os.Rename(sourcePath, cachePath)
+// addUncached moves sourcePath into the cache directory without tracking it,
+// for an add with a negative size, and opens it to be deleted on close.
+func (c *FileCache) addUncached(ctx context.Context, logger lager.Logger, cacheKey, sourcePath string) (*CachedFile, error) {
+	stagedPath, restore, err := c.stage(ctx, logger, cacheKey, sourcePath)
 	if err != nil {
 		return nil, err
 	}
+	defer restore()
 
-	newEntry := newFileCacheEntry(cachePath, size, cachingInfo)
-	c.Entries[cacheKey] = newEntry
-	if oldEntry != nil {
-		oldEntry.decrementUse()
-		c.updateOldEntries(logger, cacheKey, oldEntry)
-	}
-	return newEntry.readCloser()
-}
-
-func (c *FileCache) AddDirectory(logger lager.Logger, cacheKey, sourcePath string, size int64, cachingInfo CachingInfoType) (string, error) {
-	logger = logger.Session("file-cache.add-directory", lager.Data{"cache_key": cacheKey, "source_path": sourcePath, "size": size})
 	lock.Lock()
 	defer lock.Unlock()
+	defer c.startSpan("file-cache.add").End()
 
-	logger.Info("starting")
-	defer logger.Info("finished")
-
-	oldEntry := c.Entries[cacheKey]
-
-	c.makeRoom(logger, size, "")
-
-	c.Seq++
-	uniqueName := fmt.Sprintf("%s-%d-%d", cacheKey, time.Now().UnixNano(), c.Seq)
-	cachePath := filepath.Join(c.CachedPath, uniqueName)
+	if c.closed {
+		return nil, ClosedErr
+	}
+	logger.Info("not-caching")
+	name, err := c.filename(cacheKey, filepath.Base(sourcePath))
+	if err != nil {
+		return nil, err
+	}
+	cachePath := c.nextCachePath(name)
+	err = c.moveFile(ctx, logger, stagedPath, cachePath)
+	if err != nil {
+		return nil, err
+	}
+	return tempFileRemoveOnClose(cachePath)
+}
+
+// addRequest is what add adds besides the file: the options of
+// AddWithOptions, and the settings the other ways of adding an entry need.
+type addRequest struct {
+	AddOptions
+	// namespace is the namespace the entry is added through, if any, whose
+	// limit is kept as well as the cache's
+	namespace *Namespace
+	// origin is the URL the file was loaded from, if any
+	origin string
+	// mustFit fails the add with DoesNotFitErr instead of adding a file that
+	// does not fit in the cache even once every other entry is evicted
+	mustFit bool
+	// ifChanged skips the add with unchangedErr if the entry for the key
+	// already has the same caching info, see AddIfNewer
+	ifChanged bool
+	// prepare, if set, runs on the new entry before it is tracked, and the
+	// add is undone if it fails
+	prepare func(*FileCacheEntry) error
+	// directory adds the source as an expanded directory rather than a file,
+	// see AddExpandedDirectory
+	directory bool
+}
+
+// unchangedErr is returned by addFile for requests with ifChanged set when
+// the entry is unchanged.
+var unchangedErr = errors.New("Entry is unchanged")
+
+// apply sets the settings of the request on newEntry.
+func (r addRequest) apply(newEntry *FileCacheEntry) {
+	if r.TTL > 0 {
+		newEntry.Expiry = newEntry.Access.Add(r.TTL)
+	}
+	newEntry.Cost = r.Cost
+	newEntry.Tags = maps.Clone(r.Tags)
+	newEntry.Checksum = r.Checksum
+	newEntry.Origin = r.origin
+	if r.namespace != nil {
+		newEntry.Namespace = r.namespace.name
+	}
+}
+
+// addAndOpen adds a file with addFile and opens the new entry's file for
+// reading.
+func (c *FileCache) addAndOpen(ctx context.Context, logger lager.Logger, cacheKey, sourcePath string, size int64, cachingInfo CachingInfoType, req addRequest) (*CachedFile, []string, error) {
+	var file *CachedFile
+	req.prepare = func(newEntry *FileCacheEntry) (err error) {
+		file, err = newEntry.readCloser()
+		return err
+	}
+	evicted, err := c.addFile(ctx, logger, cacheKey, sourcePath, size, cachingInfo, req)
+	if err != nil {
+		return nil, evicted, err
+	}
+	return file, evicted, nil
+}
+
+// addFile is the common path of the adds of a file: it stages sourcePath
+// without holding the lock, then adds it with add, waiting whenever the cache
+// is busy if the request asks to, and returns the keys evicted to make room.
+// Adds of the same key are serialized by the key's stripe, which is released
+// before evictions are notified, so that OnEvict may add the key again.
+func (c *FileCache) addFile(ctx context.Context, logger lager.Logger, cacheKey, sourcePath string, size int64, cachingInfo CachingInfoType, req addRequest) ([]string, error) {
+	defer c.notifyEvictions()
+	defer c.lockKey(cacheKey).Unlock()
+	if req.ifChanged && c.unchanged(logger, cacheKey, cachingInfo) {
+		logger.Info("unchanged")
+		return nil, unchangedErr
+	}
+
+	stage, sourceName := c.stage, filepath.Base(sourcePath)
+	if req.directory {
+		stage, sourceName = c.stageDirectory, ""
+	}
+	stagedPath, restore, err := stage(ctx, logger, cacheKey, sourcePath)
+	if err != nil {
+		return nil, err
+	}
+	defer restore()
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	evicted := []string{}
+	for {
+		var e []string
+		e, err = c.add(ctx, logger, cacheKey, stagedPath, sourceName, size, cachingInfo, req)
+		evicted = append(evicted, e...)
+		if err != CacheBusyErr || !req.Wait {
+			return evicted, err
+		}
+
+		logger.Info("waiting-for-room")
+		roomFreed := c.roomFreed()
+		lock.Unlock()
+		select {
+		case <-ctx.Done():
+			lock.Lock()
+			return evicted, CacheBusyErr
+		case <-roomFreed:
+		}
+		lock.Lock()
+	}
+}
+
+// roomFreed returns a channel that is closed the next time an entry may be
+// evicted that could not be before, or leaves the cache. It must be called
+// with the lock held.
+func (c *FileCache) roomFreed() <-chan struct{} {
+	if c.freed == nil {
+		c.freed = make(chan struct{})
+	}
+	return c.freed
+}
+
+// signalRoomFreed wakes up the adds waiting for room. It must be called with
+// the lock held.
+func (c *FileCache) signalRoomFreed() {
+	if c.freed != nil {
+		close(c.freed)
+		c.freed = nil
+	}
+}
+
+// oversizedDir is the directory in the cache directory that AddOversized
+// keeps files too large for the cache in. Nothing in it is tracked, so Load
+// removes whatever is left there.
+const oversizedDir = "oversized"
+
+// AddOversized adds a file like Add if it fits in the cache. A file larger
+// than the whole cache is instead moved to a separate directory, where it
+// never counts toward the used space and is never evicted, and is deleted as
+// soon as the returned file is closed; any entry for cacheKey is kept. Either
+// way the caller must close the returned file.
+func (c *FileCache) AddOversized(logger lager.Logger, cacheKey, sourcePath string, size int64, cachingInfo CachingInfoType) (*CachedFile, error) {
+	logger = logger.Session("file-cache.add-oversized", lager.Data{"cache_key": cacheKey, "source_path": sourcePath, "size": size})
+	logger.Info("starting")
+	defer logger.Info("finished")
+
+	lock.RLock()
+	maxSizeInBytes := c.maxSizeInBytes
+	lock.RUnlock()
+	if c.roundToBlock(size) <= maxSizeInBytes {
+		file, _, err := c.addAndOpen(context.Background(), logger, cacheKey, sourcePath, size, cachingInfo, addRequest{})
+		return file, err
+	}
+
+	stagedPath, restore, err := c.stage(context.Background(), logger, cacheKey, sourcePath)
+	if err != nil {
+		return nil, err
+	}
+	defer restore()
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if c.closed {
+		return nil, ClosedErr
+	}
+
+	logger.Info("bypassing-cache", lager.Data{"max_bytes": maxSizeInBytes})
+	name, err := c.filename(cacheKey, filepath.Base(sourcePath))
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(c.CachedPath, oversizedDir)
+	err = os.MkdirAll(dir, 0750)
+	if err != nil {
+		return nil, err
+	}
+	placeholder, err := os.CreateTemp(dir, name+"-*")
+	if err != nil {
+		return nil, err
+	}
+	// #nosec G104 - the file is only a placeholder for the move
+	placeholder.Close()
+
+	err = moveFile(context.Background(), stagedPath, placeholder.Name())
+	if err != nil {
+		os.Remove(placeholder.Name())
+		return nil, err
+	}
+	return tempFileRemoveOnClose(placeholder.Name())
+}
+
+// AddResult is the outcome of AddWithResult.
+type AddResult struct {
+	File *CachedFile
+	// Evicted holds the keys that were evicted to make room for the file, in
+	// the order they were evicted.
+	Evicted []string
+}
+
+// AddWithResult adds a file like Add and also reports which entries were
+// evicted to make room for it, so that callers can drop state derived from
+// them.
+func (c *FileCache) AddWithResult(logger lager.Logger, cacheKey, sourcePath string, size int64, cachingInfo CachingInfoType) (AddResult, error) {
+	logger = logger.Session("file-cache.add-with-result", lager.Data{"cache_key": cacheKey, "source_path": sourcePath, "size": size})
+	logger.Info("starting")
+	defer logger.Info("finished")
+
+	file, evicted, err := c.addAndOpen(context.Background(), logger, cacheKey, sourcePath, size, cachingInfo, addRequest{})
+	return AddResult{File: file, Evicted: evicted}, err
+}
+
+// AddIfNewer adds a file like Add unless the entry for cacheKey already has
+// the same ETag and Last-Modified, in which case the entry only records an
+// access, sourcePath is left where it is, and false is returned. ETags are
+// compared weakly (see ETagMatches). An incoming cachingInfo without either
+// header always replaces the entry.
+func (c *FileCache) AddIfNewer(logger lager.Logger, cacheKey, sourcePath string, size int64, cachingInfo CachingInfoType) (bool, error) {
+	logger = logger.Session("file-cache.add-if-newer", lager.Data{"cache_key": cacheKey, "source_path": sourcePath, "size": size})
+	logger.Info("starting")
+	defer logger.Info("finished")
+
+	_, err := c.addFile(context.Background(), logger, cacheKey, sourcePath, size, cachingInfo, addRequest{ifChanged: true})
+	if err == unchangedErr {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// unchanged reports whether the entry for cacheKey matches cachingInfo,
+// recording an access if so. Evictions of expired entries are left for the
+// caller to notify.
+func (c *FileCache) unchanged(logger lager.Logger, cacheKey string, cachingInfo CachingInfoType) bool {
+	defer c.fetchDemoted(logger, cacheKey)()
+	lock.Lock()
+	defer lock.Unlock()
+
+	entry := c.lookup(logger, cacheKey)
+	if entry != nil && cachingInfo.isCacheable() && entry.CachingInfo.Matches(cachingInfo) {
+		entry.recordAccess()
+		return true
+	}
+	return false
+}
+
+// AddWithTTL adds a file like Add, but the entry expires once ttl has elapsed.
+// Expired entries are treated as absent on lookup and are evicted before any
+// other entry. A zero ttl never expires. It is AddWithOptions with a TTL.
+func (c *FileCache) AddWithTTL(logger lager.Logger, cacheKey, sourcePath string, size int64, cachingInfo CachingInfoType, ttl time.Duration) (*CachedFile, error) {
+	return c.AddWithOptions(context.Background(), logger, cacheKey, sourcePath, size, cachingInfo, AddOptions{TTL: ttl})
+}
+
+// AddWithCost adds a file like Add with the given cost of fetching it again.
+// The entry with the lowest cost per byte is evicted first; entries with the
+// same cost per byte, such as entries added without a cost, are evicted by the
+// cache's policy. It is AddWithOptions with a Cost.
+func (c *FileCache) AddWithCost(logger lager.Logger, cacheKey, sourcePath string, size int64, cachingInfo CachingInfoType, cost float64) (*CachedFile, error) {
+	return c.AddWithOptions(context.Background(), logger, cacheKey, sourcePath, size, cachingInfo, AddOptions{Cost: cost})
+}
+
+// AddWithTags adds a file like Add and attaches tags to the entry, which can
+// be read back with Tags and are saved with the entry. The tags are copied.
+// It is AddWithOptions with Tags.
+func (c *FileCache) AddWithTags(logger lager.Logger, cacheKey, sourcePath string, size int64, cachingInfo CachingInfoType, tags map[string]string) (*CachedFile, error) {
+	return c.AddWithOptions(context.Background(), logger, cacheKey, sourcePath, size, cachingInfo, AddOptions{Tags: tags})
+}
+
+// AddWithChecksum adds a file like Add and records its checksum, so that the
+// cached file can later be checked with Verify. It is AddWithOptions with a
+// Checksum.
+func (c *FileCache) AddWithChecksum(logger lager.Logger, cacheKey, sourcePath string, size int64, cachingInfo CachingInfoType, checksum ChecksumInfoType) (*CachedFile, error) {
+	return c.AddWithOptions(context.Background(), logger, cacheKey, sourcePath, size, cachingInfo, AddOptions{Checksum: checksum})
+}
+
+// Verify re-hashes the cached file for cacheKey and reports whether it still
+// matches the checksum recorded by AddWithChecksum. Entries added without a
+// checksum are always reported as valid.
+func (c *FileCache) Verify(logger lager.Logger, cacheKey string) (bool, error) {
+	logger = logger.Session("file-cache.verify", lager.Data{"cache_key": cacheKey})
+	lock.RLock()
+	defer lock.RUnlock()
+
+	logger.Info("starting")
+	defer logger.Info("finished")
+
+	if c.closed {
+		return false, ClosedErr
+	}
+
+	entry := c.Entries[cacheKey]
+	if entry == nil {
+		return false, EntryNotFound
+	}
+	return entry.checksumMatches()
+}
+
+// AddStream adds the contents of r to the cache without the caller staging a
+// file. The stream is written to a temporary file in the cache directory and
+// then added like Add. A stream larger than the cache is discarded with
+// TooLargeErr, and one larger than MaxEntryBytes with EntryTooLargeErr. Only
+// AddStream returns TooLargeErr: Add still takes files larger than the cache.
+// The number of bytes read from r is returned either way.
+//
+// Concurrent calls for the same key are collapsed: only the first reads its
+// stream, and the others return its result without reading theirs.
+func (c *FileCache) AddStream(logger lager.Logger, cacheKey string, r io.Reader, cachingInfo CachingInfoType) (added bool, written int64, err error) {
+	logger = logger.Session("file-cache.add-stream", lager.Data{"cache_key": cacheKey})
+	logger.Info("starting")
+	defer logger.Info("finished")
+
+	l, leader := c.startLoad(cacheKey)
+	if !leader {
+		logger.Info("waiting-for-concurrent-add")
+		<-l.done
+		return l.added, l.written, l.err
+	}
+	defer c.finishLoad(cacheKey, l)
+	defer func() {
+		l.added, l.written, l.err = added, written, err
+	}()
+
+	lock.RLock()
+	maxSizeInBytes, maxEntryBytes, closed := c.maxSizeInBytes, c.MaxEntryBytes, c.closed
+	lock.RUnlock()
+	if closed {
+		return false, 0, ClosedErr
+	}
+	limit, limitErr := maxSizeInBytes, TooLargeErr
+	if maxEntryBytes > 0 && maxEntryBytes < maxSizeInBytes {
+		limit, limitErr = maxEntryBytes, EntryTooLargeErr
+	}
+
+	// the stream is written without holding the lock
+	file, err := c.tempFile(logger, cacheKey)
+	if err != nil {
+		return false, 0, err
+	}
+	defer os.Remove(file.Name())
+
+	written, err = io.CopyN(file, r, limit+1)
+	closeErr := file.Close()
+	if err != nil && err != io.EOF {
+		logger.Error("failed-to-write-stream", err)
+		return false, written, err
+	}
+	if closeErr != nil {
+		return false, written, closeErr
+	}
+	if written > limit {
+		logger.Info("stream-too-large", lager.Data{"limit": limit})
+		return false, written, limitErr
+	}
+
+	defer c.notifyEvictions()
+	defer c.lockKey(cacheKey).Unlock()
+	lock.Lock()
+	defer lock.Unlock()
+
+	_, err = c.add(context.Background(), logger, cacheKey, file.Name(), "", written, cachingInfo, addRequest{})
+	if err != nil {
+		return false, written, err
+	}
+	return true, written, nil
+}
+
+func (c *FileCache) AddDirectory(logger lager.Logger, cacheKey, sourcePath string, size int64, cachingInfo CachingInfoType) (string, error) {
+	return c.AddDirectoryWithContext(context.Background(), logger, cacheKey, sourcePath, size, cachingInfo)
+}
+
+// AddDirectoryWithContext adds a tarball like AddDirectory, aborting the move
+// into the cache if ctx is done, as AddWithContext does.
+func (c *FileCache) AddDirectoryWithContext(ctx context.Context, logger lager.Logger, cacheKey, sourcePath string, size int64, cachingInfo CachingInfoType) (string, error) {
+	defer c.startSpan("file-cache.add-directory").End()
+	logger = logger.Session("file-cache.add-directory", lager.Data{"cache_key": cacheKey, "source_path": sourcePath, "size": size})
+	logger.Info("starting")
+	defer logger.Info("finished")
+
+	var dirPath string
+	_, err := c.addFile(ctx, logger, cacheKey, sourcePath, size, cachingInfo, addRequest{prepare: func(newEntry *FileCacheEntry) (err error) {
+		dirPath, err = c.expandedDirectory(newEntry)
+		return err
+	}})
+	if err != nil {
+		return "", err
+	}
+	return dirPath, nil
+}
+
+// SeedEntry describes a pre-populated file for Seed to adopt.
+type SeedEntry struct {
+	CacheKey    string
+	SourcePath  string
+	CachingInfo CachingInfoType
+	// Checksum, if set, is verified before the file is adopted.
+	Checksum ChecksumInfoType
+}
+
+// Seed adopts pre-populated files into the cache, for example ones shipped
+// to an air-gapped environment alongside a manifest. Each file is validated
+// and added like Add, in order, evicting entries as needed to stay under the
+// cache's limit. Files that are missing, fail their checksum or do not fit
+// the cache (DoesNotFitErr) are left where they are, and the returned error
+// joins the reasons for each of them.
+func (c *FileCache) Seed(logger lager.Logger, files []SeedEntry) error {
+	logger = logger.Session("file-cache.seed", lager.Data{"files": len(files)})
+	logger.Info("starting")
+	defer logger.Info("finished")
+
+	var errs []error
+	for _, file := range files {
+		err := c.seed(logger, file)
+		if err != nil {
+			logger.Error("failed-to-seed", err, lager.Data{"cache_key": file.CacheKey, "source_path": file.SourcePath})
+			errs = append(errs, fmt.Errorf("could not seed %s: %w", file.CacheKey, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (c *FileCache) seed(logger lager.Logger, file SeedEntry) error {
+	if file.CacheKey == "" {
+		return MissingCacheKeyErr
+	}
+
+	info, err := os.Stat(file.SourcePath)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", file.SourcePath)
+	}
+
+	if file.Checksum.Algorithm != "" || file.Checksum.Value != "" {
+		f, err := os.Open(file.SourcePath)
+		if err != nil {
+			return err
+		}
+		err = validateChecksum(f, file.Checksum)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = c.addFile(context.Background(), logger, file.CacheKey, file.SourcePath, info.Size(), file.CachingInfo, addRequest{
+		AddOptions: AddOptions{Checksum: file.Checksum},
+		mustFit:    true,
+	})
+	return err
+}
+
+// Namespace is a partition of a FileCache with its own size limit, for
+// example one per tenant of a shared cache. Adding a file through a namespace
+// only evicts entries of the same namespace to stay under its limit, so one
+// namespace cannot push out the entries of another; the limit of the cache
+// still caps the entries of all namespaces together. Namespaces share the
+// keys of the cache, so adding a key through a namespace replaces an entry
+// for the same key added any other way.
+type Namespace struct {
+	cache *FileCache
+	name  string
+}
+
+// Namespace returns the namespace called name, limiting it to
+// maxSizeInBytes. Calling it again for the same name changes the limit, which
+// is enforced on the next add. Limits are not saved by Save, so namespaces
+// should be created again after Load. Once the cache is closed the limit is
+// not recorded, and the namespace fails like the cache with ClosedErr.
+func (c *FileCache) Namespace(name string, maxSizeInBytes int64) *Namespace {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if c.closed {
+		return &Namespace{cache: c, name: name}
+	}
+	if c.quotas == nil {
+		c.quotas = map[string]int64{}
+	}
+	c.quotas[name] = maxSizeInBytes
+	return &Namespace{cache: c, name: name}
+}
+
+// Name returns the name of the namespace.
+func (n *Namespace) Name() string {
+	return n.name
+}
+
+// Add adds a file to the namespace like FileCache.Add, also evicting entries
+// of the namespace as needed to keep it under its limit.
+func (n *Namespace) Add(logger lager.Logger, cacheKey, sourcePath string, size int64, cachingInfo CachingInfoType) (*CachedFile, error) {
+	c := n.cache
+	logger = logger.Session("file-cache.namespace-add", lager.Data{"namespace": n.name, "cache_key": cacheKey, "source_path": sourcePath, "size": size})
+	logger.Info("starting")
+	defer logger.Info("finished")
+
+	file, _, err := c.addAndOpen(context.Background(), logger, cacheKey, sourcePath, size, cachingInfo, addRequest{namespace: n})
+	return file, err
+}
+
+// Get returns the cached file for cacheKey like FileCache.Get, or
+// EntryNotFound if the entry was not added through the namespace.
+func (n *Namespace) Get(logger lager.Logger, cacheKey string) (*CachedFile, CachingInfoType, error) {
+	logger = logger.Session("file-cache.namespace-get", lager.Data{"namespace": n.name, "cache_key": cacheKey})
+	return n.cache.get(logger, cacheKey, n)
+}
+
+// Acquire returns the path of the cached file for cacheKey like
+// FileCache.Acquire, or EntryNotFound if the entry was not added through the
+// namespace. The path must be released with FileCache.Release.
+func (n *Namespace) Acquire(logger lager.Logger, cacheKey string) (string, error) {
+	logger = logger.Session("file-cache.namespace-acquire", lager.Data{"namespace": n.name, "cache_key": cacheKey})
+	return n.cache.acquire(logger, cacheKey, n)
+}
+
+// UsedBytes returns the space accounted to the entries of the namespace.
+func (n *Namespace) UsedBytes() int64 {
+	lock.RLock()
+	defer lock.RUnlock()
+	return spaceUsedBy(n.cache.namespaceEntries(n.name))
+}
+
+// filter returns entry if it belongs to the namespace, or to any namespace
+// when n is nil.
+func (n *Namespace) filter(entry *FileCacheEntry) *FileCacheEntry {
+	if n == nil || entry == nil || entry.Namespace == n.name {
+		return entry
+	}
+	return nil
+}
+
+// namespaceEntries returns the entries added through the namespace called
+// name.
+func (c *FileCache) namespaceEntries(name string) map[string]*FileCacheEntry {
+	entries := map[string]*FileCacheEntry{}
+	for cacheKey, entry := range c.Entries {
+		if entry.Namespace == name {
+			entries[cacheKey] = entry
+		}
+	}
+	return entries
+}
+
+// planNamespaceRoom selects the entries of the namespace called name to
+// evict, besides the victims already planned, so that size more bytes fit
+// under its limit, like planEviction does for the whole cache.
+func (c *FileCache) planNamespaceRoom(logger lager.Logger, name string, size int64, planned []string) []string {
+	quota, ok := c.quotas[name]
+	if !ok {
+		return nil
+	}
+
+	entries := c.namespaceEntries(name)
+	for _, victimCacheKey := range planned {
+		delete(entries, victimCacheKey)
+	}
+	result := c.planEvictionAmong(entries, spaceUsedBy(entries), quota-c.roundToBlock(size), "")
+	if !result.fits {
+		logger.Info("not-enough-space-in-namespace", lager.Data{"requested_bytes": size, "max_bytes": quota})
+	}
+	return result.evicted
+}
+
+// AddItem is a file for AddBatch to add, with the arguments Add takes for it.
+type AddItem struct {
+	CacheKey    string
+	SourcePath  string
+	Size        int64
+	CachingInfo CachingInfoType
+}
+
+// AddBatch adds many files at once, for example to warm the cache, taking the
+// lock once for all of them. Room is made once, after every file has been
+// added, so files replacing cached entries do not evict other entries on the
+// way; until then the cache may be over its limit. added reports which items
+// were added, and the returned error joins the reasons the others were not.
+// Sizes must not be negative.
+func (c *FileCache) AddBatch(logger lager.Logger, items []AddItem) (added []bool, err error) {
+	logger = logger.Session("file-cache.add-batch", lager.Data{"items": len(items)})
+	logger.Info("starting")
+	defer logger.Info("finished")
+
+	cacheKeys := make([]string, len(items))
+	for i, item := range items {
+		cacheKeys[i] = item.CacheKey
+	}
+	defer c.notifyEvictions()
+	defer c.lockKeys(cacheKeys)()
+
+	errs := make([]error, len(items))
+	stagedPaths := make([]string, len(items))
+	for i, item := range items {
+		if item.Size < 0 {
+			errs[i] = fmt.Errorf("invalid size %d", item.Size)
+			continue
+		}
+
+		stagedPath, restore, err := c.stage(context.Background(), logger, item.CacheKey, item.SourcePath)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		defer restore()
+		stagedPaths[i] = stagedPath
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	added = make([]bool, len(items))
+	c.batching = true
+	for i, item := range items {
+		if errs[i] != nil {
+			continue
+		}
+		_, errs[i] = c.add(context.Background(), logger, item.CacheKey, stagedPaths[i], filepath.Base(item.SourcePath), item.Size, item.CachingInfo, addRequest{})
+		added[i] = errs[i] == nil
+	}
+	c.batching = false
+	c.makeRoom(logger, 0, "")
+
+	var failures []error
+	for i, err := range errs {
+		if err != nil {
+			logger.Error("failed-to-add", err, lager.Data{"cache_key": items[i].CacheKey, "source_path": items[i].SourcePath})
+			failures = append(failures, fmt.Errorf("could not add %s: %w", items[i].CacheKey, err))
+		}
+	}
+	return added, errors.Join(failures...)
+}
+
+// keyStripes is the number of key locks of a cache.
+const keyStripes = 64
+
+func keyStripe(cacheKey string) int {
+	h := fnv.New32a()
+	h.Write([]byte(cacheKey))
+	return int(h.Sum32() % keyStripes)
+}
+
+// lockKey locks the stripe of cacheKey. Evictions must be notified only once
+// it is unlocked, as OnEvict may add to the same stripe.
+func (c *FileCache) lockKey(cacheKey string) *sync.Mutex {
+	l := &c.keyLocks[keyStripe(cacheKey)]
+	l.Lock()
+	return l
+}
+
+// lockKeys locks the stripes of all of cacheKeys, in stripe order so that
+// concurrent batches cannot deadlock, and returns a function unlocking them.
+func (c *FileCache) lockKeys(cacheKeys []string) (unlock func()) {
+	var stripes [keyStripes]bool
+	for _, cacheKey := range cacheKeys {
+		stripes[keyStripe(cacheKey)] = true
+	}
+	for i, locked := range stripes {
+		if locked {
+			c.keyLocks[i].Lock()
+		}
+	}
+	return func() {
+		for i, locked := range stripes {
+			if locked {
+				c.keyLocks[i].Unlock()
+			}
+		}
+	}
+}
+
+// stage moves sourcePath into the cache directory under a staging name, so
+// that a slow copy from another device happens without holding lock and the
+// move by add is a rename within the directory. Staged files are not
+// accounted for until they are added.
+//
+// A file that is already in the cache directory, for example one created
+// with TempFile, is not staged again: add renames it into place directly, and
+// moves it back if the add fails. The file of a cached entry is rejected with
+// InvalidSourceErr instead, as taking it over would leave that entry without
+// its file.
+//
+// A symlink is never moved into the cache: the file it points to is copied
+// instead, and the link is removed once the copy has been added. The file it
+// points to is left alone, even if it is in the cache directory.
+//
+// restore must be called once the staged file has been added. If the add
+// failed and left the file staged, it is moved back to sourcePath, or removed
+// if that fails.
+func (c *FileCache) stage(ctx context.Context, logger lager.Logger, cacheKey, sourcePath string) (string, func(), error) {
+	info, err := os.Lstat(sourcePath)
+	if err != nil {
+		return "", nil, err
+	}
+	symlink := info.Mode()&os.ModeSymlink != 0
+	if symlink {
+		info, err = os.Stat(sourcePath)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	if !info.Mode().IsRegular() {
+		// moving a directory, possibly one holding the cache, into the cache
+		// and deleting it on eviction could destroy the cache
+		return "", nil, fmt.Errorf("%w: %s is not a regular file", InvalidSourceErr, sourcePath)
+	}
+	if c.tracksFile(sourcePath) {
+		return "", nil, fmt.Errorf("%w: %s is the file of a cached entry", InvalidSourceErr, sourcePath)
+	}
+	if !symlink && filepath.Dir(sourcePath) == filepath.Clean(c.CachedPath) {
+		return sourcePath, func() {}, nil
+	}
+
+	staged, err := c.createTemp(logger, cacheKey+"-staging-*"+filepath.Ext(sourcePath))
+	if err != nil {
+		return "", nil, err
+	}
+	stagedPath := staged.Name()
+	// #nosec G104 - the file is only a placeholder for the move
+	staged.Close()
+
+	if symlink {
+		logger.Info("copying-symlink-target")
+		err = copyFile(ctx, sourcePath, stagedPath)
+	} else {
+		err = c.moveFile(ctx, logger, sourcePath, stagedPath)
+	}
+	if err != nil {
+		os.Remove(stagedPath)
+		return "", nil, err
+	}
+
+	restore := func() {
+		_, err := os.Lstat(stagedPath)
+		if symlink {
+			if err == nil {
+				os.Remove(stagedPath)
+				return
+			}
+			err = os.Remove(sourcePath)
+			if err != nil {
+				logger.Error("failed-to-remove-symlink", err)
+			}
+			return
+		}
+		if err != nil {
+			return
+		}
+		err = moveFile(context.Background(), stagedPath, sourcePath)
+		if err != nil {
+			logger.Error("failed-to-restore-source", err)
+			os.Remove(stagedPath)
+		}
+	}
+	return stagedPath, restore, nil
+}
+
+// stageDirectory moves sourceDir into a staging directory in the cache
+// directory, as stage does for a file. Directories are only ever renamed, so
+// sourceDir must be on the same filesystem as the cache. restore removes the
+// staging directory, moving sourceDir back first if the add failed.
+func (c *FileCache) stageDirectory(ctx context.Context, logger lager.Logger, cacheKey, sourceDir string) (string, func(), error) {
+	err := ctx.Err()
+	if err != nil {
+		return "", nil, err
+	}
+
+	info, err := os.Lstat(sourceDir)
+	if err != nil {
+		return "", nil, err
+	}
+	if !info.IsDir() {
+		return "", nil, fmt.Errorf("%w: %s is not a directory", InvalidSourceErr, sourceDir)
+	}
+	err = c.checkSourceDir(sourceDir)
+	if err != nil {
+		return "", nil, err
+	}
+	if c.tracksFile(sourceDir) {
+		return "", nil, fmt.Errorf("%w: %s is the directory of a cached entry", InvalidSourceErr, sourceDir)
+	}
+
+	staging, err := os.MkdirTemp(c.CachedPath, cacheKey+"-staging-*")
+	if err != nil {
+		return "", nil, err
+	}
+	stagedDir := filepath.Join(staging, "dir")
+	err = rename(sourceDir, stagedDir)
+	if err != nil {
+		os.Remove(staging)
+		return "", nil, err
+	}
+
+	restore := func() {
+		if _, err := os.Lstat(stagedDir); err == nil {
+			err = rename(stagedDir, sourceDir)
+			if err != nil {
+				logger.Error("failed-to-restore-source", err)
+				os.RemoveAll(stagedDir)
+			}
+		}
+		os.Remove(staging)
+	}
+	return stagedDir, restore, nil
+}
+
+// tracksFile reports whether path is the file or the expanded directory of an
+// entry, including entries that were replaced but are still in use.
+func (c *FileCache) tracksFile(path string) bool {
+	cachedPath, err := filepath.Abs(c.CachedPath)
+	if err != nil {
+		return false
+	}
+	source, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(cachedPath, source)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return false
+	}
+	// entries refer to their files by paths joined to CachedPath
+	path = filepath.Join(c.CachedPath, rel)
+
+	lock.RLock()
+	defer lock.RUnlock()
+	for _, entries := range []map[string]*FileCacheEntry{c.Entries, c.OldEntries} {
+		for _, entry := range entries {
+			if entry.FilePath == path || entry.ExpandedDirectoryPath == path {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// add moves sourcePath into the cache as the entry for cacheKey, with the
+// settings of req, returning the keys that were evicted to make room for it.
+//
+// The entry is only tracked once the prepare of req, if given, has succeeded
+// on it. If prepare fails the move is undone, so sourcePath is left where it was and
+// any previous entry for cacheKey is kept. A file that cannot be moved back is
+// removed rather than left untracked in the cache. Entries are only evicted
+// to make room once the entry is tracked, except for those evicted to keep
+// the free-space reserve, which stay evicted.
+func (c *FileCache) add(ctx context.Context, logger lager.Logger, cacheKey, sourcePath, sourceName string, size int64, cachingInfo CachingInfoType, req addRequest) ([]string, error) {
+	defer c.startSpan("file-cache.add").End()
+	if c.closed {
+		return nil, ClosedErr
+	}
+
+	err := c.validateKey(cacheKey)
+	if err != nil {
+		logger.Info("invalid-cache-key", lager.Data{"error": err.Error()})
+		return nil, err
+	}
+
+	name, err := c.filename(cacheKey, sourceName)
+	if err != nil {
+		return nil, err
+	}
+
+	actualSize, err := entrySize(sourcePath)
+	if err != nil {
+		return nil, err
+	}
+	if actualSize != size {
+		// the file on disk is what takes up space, whatever the caller said
+		logger.Info("size-mismatch", lager.Data{"size": size, "actual_size": actualSize})
+		size = actualSize
+	}
+	if c.MaxEntryBytes > 0 && size > c.MaxEntryBytes {
+		logger.Info("entry-too-large", lager.Data{"size": size, "max_entry_bytes": c.MaxEntryBytes})
+		return nil, EntryTooLargeErr
+	}
+	size = c.roundToBlock(size)
+	if req.mustFit && !c.planEviction(c.maxSizeInBytes-size, "").fits {
+		return nil, DoesNotFitErr
+	}
+
+	// victims are only evicted once the add has committed, so that an add
+	// that fails leaves the other entries alone
+	victims := c.planRoomForKey(logger, cacheKey)
+	if req.namespace != nil {
+		victims = append(victims, c.planNamespaceRoom(logger, req.namespace.name, size, victims)...)
+	}
+
+	hash := ""
+	if c.Deduplicate && !req.directory {
+		hash, err = contentHash(sourcePath)
+		if err != nil {
+			return nil, err
+		}
+
+		newEntry, err := c.linkDuplicate(logger, name, size, cachingInfo, hash)
+		if err != nil {
+			logger.Error("failed-to-link-duplicate", err)
+		} else if newEntry != nil {
+			err = c.commit(logger, cacheKey, newEntry, req, func() error {
+				return os.Remove(newEntry.FilePath)
+			})
+			if err != nil {
+				return nil, err
+			}
+
+			err = os.Remove(sourcePath)
+			if err != nil {
+				logger.Error("failed-to-remove-duplicate-source", err)
+			}
+			return c.evictPlanned(logger, cacheKey, victims), nil
+		}
+	}
+
+	// a file staged in the cache directory, or a directory, which is always
+	// staged there, is already on the filesystem, so renaming it into place
+	// takes no further space
+	needed := size
+	if req.directory || filepath.Dir(sourcePath) == filepath.Clean(c.CachedPath) && !c.compress {
+		needed = 0
+	}
+
+	if !c.batching {
+		result := c.planEvictionAfter(victims, c.maxSizeInBytes-size, "")
+		if !result.fits {
+			logger.Info("not-enough-space", lager.Data{"requested_bytes": size, "max_bytes": c.maxSizeInBytes})
+			if size <= c.maxSizeInBytes {
+				// the file would fit, but everything left to evict is in use
+				return nil, CacheBusyErr
+			}
+		}
+		victims = append(victims, result.evicted...)
+	}
+	// the reserve is kept by freeing disk space for the file before it is
+	// moved, so these evictions stay even if the add fails
+	evicted, err := c.keepReserve(logger, needed)
+	if err != nil {
+		return evicted, err
+	}
+
+	cachePath := c.nextCachePath(name)
+	if req.directory {
+		dirPath := cachePath + ".d"
+		err = rename(sourcePath, dirPath)
+		if err != nil {
+			return evicted, err
+		}
+
+		newEntry := c.newFileCacheEntry(cachePath, size, cachingInfo)
+		newEntry.ExpandedDirectoryPath = dirPath
+		err = c.commit(logger, cacheKey, newEntry, req, func() error {
+			return rename(dirPath, sourcePath)
+		})
+		if err != nil {
+			return evicted, err
+		}
+		return append(evicted, c.evictPlanned(logger, cacheKey, victims)...), nil
+	}
+
+	if c.compress {
+		compressedSize, err := compressFile(sourcePath, cachePath)
+		if err != nil {
+			return evicted, err
+		}
+
+		newEntry := c.newFileCacheEntry(cachePath, compressedSize, cachingInfo)
+		newEntry.ContentHash = hash
+		newEntry.Compressed = true
+		err = c.commit(logger, cacheKey, newEntry, req, func() error {
+			return os.Remove(cachePath)
+		})
+		if err != nil {
+			return evicted, err
+		}
+
+		err = os.Remove(sourcePath)
+		if err != nil {
+			logger.Error("failed-to-remove-compressed-source", err)
+		}
+		return append(evicted, c.evictPlanned(logger, cacheKey, victims)...), nil
+	}
+
+	err = c.moveFile(ctx, logger, sourcePath, cachePath)
+	if err != nil {
+		return evicted, err
+	}
+
+	newEntry := c.newFileCacheEntry(cachePath, size, cachingInfo)
+	newEntry.ContentHash = hash
+	err = c.commit(logger, cacheKey, newEntry, req, func() error {
+		err := moveFile(context.Background(), cachePath, sourcePath)
+		if err != nil {
+			logger.Error("failed-to-restore-source", err)
+			return os.Remove(cachePath)
+		}
+		return nil
+	})
+	if err != nil {
+		return evicted, err
+	}
+	return append(evicted, c.evictPlanned(logger, cacheKey, victims)...), nil
+}
+
+// commit flushes the file of newEntry to disk if the cache is Durable,
+// applies the settings of req to newEntry, runs its prepare and tracks the
+// entry if all succeed. Otherwise any directory expanded by prepare is
+// removed and undo is called to take the entry's file back out of the cache.
+// For a directory request the directory stands in for the file, and is left
+// for undo to take back.
+func (c *FileCache) commit(logger lager.Logger, cacheKey string, newEntry *FileCacheEntry, req addRequest, undo func() error) error {
+	var err error
+	if req.directory {
+		err = c.chmodDirectory(newEntry.ExpandedDirectoryPath)
+		if err != nil {
+			logger.Error("failed-to-chmod-directory", err)
+		}
+	} else if c.FileMode != 0 {
+		err = os.Chmod(newEntry.FilePath, c.FileMode)
+		if err != nil {
+			logger.Error("failed-to-chmod-entry", err)
+		}
+	}
+	if err == nil {
+		if req.directory {
+			err = c.flushDirectory(newEntry.ExpandedDirectoryPath)
+		} else {
+			err = c.flush(newEntry.FilePath)
+		}
+		if err != nil {
+			logger.Error("failed-to-flush-entry", err)
+		}
+	}
+	if err == nil {
+		req.apply(newEntry)
+	}
+	if err == nil && req.prepare != nil {
+		err = req.prepare(newEntry)
+		if err != nil {
+			logger.Error("failed-to-prepare-entry", err)
+		}
+	}
+
+	if err != nil {
+		if newEntry.ExpandedDirectoryPath != "" && !req.directory {
+			if removeErr := removeAll(newEntry.ExpandedDirectoryPath); removeErr != nil {
+				logger.Error("failed-to-remove-expanded-directory", removeErr)
+			}
+		}
+		if undoErr := undo(); undoErr != nil {
+			logger.Error("failed-to-roll-back-add", undoErr)
+		}
+		return err
+	}
+
+	c.track(logger, cacheKey, newEntry)
+	return nil
+}
+
+var syncFile = (*os.File).Sync
+
+// flush writes the file at path and its entry in the cache directory to disk
+// if the cache is Durable.
+func (c *FileCache) flush(path string) error {
+	if !c.Durable {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = syncFile(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// flushDirectory is flush for an expanded directory: the directory and the
+// one holding it are synced, but not the files in it.
+func (c *FileCache) flushDirectory(dir string) error {
+	if !c.Durable {
+		return nil
+	}
+
+	err := syncDir(dir)
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(dir))
+}
+
+// linkDuplicate hard links the cached file of another entry with the same
+// content hash to a new cache path for sourcePath, returning an untracked
+// entry for it. It returns a nil entry if there is none.
+func (c *FileCache) linkDuplicate(logger lager.Logger, name string, size int64, cachingInfo CachingInfoType, hash string) (*FileCacheEntry, error) {
+	var original *FileCacheEntry
+	for cacheKey := range c.byContent[hash] {
+		entry := c.Entries[cacheKey]
+		if !entry.fileDoesNotExist() {
+			original = entry
+			break
+		}
+	}
+	if original == nil {
+		return nil, nil
+	}
+
+	cachePath := c.nextCachePath(name)
+	err := os.Link(original.FilePath, cachePath)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("linked-duplicate", lager.Data{"content_hash": hash})
+	newEntry := c.newFileCacheEntry(cachePath, size, cachingInfo)
+	newEntry.ContentHash = hash
+	if original.Compressed {
+		newEntry.Compressed = true
+		newEntry.Size = original.Size
+	}
+	return newEntry, nil
+}
+
+// KeysWithContent returns the sorted keys of the entries whose content has
+// the SHA-256 hash, which the cache records for entries added while it
+// deduplicates.
+func (c *FileCache) KeysWithContent(hash []byte) []string {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	cacheKeys := []string{}
+	for cacheKey := range c.byContent[hex.EncodeToString(hash)] {
+		cacheKeys = append(cacheKeys, cacheKey)
+	}
+	sort.Strings(cacheKeys)
+	return cacheKeys
+}
+
+// sharesContent reports whether another of entries is hard linked to the file
+// of entry, in which case it is only accounted for once.
+func sharesContent(entries map[string]*FileCacheEntry, cacheKey string, entry *FileCacheEntry) bool {
+	if !entry.shareable() {
+		return false
+	}
+	for ck, other := range entries {
+		if ck != cacheKey && other.shareable() && other.ContentHash == entry.ContentHash {
+			return true
+		}
+	}
+	return false
+}
+
+// compressFile writes a gzipped copy of sourcePath to path and returns its
+// size. path is removed if the copy fails.
+func compressFile(sourcePath, path string) (size int64, err error) {
+	src, err := os.Open(sourcePath)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	dest, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+
+	w := gzip.NewWriter(dest)
+	_, err = io.Copy(w, src)
+	if err == nil {
+		err = w.Close()
+	}
+	if closeErr := dest.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// decompressFile writes the decompressed content of the gzipped file at path
+// to a temporary file next to it and returns the temporary file's path.
+func decompressFile(path string) (string, error) {
+	r, err := openCompressed(path)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	dest, err := os.CreateTemp(filepath.Dir(path), "decompressed-")
+	if err != nil {
+		return "", err
+	}
+
+	_, err = io.Copy(dest, r)
+	if closeErr := dest.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dest.Name())
+		return "", err
+	}
+	return dest.Name(), nil
+}
+
+// gzipFile reads the decompressed content of a gzipped file.
+type gzipFile struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func openCompressed(path string) (*gzipFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &gzipFile{Reader: r, file: f}, nil
+}
+
+func (g *gzipFile) Close() error {
+	return errors.Join(g.Reader.Close(), g.file.Close())
+}
+
+// contentHash returns the hex encoded sha256 of the file at path.
+func contentHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// cacheFileName matches the names given by nextCachePath, with or without the
+// suffix of an expanded directory.
+var cacheFileName = regexp.MustCompile(`-\d+-\d+(\.[^.]+)?(\.d)?$`)
+
+var now = time.Now
+
+// DefaultFilename names cached files after their cache key, keeping the
+// extension of the source so that the cached file is recognizable.
+func DefaultFilename(cacheKey, sourceBase string) string {
+	return cacheKey + filepath.Ext(sourceBase)
+}
+
+// HashedFilename names cached files by a hash of the cache key and the source
+// name, keeping the extension of the source. Use it as FilenameFunc when
+// cache keys or source names are too long for the filesystem.
+func HashedFilename(cacheKey, sourceBase string) string {
+	sum := sha256.Sum256([]byte(cacheKey + "/" + sourceBase))
+	return hex.EncodeToString(sum[:8]) + filepath.Ext(sourceBase)
+}
+
+// filename returns the name that cached files for cacheKey are derived from,
+// as given by FilenameFunc. It fails with InvalidFilenameErr unless the name
+// is a single path segment.
+func (c *FileCache) filename(cacheKey, sourceBase string) (string, error) {
+	filenameFunc := c.FilenameFunc
+	if filenameFunc == nil {
+		filenameFunc = DefaultFilename
+	}
+
+	name := filenameFunc(cacheKey, sourceBase)
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", InvalidFilenameErr
+	}
+	return name, nil
+}
+
+// nextCachePath returns a path in the cache directory, derived from name,
+// that no entry uses and that does not exist on disk, for example left over
+// from an earlier run. The shard directory of the path is created if needed.
+func (c *FileCache) nextCachePath(name string) string {
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	dir := c.shardDir(name)
+	if dir != c.CachedPath {
+		// #nosec G104 - a failure shows when the file is written
+		os.MkdirAll(dir, 0750)
+	}
+	trackedFiles := c.trackedFiles()
+	for {
+		c.Seq++
+		// the sequence number keeps names unique across keys even when source
+		// files share a name
+		uniqueName := fmt.Sprintf("%s-%d-%d%s", stem, now().UnixNano(), c.Seq, ext)
+		cachePath := filepath.Join(dir, uniqueName)
+		if !pathInUse(cachePath, trackedFiles) && !pathInUse(cachePath+".d", trackedFiles) {
+			return cachePath
+		}
+	}
+}
+
+// maxShardDepth is the number of pairs of hex digits in a sha256 sum.
+const maxShardDepth = sha256.Size
+
+// shardName matches the names of shard directories.
+var shardName = regexp.MustCompile(`^[0-9a-f]{2}$`)
+
+// shardDir returns the directory that files derived from name are cached in.
+func (c *FileCache) shardDir(name string) string {
+	depth := min(c.ShardDepth, maxShardDepth)
+	if depth <= 0 {
+		return c.CachedPath
+	}
+
+	hash := sha256.Sum256([]byte(name))
+	sum := hex.EncodeToString(hash[:])
+	parts := []string{c.CachedPath}
+	for i := 0; i < depth; i++ {
+		parts = append(parts, sum[2*i:2*i+2])
+	}
+	return filepath.Join(parts...)
+}
+
+// cacheFiles returns the paths of the files and directories in the cache
+// directory and, whatever the current ShardDepth, in its shard directories,
+// which are not listed themselves.
+func (c *FileCache) cacheFiles() ([]string, error) {
+	var paths []string
+	var list func(dir string) error
+	list = func(dir string) error {
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			path := filepath.Join(dir, file.Name())
+			if file.IsDir() && shardName.MatchString(file.Name()) {
+				err = list(path)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			paths = append(paths, path)
+		}
+		return nil
+	}
+
+	err := list(c.CachedPath)
+	return paths, err
+}
+
+// Migrate renames the cached files to the names newFn gives them and makes
+// newFn the cache's FilenameFunc, so that the naming scheme can change without
+// losing the cached entries. The name of the source file is not known after
+// it was added, so newFn is passed the current name of the cached file, whose
+// extension is the source's. Each file is renamed under the lock, atomically.
+// Files that cannot be renamed, including those of entries that are in use or
+// acquired, keep their old names, and the returned error joins the reasons for
+// each of them.
+func (c *FileCache) Migrate(logger lager.Logger, newFn func(cacheKey, sourceBase string) string) error {
+	logger = logger.Session("file-cache.migrate")
+	lock.Lock()
+	defer lock.Unlock()
+
+	logger.Info("starting")
+	defer logger.Info("finished")
+
+	if c.closed {
+		return ClosedErr
+	}
+
+	c.FilenameFunc = newFn
+
+	cacheKeys := make([]string, 0, len(c.Entries))
+	for cacheKey := range c.Entries {
+		cacheKeys = append(cacheKeys, cacheKey)
+	}
+	sort.Strings(cacheKeys)
+
+	var errs []error
+	for _, cacheKey := range cacheKeys {
+		err := c.migrate(cacheKey, c.Entries[cacheKey])
+		if err != nil {
+			logger.Error("failed-to-migrate", err, lager.Data{"cache_key": cacheKey})
+			errs = append(errs, fmt.Errorf("could not migrate %s: %w", cacheKey, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (c *FileCache) migrate(cacheKey string, entry *FileCacheEntry) error {
+	if entry.inUse() || entry.acquiredCount > 0 {
+		return EntryInUseErr
+	}
+
+	name, err := c.filename(cacheKey, filepath.Base(entry.FilePath))
+	if err != nil {
+		return err
+	}
+	cachePath := c.nextCachePath(name)
+
+	// entries whose file was deleted in favor of their directory only need the
+	// new path for when the file is recreated
+	if !entry.fileDoesNotExist() {
+		err = rename(entry.FilePath, cachePath)
+		if err != nil {
+			return err
+		}
+	}
+	entry.change(func() {
+		entry.FilePath = cachePath
+	})
+	return nil
+}
+
+// ValidateKey is the default check of the keys of added entries. It rejects
+// keys that are empty or only whitespace with EmptyCacheKeyErr.
+func ValidateKey(cacheKey string) error {
+	if strings.TrimSpace(cacheKey) == "" {
+		return EmptyCacheKeyErr
+	}
+	return nil
+}
+
+// NormalizeKey canonicalizes cacheKey by trimming surrounding whitespace and
+// lowercasing it. The cache uses keys verbatim, so callers whose keys may
+// vary in case or spacing should normalize them both when adding entries and
+// when looking them up.
+func NormalizeKey(cacheKey string) string {
+	return strings.ToLower(strings.TrimSpace(cacheKey))
+}
+
+func (c *FileCache) validateKey(cacheKey string) error {
+	if c.KeyValidator != nil {
+		return c.KeyValidator(cacheKey)
+	}
+	return ValidateKey(cacheKey)
+}
+
+// checkSourceDir fails with InvalidSourceErr if sourceDir is the cache
+// directory or contains it, as moving it into the cache would move the cache
+// into itself.
+func (c *FileCache) checkSourceDir(sourceDir string) error {
+	source, err := filepath.Abs(sourceDir)
+	if err != nil {
+		return err
+	}
+	cachedPath, err := filepath.Abs(c.CachedPath)
+	if err != nil {
+		return err
+	}
+
+	rel, err := filepath.Rel(source, cachedPath)
+	if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%w: %s contains the cache directory", InvalidSourceErr, sourceDir)
+	}
+	return nil
+}
+
+// track stores newEntry under cacheKey, releasing the entry it replaces.
+func (c *FileCache) track(logger lager.Logger, cacheKey string, newEntry *FileCacheEntry) {
+	// the sequence number was taken for the entry's path by nextCachePath
+	newEntry.Seq = c.Seq
+	delete(c.knownMisses, cacheKey)
+	c.forgetDemoted(cacheKey)
+	oldEntry := c.deleteEntry(cacheKey)
+	if oldEntry != nil && oldEntry.Pinned {
+		newEntry.Pinned = true
+	}
+	c.setEntry(cacheKey, newEntry)
+	c.emit(EventAdd, cacheKey, newEntry.Size)
+	if oldEntry != nil {
+		err := oldEntry.decrementUse()
+		if err != nil {
+			logger.Error("failed-to-delete-replaced-entry", err, lager.Data{"cache_key": cacheKey})
+		}
+		c.updateOldEntries(logger, cacheKey, oldEntry)
+		c.evicted(cacheKey, oldEntry, EvictReasonReplaced)
+	}
+}
+
+// AddExpandedDirectory adds a directory that has already been expanded, for
+// example from a tarball, by moving it into the cache. The size of the entry
+// is the total size of the files in the directory. The directory is added
+// like a file by Add: it must fit under MaxEntryBytes, evictions make room
+// for it, and CacheBusyErr is returned if the entries that would have to be
+// evicted are in use. It is renamed into place, so it must be on the same
+// filesystem as the cache. As with AddDirectory, the returned directory
+// should be closed with CloseDirectory.
+func (c *FileCache) AddExpandedDirectory(logger lager.Logger, cacheKey, sourceDir string, cachingInfo CachingInfoType) (string, error) {
+	logger = logger.Session("file-cache.add-expanded-directory", lager.Data{"cache_key": cacheKey, "source_dir": sourceDir})
+	logger.Info("starting")
+	defer logger.Info("finished")
+
+	size, err := entrySize(sourceDir)
+	if err != nil {
+		return "", err
+	}
+
+	var dirPath string
+	_, err = c.addFile(context.Background(), logger, cacheKey, sourceDir, size, cachingInfo, addRequest{directory: true, prepare: func(newEntry *FileCacheEntry) (err error) {
+		dirPath, err = c.expandedDirectory(newEntry)
+		return err
+	}})
+	if err != nil {
+		return "", err
+	}
+	return dirPath, nil
+}
+
+// Info describes the entry for cacheKey, or returns EntryNotFound.
+func (c *FileCache) Info(cacheKey string) (EntryInfo, error) {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	entry := c.Entries[cacheKey]
+	if entry == nil {
+		return EntryInfo{}, EntryNotFound
+	}
+	return entry.info(cacheKey), nil
+}
+
+// InfoOK returns the caching info of the entry for cacheKey and whether there
+// is such an entry, telling an entry without validators apart from a missing
+// one. Like Info, it does not count as an access to the entry.
+func (c *FileCache) InfoOK(cacheKey string) (CachingInfoType, bool) {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	entry := c.Entries[cacheKey]
+	if entry == nil {
+		return CachingInfoType{}, false
+	}
+	return entry.CachingInfo, true
+}
+
+// Tags returns a copy of the tags of the entry for cacheKey and whether there
+// is such an entry. Entries added without tags have none. Like Info, it does
+// not count as an access to the entry.
+func (c *FileCache) Tags(cacheKey string) (map[string]string, bool) {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	entry := c.Entries[cacheKey]
+	if entry == nil {
+		return nil, false
+	}
+	return maps.Clone(entry.Tags), true
+}
+
+// MeasuredSize measures the files of the entry for cacheKey on disk: its file,
+// stored compressed if the cache compresses, plus its expanded directory, if
+// any. An entry accounted correctly has this Size, before rounding up to
+// BlockSize. It returns false if there is no such entry or it cannot be
+// measured.
+func (c *FileCache) MeasuredSize(cacheKey string) (int64, bool) {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	entry := c.Entries[cacheKey]
+	if entry == nil {
+		return 0, false
+	}
+
+	size := int64(0)
+	for _, path := range []string{entry.FilePath, entry.ExpandedDirectoryPath} {
+		if path == "" {
+			continue
+		}
+		pathSize, err := entrySize(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return 0, false
+		}
+		size += pathSize
+	}
+	return size, true
+}
+
+// LastAccess returns when the entry for cacheKey was last added or accessed,
+// and whether there is such an entry. It does not count as an access itself.
+func (c *FileCache) LastAccess(cacheKey string) (time.Time, bool) {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	entry := c.Entries[cacheKey]
+	if entry == nil {
+		return time.Time{}, false
+	}
+	return entry.Access, true
+}
+
+func (c *FileCache) Get(logger lager.Logger, cacheKey string) (*CachedFile, CachingInfoType, error) {
+	logger = logger.Session("file-cache.get", lager.Data{"cache_key": cacheKey})
+	return c.get(logger, cacheKey, nil)
+}
+
+// get is Get, only finding entries of namespace if it is not nil.
+func (c *FileCache) get(logger lager.Logger, cacheKey string, namespace *Namespace) (*CachedFile, CachingInfoType, error) {
+	defer c.startSpan("file-cache.get").End()
+	defer c.fetchDemoted(logger, cacheKey)()
+	defer c.notifyEvictions()
+	lock.Lock()
+	defer lock.Unlock()
+
+	logger.Info("starting")
+	defer logger.Info("finished")
+
+	if c.closed {
+		return nil, CachingInfoType{}, ClosedErr
+	}
+
+	entry := namespace.filter(c.lookup(logger, cacheKey))
+	if entry == nil {
+		c.recordMiss(cacheKey)
+		return nil, CachingInfoType{}, EntryNotFound
+	}
+	c.recordHit(cacheKey, entry)
+
+	if entry.fileDoesNotExist() {
+		c.makeRoom(logger, entry.Size, cacheKey)
+	}
+
+	entry.recordAccess()
+	readCloser, err := entry.readCloser()
+	if err != nil {
+		return nil, CachingInfoType{}, err
+	}
+
+	return readCloser, entry.CachingInfo, nil
+}
+
+func (c *FileCache) GetDirectory(logger lager.Logger, cacheKey string) (string, CachingInfoType, error) {
+	logger = logger.Session("file-cache.get-directory", lager.Data{"cache_key": cacheKey})
+	defer c.startSpan("file-cache.get-directory").End()
+	defer c.fetchDemoted(logger, cacheKey)()
+	defer c.notifyEvictions()
+	lock.Lock()
+	defer lock.Unlock()
+
+	logger.Info("starting")
+	defer logger.Info("finished")
+
+	if c.closed {
+		return "", CachingInfoType{}, ClosedErr
+	}
+
+	entry := c.lookup(logger, cacheKey)
+	if entry == nil {
+		c.recordMiss(cacheKey)
+		return "", CachingInfoType{}, EntryNotFound
+	}
+	c.recordHit(cacheKey, entry)
+
+	// Was it expanded before
+	if entry.dirDoesNotExist() {
+		// Do we have enough room to double the size?
+		c.makeRoom(logger, entry.Size, cacheKey)
+		entry.change(func() {
+			entry.Size = entry.Size * 2
+		})
+	}
+
+	entry.recordAccess()
+	dir, err := c.expandedDirectory(entry)
+	if err != nil {
+		return "", CachingInfoType{}, err
+	}
+
+	return dir, entry.CachingInfo, nil
+}
+
+// lookup returns the entry for cacheKey, removing it first if it has expired
+// or, when VerifyOnRead is set, if it fails verification. A missing entry is
+// promoted from the cold tier if fetchDemoted staged its content.
+func (c *FileCache) lookup(logger lager.Logger, cacheKey string) *FileCacheEntry {
+	entry := c.Entries[cacheKey]
+	if entry == nil {
+		if c.coldTier != nil {
+			return c.promote(logger, cacheKey)
+		}
+		return nil
+	}
+
+	if entry.expired() {
+		logger.Info("entry-expired")
+		c.remove(logger, cacheKey, EvictReasonExpired)
+		return nil
+	}
+
+	if c.VerifyOnRead && !entry.fileDoesNotExist() {
+		ok, err := entry.checksumMatches()
+		if !ok {
+			logger.Error("entry-failed-verification", err)
+			c.remove(logger, cacheKey, EvictReasonCorrupted)
+			return nil
+		}
+	}
+	return entry
+}
+
+// Acquire returns the path of the cached file for cacheKey and marks it as in
+// use, so that it is not evicted or deleted until Release is called with the
+// same cacheKey and path. Callers that only need to read the file should
+// prefer OpenForKey, in particular when the cache stores files compressed, as
+// the path then refers to the compressed file.
+func (c *FileCache) Acquire(logger lager.Logger, cacheKey string) (string, error) {
+	logger = logger.Session("file-cache.acquire", lager.Data{"cache_key": cacheKey})
+	return c.acquire(logger, cacheKey, nil)
+}
+
+// acquire is Acquire, only finding entries of namespace if it is not nil.
+func (c *FileCache) acquire(logger lager.Logger, cacheKey string, namespace *Namespace) (string, error) {
+	defer c.startSpan("file-cache.acquire").End()
+	defer c.fetchDemoted(logger, cacheKey)()
+	defer c.notifyEvictions()
+	lock.Lock()
+	defer lock.Unlock()
+
+	logger.Info("starting")
+	defer logger.Info("finished")
+
+	if c.closed {
+		return "", ClosedErr
+	}
+
+	entry := namespace.filter(c.lookup(logger, cacheKey))
+	if entry == nil {
+		c.recordMiss(cacheKey)
+		return "", EntryNotFound
+	}
+	c.recordHit(cacheKey, entry)
+
+	if entry.fileDoesNotExist() {
+		c.makeRoom(logger, entry.Size, cacheKey)
+	}
+
+	entry.recordAccess()
+	return entry.acquire()
+}
+
+// GetOrLoad acquires the cached file for cacheKey like Acquire. On a miss it
+// calls loader for a file to add, adds it and acquires it. Concurrent misses
+// for the same key wait for the first loader instead of running their own. As
+// with Acquire, the returned path must be released with Release.
+func (c *FileCache) GetOrLoad(logger lager.Logger, cacheKey string, loader func() (sourcePath string, size int64, info CachingInfoType, err error)) (string, error) {
+	logger = logger.Session("file-cache.get-or-load", lager.Data{"cache_key": cacheKey})
+	logger.Info("starting")
+	defer logger.Info("finished")
+
+	var l *load
+	for {
+		path, err := c.Acquire(logger, cacheKey)
+		if err != EntryNotFound {
+			return path, err
+		}
+
+		var leader bool
+		l, leader = c.startLoad(cacheKey)
+		if leader {
+			defer c.finishLoad(cacheKey, l)
+			break
+		}
+
+		logger.Info("waiting-for-loader")
+		<-l.done
+	}
+
+	return c.loadAndAcquire(logger, cacheKey, "", l, loader)
+}
+
+// loadAndAcquire adds the file from loader for cacheKey and acquires it,
+// recording the outcome in l. The entry's Origin is set to origin.
+func (c *FileCache) loadAndAcquire(logger lager.Logger, cacheKey, origin string, l *load, loader func() (sourcePath string, size int64, info CachingInfoType, err error)) (string, error) {
+	sourcePath, size, cachingInfo, err := loader()
+	if err != nil {
+		logger.Error("failed-to-load", err)
+		l.err = err
+		return "", err
+	}
+
+	var path string
+	_, err = c.addFile(context.Background(), logger, cacheKey, sourcePath, size, cachingInfo, addRequest{origin: origin, prepare: func(newEntry *FileCacheEntry) (err error) {
+		path, err = newEntry.acquire()
+		return err
+	}})
+	if err != nil {
+		l.err = err
+		return "", err
+	}
+	l.added, l.written, l.cacheKey = true, size, cacheKey
+	return path, nil
+}
+
+// GetOrLoadByURL is GetOrLoad for keys whose files are downloaded from url.
+// Concurrent misses for different keys with the same url wait for the first
+// loader too; the cached file it loaded is then hard linked, or copied where
+// that is not possible, into an entry for each of the other keys, so that the
+// url is downloaded once. The entries record url as their Origin, and are
+// accounted separately unless the cache deduplicates them.
+func (c *FileCache) GetOrLoadByURL(logger lager.Logger, cacheKey, url string, loader func() (sourcePath string, size int64, info CachingInfoType, err error)) (string, error) {
+	logger = logger.Session("file-cache.get-or-load-by-url", lager.Data{"cache_key": cacheKey, "url": url})
+	logger.Info("starting")
+	defer logger.Info("finished")
+
+	var l *load
+	for {
+		path, err := c.Acquire(logger, cacheKey)
+		if err != EntryNotFound {
+			return path, err
+		}
+
+		var leader bool
+		l, leader = c.startURLLoad(url)
+		if leader {
+			defer c.finishURLLoad(url, l)
+			break
+		}
+
+		logger.Info("waiting-for-loader")
+		<-l.done
+		if l.err != nil || l.cacheKey == cacheKey {
+			continue
+		}
+
+		path, err = c.addFromEntry(logger, l.cacheKey, cacheKey, url)
+		if err != EntryNotFound {
+			return path, err
+		}
+		// the loaded entry is already gone, so load it again
+	}
+
+	return c.loadAndAcquire(logger, cacheKey, url, l, loader)
+}
+
+// startURLLoad is startLoad for the loads of GetOrLoadByURL.
+func (c *FileCache) startURLLoad(url string) (l *load, leader bool) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if c.loadingURLs == nil {
+		c.loadingURLs = map[string]*load{}
+	}
+	l = c.loadingURLs[url]
+	if l != nil {
+		return l, false
+	}
+	l = &load{done: make(chan struct{})}
+	c.loadingURLs[url] = l
+	return l, true
+}
+
+func (c *FileCache) finishURLLoad(url string, l *load) {
+	lock.Lock()
+	delete(c.loadingURLs, url)
+	close(l.done)
+	lock.Unlock()
+}
+
+// addFromEntry adds the file of the entry for sourceKey as the entry for
+// cacheKey, and acquires it. It fails with EntryNotFound if sourceKey has no
+// entry with a file.
+func (c *FileCache) addFromEntry(logger lager.Logger, sourceKey, cacheKey, origin string) (string, error) {
+	defer c.notifyEvictions()
+	defer c.lockKey(cacheKey).Unlock()
+
+	stagedPath, cachingInfo, err := c.linkEntry(logger, sourceKey, cacheKey)
+	if err != nil {
+		return "", err
+	}
+	// the staged file is only left behind if adding it fails
+	defer os.Remove(stagedPath)
+
+	info, err := os.Stat(stagedPath)
+	if err != nil {
+		return "", err
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	var path string
+	_, err = c.add(context.Background(), logger, cacheKey, stagedPath, "", info.Size(), cachingInfo, addRequest{origin: origin, prepare: func(newEntry *FileCacheEntry) (err error) {
+		path, err = newEntry.acquire()
+		return err
+	}})
+	if err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+var link = os.Link
+
+// linkEntry stages the uncompressed content of the entry for sourceKey in the
+// cache directory for cacheKey, hard linking the entry's file if it can.
+func (c *FileCache) linkEntry(logger lager.Logger, sourceKey, cacheKey string) (string, CachingInfoType, error) {
+	staged, err := c.tempFile(logger, cacheKey)
+	if err != nil {
+		return "", CachingInfoType{}, err
+	}
+	stagedPath := staged.Name()
+
+	lock.RLock()
+	entry := c.Entries[sourceKey]
+	if entry == nil || entry.fileDoesNotExist() {
+		lock.RUnlock()
+		// #nosec G104 - the staged file is being discarded
+		staged.Close()
+		os.Remove(stagedPath)
+		return "", CachingInfoType{}, EntryNotFound
+	}
+	cachingInfo := entry.CachingInfo
+
+	if !entry.Compressed {
+		// #nosec G104 - the placeholder only reserved the name
+		staged.Close()
+		os.Remove(stagedPath)
+		err = link(entry.FilePath, stagedPath)
+		if err == nil {
+			lock.RUnlock()
+			return stagedPath, cachingInfo, nil
+		}
+		staged, err = os.Create(stagedPath)
+		if err != nil {
+			lock.RUnlock()
+			return "", CachingInfoType{}, err
+		}
+	}
+
+	// an open file stays readable if the entry is evicted once the lock is
+	// released
+	reader, err := entry.open()
+	lock.RUnlock()
+	if err == nil {
+		_, err = io.Copy(staged, reader)
+		reader.Close()
+	}
+	closeErr := staged.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(stagedPath)
+		return "", CachingInfoType{}, err
+	}
+	return stagedPath, cachingInfo, nil
+}
+
+// load tracks a key that is being loaded by GetOrLoad or AddStream, or a URL
+// that is being loaded by GetOrLoadByURL. The outcome is set before done is
+// closed.
+type load struct {
+	done    chan struct{}
+	added   bool
+	written int64
+	err     error
+	// cacheKey is the key the file was added for
+	cacheKey string
+}
+
+// startLoad returns the load in progress for cacheKey, or starts one if there
+// is none, in which case leader is true and the caller must call finishLoad.
+func (c *FileCache) startLoad(cacheKey string) (l *load, leader bool) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if c.loading == nil {
+		c.loading = map[string]*load{}
+	}
+	l = c.loading[cacheKey]
+	if l != nil {
+		return l, false
+	}
+	l = &load{done: make(chan struct{})}
+	c.loading[cacheKey] = l
+	return l, true
+}
+
+func (c *FileCache) finishLoad(cacheKey string, l *load) {
+	lock.Lock()
+	delete(c.loading, cacheKey)
+	close(l.done)
+	lock.Unlock()
+}
+
+// OpenForKey opens the cached file for cacheKey while holding the cache lock,
+// decompressing it as it is read if it is stored compressed. The file is not
+// marked as in use; it may be evicted once OpenForKey returns, but on Unix the
+// open file remains readable after its path is removed.
+func (c *FileCache) OpenForKey(logger lager.Logger, cacheKey string) (io.ReadCloser, error) {
+	logger = logger.Session("file-cache.open-for-key", lager.Data{"cache_key": cacheKey})
+	defer c.startSpan("file-cache.open-for-key").End()
+	defer c.fetchDemoted(logger, cacheKey)()
+	defer c.notifyEvictions()
+	lock.Lock()
+	defer lock.Unlock()
+
+	logger.Info("starting")
+	defer logger.Info("finished")
+
+	if c.closed {
+		return nil, ClosedErr
+	}
+
+	entry := c.lookup(logger, cacheKey)
+	if entry == nil {
+		c.recordMiss(cacheKey)
+		return nil, EntryNotFound
+	}
+	c.recordHit(cacheKey, entry)
+
+	if entry.fileDoesNotExist() {
+		c.makeRoom(logger, entry.Size, cacheKey)
+	}
+
+	entry.recordAccess()
+	err := entry.ensureFile()
+	if err != nil {
+		return nil, err
+	}
+
+	return entry.open()
+}
+
+// ReaderAt opens the cached file for cacheKey for reading at arbitrary
+// offsets, for example to serve ranges with http.ServeContent, and returns it
+// with its size. The file is in use, and so not deleted, until release is
+// called; release may be called more than once. Compressed files are
+// decompressed into a temporary copy first.
+func (c *FileCache) ReaderAt(logger lager.Logger, cacheKey string) (r io.ReaderAt, size int64, release func(), err error) {
+	logger = logger.Session("file-cache.reader-at", lager.Data{"cache_key": cacheKey})
+	file, _, err := c.get(logger, cacheKey, nil)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	release = func() {
+		// #nosec G104 - closing again after the first release fails harmlessly
+		file.Close()
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		release()
+		return nil, 0, nil, err
+	}
+	return file, info.Size(), release, nil
+}
+
+// Release decrements the usage counter for the given cacheKey/filePath pair
+// returned by Acquire.
+func (c *FileCache) Release(logger lager.Logger, cacheKey, filePath string) error {
+	logger = logger.Session("file-cache.release", lager.Data{"cache_key": cacheKey, "file_path": filePath})
+	lock.Lock()
+	defer lock.Unlock()
+
+	logger.Info("starting")
+	defer logger.Info("finished")
+
+	entry := c.Entries[cacheKey]
+	if entry != nil && entry.FilePath == filePath {
+		if entry.acquiredCount == 0 {
+			return AlreadyReleased
+		}
+
+		entry.acquiredCount--
+		return entry.decrementFileInUseCount()
+	}
+
+	// Key didn't match anything in the current cache, so
+	// check and clean up old entries
+	entry = c.OldEntries[cacheKey+filePath]
+	if entry == nil {
+		return EntryNotFound
+	}
+
+	entry.acquiredCount--
+	err := entry.decrementFileInUseCount()
+	if entry.acquiredCount == 0 {
+		// done with this old entry, so clean it up
+		delete(c.OldEntries, cacheKey+filePath)
+		c.mutated()
+	}
+	return err
+}
+
+// Remove drops the entry for cacheKey. The entry is removed even if deleting
+// its files fails, in which case the error is returned.
+func (c *FileCache) Remove(logger lager.Logger, cacheKey string) error {
+	_, _, err := c.RemoveWithResult(logger, cacheKey)
+	return err
+}
+
+// RemoveWithResult drops the entry for cacheKey like Remove, and reports
+// whether there was an entry and how many bytes of the cache's space its
+// removal freed. Content shared with other entries is not freed until the
+// last of them is removed. Files that are in use count as freed even though
+// they stay on disk until they are released.
+func (c *FileCache) RemoveWithResult(logger lager.Logger, cacheKey string) (removed bool, freedBytes int64, err error) {
+	logger = logger.Session("file-cache.remove", lager.Data{"cache_key": cacheKey})
+
+	lock.Lock()
+	logger.Info("starting")
+	if c.closed {
+		err = ClosedErr
+	} else {
+		c.forgetDemoted(cacheKey)
+		if _, removed = c.Entries[cacheKey]; removed {
+			usedBytes := c.usedBytes
+			err = c.remove(logger, cacheKey, EvictReasonRemoved)
+			freedBytes = usedBytes - c.usedBytes
+		}
+	}
+	lock.Unlock()
+	c.notifyEvictions()
+	logger.Info("finished")
+	return removed, freedBytes, err
+}
+
+// Take removes the entry for cacheKey without deleting its file and returns
+// the file's path, handing ownership of the file to the caller. An entry that
+// is only held as an expanded directory is archived back into a file first.
+// ok is false, and nothing changes, if there is no entry for cacheKey or it
+// is in use. As with Acquire, the file of a compressed cache is compressed.
+//
+// The file is left in the cache directory, where the janitor and Load delete
+// untracked files, so the caller should move it elsewhere promptly.
+func (c *FileCache) Take(logger lager.Logger, cacheKey string) (path string, ok bool) {
+	logger = logger.Session("file-cache.take", lager.Data{"cache_key": cacheKey})
+	defer c.fetchDemoted(logger, cacheKey)()
+	defer c.notifyEvictions()
+	lock.Lock()
+	defer lock.Unlock()
+
+	logger.Info("starting")
+	defer logger.Info("finished")
+
+	if c.closed {
+		return "", false
+	}
+
+	entry := c.lookup(logger, cacheKey)
+	if entry == nil || entry.inUse() || entry.acquiredCount > 0 {
+		return "", false
+	}
+
+	err := entry.ensureFile()
+	if err != nil {
+		logger.Error("failed-to-archive-directory", err)
+		return "", false
+	}
+	if entry.ExpandedDirectoryPath != "" {
+		err = removeAll(entry.ExpandedDirectoryPath)
+		if err != nil {
+			logger.Error("failed-to-remove-directory", err)
+		}
+	}
+
+	c.deleteEntry(cacheKey)
+	c.evicted(cacheKey, entry, EvictReasonRemoved)
+	return entry.FilePath, true
+}
+
+// Clear removes every entry from the cache. Files that are not in use are
+// deleted right away; the first error encountered while deleting is returned,
+// but the remaining entries are still removed. Files that are in use are
+// deleted once they are closed.
+func (c *FileCache) Clear(logger lager.Logger) error {
+	logger = logger.Session("file-cache.clear")
+	defer c.notifyEvictions()
+	lock.Lock()
+	defer lock.Unlock()
+
+	logger.Info("starting")
+	defer logger.Info("finished")
+
+	if c.closed {
+		return ClosedErr
+	}
+
+	var firstErr error
+	for cacheKey, entry := range c.Entries {
+		if entry.inUse() {
+			err := c.remove(logger, cacheKey, EvictReasonRemoved)
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		for _, path := range []string{entry.FilePath, entry.ExpandedDirectoryPath} {
+			if path == "" {
+				continue
+			}
+			err := os.RemoveAll(path)
+			if err != nil {
+				logger.Error("failed-to-remove", err, lager.Data{"path": path})
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+		c.deleteEntry(cacheKey)
+		c.evicted(cacheKey, entry, EvictReasonRemoved)
+	}
+	c.signalRoomFreed()
+	return firstErr
+}
+
+func (c *FileCache) remove(logger lager.Logger, cacheKey string, reason EvictReason) error {
+	entry := c.Entries[cacheKey]
+	if entry == nil {
+		return nil
+	}
+
+	if reason == EvictReasonCapacity {
+		c.demote(logger, cacheKey, entry)
+	}
+	err := entry.decrementUse()
+	if err != nil {
+		logger.Error("failed-to-delete-entry", err, lager.Data{"cache_key": cacheKey})
+	}
+	c.updateOldEntries(logger, cacheKey, entry)
+	c.deleteEntry(cacheKey)
+	c.evicted(cacheKey, entry, reason)
+	c.signalRoomFreed()
+	return err
+}
+
+// setEntry stores entry under cacheKey and accounts for it.
+func (c *FileCache) setEntry(cacheKey string, entry *FileCacheEntry) {
+	c.Entries[cacheKey] = entry
+	entry.cache = c
+	entry.cacheKey = cacheKey
+	c.account(entry, 1)
+	c.index(entry)
+}
+
+// index adds entry to the heaps used to find victims.
+func (c *FileCache) index(entry *FileCacheEntry) {
+	if c.victims.less == nil {
+		c.victims = entryHeap{
+			less:     c.ranksBefore,
+			position: func(e *FileCacheEntry) *int { return &e.victimIndex },
+		}
+		c.expiring = entryHeap{
+			less:     func(a, b *FileCacheEntry) bool { return a.Expiry.Before(b.Expiry) },
+			position: func(e *FileCacheEntry) *int { return &e.expiryIndex },
+		}
+	}
+
+	c.mutated()
+	if c.evictor == nil {
+		c.victims.add(entry)
+	}
+	if !entry.Expiry.IsZero() {
+		c.expiring.add(entry)
+	}
+
+	if c.evictor != nil {
+		c.evictor.RecordAdd(entry.cacheKey, entry.info(entry.cacheKey))
+	}
+
+	if entry.ContentHash != "" {
+		if c.byContent == nil {
+			c.byContent = map[string]map[string]struct{}{}
+		}
+		if c.byContent[entry.ContentHash] == nil {
+			c.byContent[entry.ContentHash] = map[string]struct{}{}
+		}
+		c.byContent[entry.ContentHash][entry.cacheKey] = struct{}{}
+	}
+}
+
+// deleteEntry deletes the entry for cacheKey, if any, and returns it.
+func (c *FileCache) deleteEntry(cacheKey string) *FileCacheEntry {
+	entry := c.Entries[cacheKey]
+	if entry == nil {
+		return nil
+	}
+	c.mutated()
+	c.account(entry, -1)
+	c.victims.remove(entry)
+	c.expiring.remove(entry)
+	if c.evictor != nil {
+		c.evictor.RecordRemove(cacheKey)
+	}
+	if keys := c.byContent[entry.ContentHash]; keys != nil {
+		delete(keys, cacheKey)
+		if len(keys) == 0 {
+			delete(c.byContent, entry.ContentHash)
+		}
+	}
+	entry.cache = nil
+	delete(c.Entries, cacheKey)
+	return entry
+}
+
+// account adds (sign 1) or subtracts (sign -1) the size of entry to
+// usedBytes. Shareable entries with the same content are accounted for once.
+func (c *FileCache) account(entry *FileCacheEntry, sign int64) {
+	if entry.shareable() {
+		if c.shared == nil {
+			c.shared = map[string]int{}
+		}
+		c.shared[entry.ContentHash] += int(sign)
+		count := c.shared[entry.ContentHash]
+		if count <= 0 {
+			delete(c.shared, entry.ContentHash)
+		}
+		if (sign > 0 && count > 1) || (sign < 0 && count > 0) {
+			return
+		}
+	}
+	c.usedBytes += sign * entry.Size
+}
+
+// recount accounts for the entries from scratch, after they were loaded.
+func (c *FileCache) recount() {
+	c.usedBytes = 0
+	c.shared = nil
+	c.byContent = nil
+	c.victims.reset()
+	c.expiring.reset()
+	entries := make([]*FileCacheEntry, 0, len(c.Entries))
+	for cacheKey, entry := range c.Entries {
+		entry.cache = c
+		entry.cacheKey = cacheKey
+		entries = append(entries, entry)
+	}
+	// the entries are indexed in eviction order, so that an evictor that
+	// orders ties by when they were added breaks them as the cache does
+	sort.Slice(entries, func(i, j int) bool {
+		return c.ranksBefore(entries[i], entries[j])
+	})
+	for _, entry := range entries {
+		c.account(entry, 1)
+		c.index(entry)
+	}
+}
+
+// UsedBytes returns the space accounted to the cached entries.
+func (c *FileCache) UsedBytes() int64 {
+	lock.RLock()
+	defer lock.RUnlock()
+	return c.usedBytes
+}
+
+// FreeBytes returns how many more bytes fit in the cache before it reaches
+// its limit. It is negative while the cache is over its limit because the
+// entries that would be evicted are in use. This is not the free space on
+// disk.
+func (c *FileCache) FreeBytes() int64 {
+	lock.RLock()
+	defer lock.RUnlock()
+	return c.maxSizeInBytes - c.usedBytes
+}
+
+// evicted queues an OnEvict notification. Notifications are delivered by
+// notifyEvictions once the lock has been released, so that OnEvict may call
+// back into the cache.
+func (c *FileCache) evicted(cacheKey string, entry *FileCacheEntry, reason EvictReason) {
+	if reason != EvictReasonRemoved && reason != EvictReasonReplaced {
+		c.evictionCount.Add(1)
+	}
+
+	c.emit(EventEvict, cacheKey, entry.Size)
+
+	age := c.currentTime().Sub(entry.Access)
+	if reason == EvictReasonCapacity {
+		bucket := 0
+		for bucket < len(evictionAgeBounds) && age > evictionAgeBounds[bucket] {
+			bucket++
+		}
+		c.evictionAges[bucket]++
+
+		if c.ThrashDetected != nil {
+			c.detectThrash()
+		}
+	}
+
+	if c.OnEvict == nil && c.OnEviction == nil {
+		return
+	}
+	c.evictions = append(c.evictions, Eviction{CacheKey: cacheKey, Size: entry.Size, Reason: reason, Age: age})
+}
+
+// defaultThrashWindow is the ThrashWindow used when it is not set.
+const defaultThrashWindow = time.Minute
+
+// detectThrash records an eviction for capacity and queues a call to
+// ThrashDetected if the rate of them is over the threshold.
+func (c *FileCache) detectThrash() {
+	window := c.ThrashWindow
+	if window <= 0 {
+		window = defaultThrashWindow
+	}
+
+	now := c.currentTime()
+	cutoff := now.Add(-window)
+	recent := 0
+	for recent < len(c.recentEvictions) && !c.recentEvictions[recent].After(cutoff) {
+		recent++
+	}
+	c.recentEvictions = append(c.recentEvictions[recent:], now)
+
+	rate := float64(len(c.recentEvictions)) / window.Seconds()
+	if rate > c.ThrashThreshold && (c.lastThrash.IsZero() || now.Sub(c.lastThrash) >= window) {
+		c.lastThrash = now
+		c.thrashRates = append(c.thrashRates, rate)
+	}
+}
+
+func (c *FileCache) notifyEvictions() {
+	lock.Lock()
+	onEvict, onEviction, evictions := c.OnEvict, c.OnEviction, c.evictions
+	thrashDetected, thrashRates := c.ThrashDetected, c.thrashRates
+	coldTier, demotions := c.coldTier, c.demotions
+	c.evictions = nil
+	c.thrashRates = nil
+	c.demotions = nil
+	lock.Unlock()
+
+	c.storeDemotions(coldTier, demotions)
+
+	for _, rate := range thrashRates {
+		thrashDetected(rate)
+	}
+
+	for _, e := range evictions {
+		if onEvict != nil {
+			onEvict(e.CacheKey, e.Size, e.Reason)
+		}
+		if onEviction != nil {
+			onEviction(e)
+		}
+	}
+}
+
+// EvictionAgeHistogram returns how long the entries evicted to make room had
+// gone without being accessed. Many evictions of recently used entries
+// suggest that the cache is too small to hold its working set.
+func (c *FileCache) EvictionAgeHistogram() AgeHistogram {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	return AgeHistogram{
+		Bounds: append([]time.Duration(nil), evictionAgeBounds[:]...),
+		Counts: append([]uint64(nil), c.evictionAges[:]...),
+	}
+}
+
+// Prune evicts entries, using the same policy as when room is needed for a new
+// entry, until no more than targetBytes are used. Entries that are in use are
+// never evicted, so the cache may remain above targetBytes. Evicted entries are
+// dropped even if their files cannot be deleted; the first such error is
+// returned.
+func (c *FileCache) Prune(logger lager.Logger, targetBytes int64) (int64, error) {
+	logger = logger.Session("file-cache.prune", lager.Data{"target_bytes": targetBytes})
+	defer c.notifyEvictions()
+	lock.Lock()
+	defer lock.Unlock()
+
+	logger.Info("starting")
+	defer logger.Info("finished")
+
+	if c.closed {
+		return 0, ClosedErr
+	}
+
+	result := c.evictDownTo(logger, targetBytes, "")
+	logger.Info("pruned", lager.Data{"reclaimed_bytes": result.freed})
+	return result.freed, result.err
+}
+
+// StartJanitor starts a goroutine that, every interval, removes expired entries
+// and MarkMiss marks, and files in the cache directory that were left behind by
+// the cache but are no longer tracked. The returned stop function terminates
+// the goroutine and may be called more than once. Close stops the janitor too,
+// and no janitor is started once the cache is closed.
+func (c *FileCache) StartJanitor(logger lager.Logger, interval time.Duration) (stop func()) {
+	logger = logger.Session("file-cache.janitor", lager.Data{"interval": interval})
+	lock.Lock()
+	defer lock.Unlock()
+	if c.closed {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				c.sweep(logger)
+			}
+		}
+	}()
+
+	var once sync.Once
+	stop = func() {
+		once.Do(func() { close(done) })
+		<-stopped
+	}
+	c.janitors = append(c.janitors, stop)
+	return stop
+}
+
+// StartAutosave saves the metadata to StatePath in the background, at most
+// once every interval and only when it has changed since the last save, until
+// the returned function is called or the cache is closed. Saving on every add
+// or eviction would cost a full write each time, while saving only on Close
+// loses every change since the start on a crash; this bounds what is lost to
+// the changes of the last interval. Close still saves immediately. Failed
+// saves are logged and retried after the next interval. It does nothing if
+// StatePath is not set.
+func (c *FileCache) StartAutosave(logger lager.Logger, interval time.Duration) (stop func()) {
+	logger = logger.Session("file-cache.autosave", lager.Data{"interval": interval, "path": c.StatePath})
+	lock.Lock()
+	defer lock.Unlock()
+	if c.closed || c.StatePath == "" {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				c.autosave(logger)
+			}
+		}
+	}()
+
+	var once sync.Once
+	stop = func() {
+		once.Do(func() { close(done) })
+		<-stopped
+	}
+	c.janitors = append(c.janitors, stop)
+	return stop
+}
+
+// mutated records that the metadata saved by Save has changed, for
+// StartAutosave. Entries are changed through setEntry, deleteEntry,
+// FileCacheEntry.change and recordAccess, which call it, so that no change is
+// left unsaved.
+func (c *FileCache) mutated() {
+	c.dirty.Store(true)
+}
+
+// autosave saves the metadata to StatePath if it has changed since the last
+// save.
+func (c *FileCache) autosave(logger lager.Logger) {
+	if !c.dirty.Swap(false) {
+		return
+	}
+
+	lock.RLock()
+	err := c.save(c.StatePath)
+	lock.RUnlock()
+	if err != nil {
+		logger.Error("failed-to-save", err)
+		c.mutated()
+	}
+}
+
+// Close shuts the cache down for a graceful stop. It stops the janitors and
+// autosaves, saves the metadata to StatePath if it is set and removes the
+// directory of a cache created by NewTempCache. Later changes fail with
+// ClosedErr, or change nothing for methods without an error such as Touch,
+// Pin and SetMaxSize. Keys, Stats and the other accessors keep returning what
+// the cache held, and files in use can still be released. Closing a closed
+// cache does nothing.
+func (c *FileCache) Close(logger lager.Logger) error {
+	logger = logger.Session("file-cache.close")
+	lock.Lock()
+	if c.closed {
+		lock.Unlock()
+		return nil
+	}
+	logger.Info("starting")
+	defer logger.Info("finished")
+
+	c.closed = true
+	if c.events != nil {
+		close(c.events)
+	}
+	janitors := c.janitors
+	c.janitors = nil
+	lock.Unlock()
+
+	// a sweep in progress needs the lock to finish
+	for _, stop := range janitors {
+		stop()
+	}
+
+	var err error
+	if c.StatePath != "" {
+		lock.RLock()
+		err = c.save(c.StatePath)
+		lock.RUnlock()
+		if err != nil {
+			logger.Error("failed-to-save", err)
+		}
+	}
+
+	if c.temporary {
+		removeErr := os.RemoveAll(c.CachedPath)
+		if removeErr != nil {
+			logger.Error("failed-to-remove-cache-dir", removeErr)
+			err = errors.Join(err, removeErr)
+		}
+	}
+	return err
+}
+
+// sweep removes expired entries and orphaned cache files. The cache directory
+// is listed without holding the lock, so files are checked one at a time.
+func (c *FileCache) sweep(logger lager.Logger) {
+	logger = logger.Session("sweep")
+	c.removeExpired(logger)
+
+	paths, err := c.cacheFiles()
+	if err != nil {
+		logger.Error("failed-to-read-cache-dir", err)
+		return
+	}
+
+	for _, path := range paths {
+		if !cacheFileName.MatchString(filepath.Base(path)) {
+			// not created by the cache, e.g. saved state or a staging area
+			continue
+		}
+
+		lock.Lock()
+		removed, err := c.removeFileIfUntracked(path, c.trackedFiles())
+		lock.Unlock()
+		if err != nil {
+			logger.Error("failed-to-remove-orphan", err, lager.Data{"path": path})
+		} else if removed {
+			logger.Info("removed-orphan", lager.Data{"path": path})
+		}
+	}
+}
+
+func (c *FileCache) removeExpired(logger lager.Logger) {
+	defer c.notifyEvictions()
+	lock.Lock()
+	defer lock.Unlock()
+
+	for cacheKey, entry := range c.Entries {
+		if entry.expired() {
+			logger.Info("entry-expired", lager.Data{"cache_key": cacheKey})
+			c.remove(logger, cacheKey, EvictReasonExpired)
+		}
+	}
+
+	for cacheKey, expiry := range c.knownMisses {
+		if !c.currentTime().Before(expiry) {
+			delete(c.knownMisses, cacheKey)
+		}
+	}
+}
+
+// SetMaxSize changes the size limit of the cache. If the limit is lowered,
+// entries are evicted right away until the cache fits, and the number of bytes
+// evicted is returned. It does nothing once the cache is closed.
+func (c *FileCache) SetMaxSize(logger lager.Logger, maxSizeInBytes int64) int64 {
+	logger = logger.Session("file-cache.set-max-size", lager.Data{"max_size_in_bytes": maxSizeInBytes})
+	defer c.notifyEvictions()
+	lock.Lock()
+	defer lock.Unlock()
+
+	logger.Info("starting")
+	defer logger.Info("finished")
+
+	if c.closed {
+		return 0
+	}
+	c.maxSizeInBytes = maxSizeInBytes
+	return c.evictDownTo(logger, maxSizeInBytes, "").freed
+}
+
+// Dir returns the directory that holds the cached files.
+func (c *FileCache) Dir() string {
+	return c.CachedPath
+}
+
+// TempFile creates a new temporary file in the cache directory for staging
+// content for cacheKey, so that a subsequent Add moves it into place with a
+// cheap rename. The caller is responsible for the file until it is added.
+func (c *FileCache) TempFile(cacheKey string) (*os.File, error) {
+	return c.tempFile(lager.NewLogger("file-cache"), cacheKey)
+}
+
+func (c *FileCache) tempFile(logger lager.Logger, cacheKey string) (*os.File, error) {
+	return c.createTemp(logger, cacheKey+"-staging-")
+}
+
+// createTemp creates a new temporary file in the cache directory like
+// os.CreateTemp. If the cache directory has been removed, it is recreated
+// once with recreateDir. It must be called without the lock held.
+func (c *FileCache) createTemp(logger lager.Logger, pattern string) (*os.File, error) {
+	f, err := os.CreateTemp(c.CachedPath, pattern)
+	if err == nil {
+		return f, nil
+	}
+	_, statErr := os.Stat(c.CachedPath)
+	if !os.IsNotExist(statErr) && !errors.Is(statErr, syscall.ENOTDIR) {
+		return nil, err
+	}
+
+	err = c.recreateDir(logger)
+	if err != nil {
+		return nil, err
+	}
+	return os.CreateTemp(c.CachedPath, pattern)
+}
+
+// recreateDir recreates the cache directory after it has been removed from
+// under the cache, dropping the entries whose files went with it. It fails
+// with CacheDirMissingErr if the directory cannot be created.
+func (c *FileCache) recreateDir(logger lager.Logger) error {
+	logger = logger.Session("recreate-cache-dir", lager.Data{"cached_path": c.CachedPath})
+	defer c.notifyEvictions()
+	lock.Lock()
+	defer lock.Unlock()
+
+	_, err := os.Stat(c.CachedPath)
+	if err == nil {
+		// recreated by a concurrent add
+		return nil
+	}
+
+	logger.Info("cache-dir-missing")
+	err = os.MkdirAll(c.CachedPath, 0750)
+	if err != nil {
+		logger.Error("failed-to-recreate-cache-dir", err)
+		return fmt.Errorf("%w: %w", CacheDirMissingErr, err)
+	}
+
+	cacheKeys := make([]string, 0, len(c.Entries))
+	for cacheKey := range c.Entries {
+		cacheKeys = append(cacheKeys, cacheKey)
+	}
+	sort.Strings(cacheKeys)
+	for _, cacheKey := range cacheKeys {
+		entry := c.Entries[cacheKey]
+		if entry.fileDoesNotExist() && entry.dirDoesNotExist() {
+			c.remove(logger, cacheKey, EvictReasonMissing)
+		}
+	}
+	return nil
+}
+
+// ContainsKey reports whether cacheKey has an entry that has not expired. Unlike
+// Get, it does not count as an access to the entry.
+func (c *FileCache) ContainsKey(cacheKey string) bool {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	entry := c.Entries[cacheKey]
+	return entry != nil && !entry.expired()
+}
+
+// KeyStatus is what Lookup knows about a key.
+type KeyStatus int
+
+const (
+	// KeyUnknown means the key has no entry and is not marked as missing.
+	KeyUnknown KeyStatus = iota
+	// KeyCached means the key has an entry that has not expired.
+	KeyCached
+	// KeyMissing means the key was marked as missing with MarkMiss and the
+	// mark has not expired.
+	KeyMissing
+)
+
+func (s KeyStatus) String() string {
+	switch s {
+	case KeyUnknown:
+		return "unknown"
+	case KeyCached:
+		return "cached"
+	case KeyMissing:
+		return "missing"
+	default:
+		return "invalid"
+	}
+}
+
+// MarkMiss remembers for ttl that cacheKey is known to be missing, for
+// example because its origin returned not found, so that callers can check
+// Lookup before asking the origin again. Marking a key again replaces the
+// previous mark, which lets callers back off by passing growing ttls. Marks
+// take no space in the cache, expire on their own and are cleared when an
+// entry is added for the key. It does nothing once the cache is closed.
+func (c *FileCache) MarkMiss(cacheKey string, ttl time.Duration) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if c.closed {
+		return
+	}
+	if c.knownMisses == nil {
+		c.knownMisses = map[string]time.Time{}
+	}
+	c.knownMisses[cacheKey] = c.currentTime().Add(ttl)
+}
+
+// Lookup reports whether cacheKey is cached, known to be missing or unknown.
+// Like ContainsKey, it does not count as an access to the entry.
+func (c *FileCache) Lookup(cacheKey string) KeyStatus {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	entry := c.Entries[cacheKey]
+	if entry != nil && !entry.expired() {
+		return KeyCached
+	}
+	if expiry, ok := c.knownMisses[cacheKey]; ok && c.currentTime().Before(expiry) {
+		return KeyMissing
+	}
+	return KeyUnknown
+}
+
+// Touch records an access to the entry for cacheKey, making it the most
+// recently used, and returns the path of its file, or of its expanded
+// directory if only that is left. It returns "" and false without changing
+// anything if there is no such entry or it has expired, so unlike reading the
+// path and recording the access separately it never leaves an entry behind
+// for a key that was evicted in between. The path is not protected from
+// eviction; use Acquire for that. Once the cache is closed it always returns
+// false.
+func (c *FileCache) Touch(cacheKey string) (path string, ok bool) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	entry := c.Entries[cacheKey]
+	if c.closed || entry == nil || entry.expired() {
+		return "", false
+	}
+
+	entry.recordAccess()
+	if entry.fileDoesNotExist() {
+		return entry.ExpandedDirectoryPath, true
+	}
+	return entry.FilePath, true
+}
+
+// UpdateInfo replaces the caching info of the entry for cacheKey and records
+// an access to it, for when a conditional request showed that the cached file
+// is still current but returned new validators. The file is not touched. It
+// returns false if there is no such entry or it has expired, or the cache is
+// closed.
+func (c *FileCache) UpdateInfo(cacheKey string, info CachingInfoType) bool {
+	lock.Lock()
+	defer lock.Unlock()
+
+	entry := c.Entries[cacheKey]
+	if c.closed || entry == nil || entry.expired() {
+		return false
+	}
+
+	entry.change(func() {
+		entry.CachingInfo = info
+	})
+	entry.recordAccess()
+	return true
+}
+
+// Pin exempts the entry for cacheKey from eviction, for artifacts too
+// expensive to fetch again, and reports whether there was such an entry.
+// Pinned entries still count toward the used space, so a cache full of them
+// fails Add with CacheBusyErr. The pin is kept when the entry is replaced and
+// is saved with the entry. Once the cache is closed Pin returns false.
+func (c *FileCache) Pin(cacheKey string) bool {
+	return c.setPinned(cacheKey, true)
+}
+
+// Unpin lets the entry for cacheKey be evicted again and reports whether
+// there was such an entry. Like Pin, it returns false once the cache is
+// closed.
+func (c *FileCache) Unpin(cacheKey string) bool {
+	return c.setPinned(cacheKey, false)
+}
+
+func (c *FileCache) setPinned(cacheKey string, pinned bool) bool {
+	lock.Lock()
+	defer lock.Unlock()
+
+	entry := c.Entries[cacheKey]
+	if c.closed || entry == nil {
+		return false
+	}
+	entry.change(func() {
+		entry.Pinned = pinned
+	})
+	if !pinned {
+		c.signalRoomFreed()
+	}
+	return true
+}
+
+// Snapshot returns the metadata of every entry, in no particular order. The
+// entries are copied under the lock, so they are consistent with each other.
+func (c *FileCache) Snapshot() []EntryInfo {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	infos := make([]EntryInfo, 0, len(c.Entries))
+	for cacheKey, entry := range c.Entries {
+		infos = append(infos, entry.info(cacheKey))
+	}
+	return infos
+}
+
+// EntriesByLRU returns the metadata of every entry like Snapshot, sorted in
+// the order the cache would evict them: expired entries first, then by the
+// eviction policy, which for LRU is by access time with ties broken by
+// insertion order. Entries that are in use or pinned are included where they
+// would rank, although they are skipped while they cannot be evicted.
+func (c *FileCache) EntriesByLRU() []EntryInfo {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	entries := make([]*FileCacheEntry, 0, len(c.Entries))
+	for _, entry := range c.Entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return c.evictsBefore(entries[i], entries[j])
+	})
+
+	infos := make([]EntryInfo, 0, len(entries))
+	for _, entry := range entries {
+		infos = append(infos, entry.info(entry.cacheKey))
+	}
+	return infos
+}
+
+// EvictionOrder returns the keys of the entries in the order they would be
+// evicted next, leaving out the entries that are in use or pinned and so
+// cannot be evicted now. Unlike EntriesByLRU, it walks the eviction order
+// kept by the cache rather than sorting every entry.
+func (c *FileCache) EvictionOrder() []string {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	cacheKeys := []string{}
+	c.eachVictim("", func(victim *FileCacheEntry) bool {
+		cacheKeys = append(cacheKeys, victim.cacheKey)
+		return true
+	})
+	return cacheKeys
+}
+
+// NextVictim returns the key and size of the entry that would be evicted next
+// to make room, without evicting it. Entries that are in use or pinned are
+// skipped, and ok is false if no entry can be evicted.
+func (c *FileCache) NextVictim() (cacheKey string, size int64, ok bool) {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	cacheKey, victim := c.nextVictim("")
+	if victim == nil {
+		return "", 0, false
+	}
+	return cacheKey, victim.Size, true
+}
+
+// Walk calls fn with the metadata of each entry, in no particular order, until
+// fn returns false. fn is called while the cache lock is held, so it must be
+// fast and must not call back into the cache, which would deadlock.
+func (c *FileCache) Walk(fn func(cacheKey string, entry EntryInfo) bool) {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	for cacheKey, entry := range c.Entries {
+		if !fn(cacheKey, entry.info(cacheKey)) {
+			return
+		}
+	}
+}
+
+// Keys returns a snapshot of the cache keys currently tracked by the cache, in
+// no particular order.
+func (c *FileCache) Keys() []string {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	keys := make([]string, 0, len(c.Entries))
+	for cacheKey := range c.Entries {
+		keys = append(keys, cacheKey)
+	}
+	return keys
+}
+
+// Len returns the number of entries currently tracked by the cache.
+func (c *FileCache) Len() int {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	return len(c.Entries)
+}
+
+// EntryInfo is a copy of the metadata of an entry.
+type EntryInfo struct {
+	CacheKey string
+	Size     int64
+	Access   time.Time
+	// Cost is the cost given to AddWithCost, or zero.
+	Cost        float64
+	CachingInfo CachingInfoType
+	FilePath    string
+	// DirectoryPath is the expanded directory of the entry, or empty if the
+	// entry has not been expanded.
+	DirectoryPath string
+}
+
+// IsDirectory reports whether the entry is held as an expanded directory.
+func (i EntryInfo) IsDirectory() bool {
+	return i.DirectoryPath != ""
+}
+
+type CacheStats struct {
+	UsedBytes    int64
+	MaxBytes     int64
+	EntryCount   int
+	OldestAccess time.Time
+}
+
+// Stats returns a consistent view of the cache usage. OldestAccess is the zero
+// time when the cache is empty.
+func (c *FileCache) Stats() CacheStats {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	_, oldestAccess := c.usage()
+	return CacheStats{
+		UsedBytes:    c.usedBytes,
+		MaxBytes:     c.maxSizeInBytes,
+		EntryCount:   len(c.Entries),
+		OldestAccess: oldestAccess,
+	}
+}
+
+// HitMissCounts returns the number of lookups that found an entry and the
+// number that did not. Lookups are counted by Get, GetDirectory, Acquire,
+// OpenForKey and ReaderAt, those of a Namespace, and the lookups GetOrLoad and
+// GetOrLoadByURL make before loading.
+func (c *FileCache) HitMissCounts() (hits, misses uint64) {
+	return c.hits.Load(), c.misses.Load()
+}
+
+// MetricsEmitter receives the metrics of the cache. It matches the shape of
+// the value metrics of dropsonde, so it can be adapted to most backends.
+type MetricsEmitter interface {
+	SendValue(name string, value float64, unit string)
+}
 
-	err := os.Rename(sourcePath, cachePath)
-	if err != nil {
-		return "", err
-	}
+const (
+	MetricUsedBytes = "FileCacheUsedBytes"
+	MetricEntries   = "FileCacheEntries"
+	MetricHitRatio  = "FileCacheHitRatio"
+	MetricEvictions = "FileCacheEvictions"
+)
 
-	newEntry := newFileCacheEntry(cachePath, size, cachingInfo)
-	c.Entries[cacheKey] = newEntry
-	if oldEntry != nil {
-		oldEntry.decrementUse()
-		c.updateOldEntries(logger, cacheKey, oldEntry)
+// EmitMetrics sends the used bytes, the number of entries, the hit ratio of
+// lookups and the number of entries evicted since the cache was created to
+// emitter. Entries that were removed or replaced do not count as evicted. Call
+// it on demand or from a timer.
+func (c *FileCache) EmitMetrics(emitter MetricsEmitter) {
+	stats := c.Stats()
+	hits, misses := c.HitMissCounts()
+
+	hitRatio := 0.0
+	if hits+misses > 0 {
+		hitRatio = float64(hits) / float64(hits+misses)
 	}
-	return newEntry.expandedDirectory()
+
+	emitter.SendValue(MetricUsedBytes, float64(stats.UsedBytes), "B")
+	emitter.SendValue(MetricEntries, float64(stats.EntryCount), "Metric")
+	emitter.SendValue(MetricHitRatio, hitRatio, "Ratio")
+	emitter.SendValue(MetricEvictions, float64(c.evictionCount.Load()), "Metric")
 }
 
-func (c *FileCache) Get(logger lager.Logger, cacheKey string) (*CachedFile, CachingInfoType, error) {
-	logger = logger.Session("file-cache.get", lager.Data{"cache_key": cacheKey})
-	lock.Lock()
-	defer lock.Unlock()
+// Save writes the cache metadata to path. The metadata is written to a
+// temporary file next to path and renamed into place, so a crash never leaves
+// a partially written file behind.
+func (c *FileCache) Save(logger lager.Logger, path string) error {
+	logger = logger.Session("file-cache.save", lager.Data{"path": path})
+	lock.RLock()
+	defer lock.RUnlock()
 
 	logger.Info("starting")
 	defer logger.Info("finished")
 
-	entry := c.Entries[cacheKey]
-	if entry == nil {
-		return nil, CachingInfoType{}, EntryNotFound
+	if c.closed {
+		return ClosedErr
 	}
+	return c.save(path)
+}
 
-	if entry.fileDoesNotExist() {
-		c.makeRoom(logger, entry.Size, cacheKey)
+// save writes the metadata to path like Save, with the lock held.
+func (c *FileCache) save(path string) error {
+	json, err := json.Marshal(c)
+	if err != nil {
+		return err
 	}
 
-	entry.Access = time.Now()
-	readCloser, err := entry.readCloser()
+	tempFile, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+"-")
 	if err != nil {
-		return nil, CachingInfoType{}, err
+		return err
 	}
+	defer os.Remove(tempFile.Name())
 
-	return readCloser, entry.CachingInfo, nil
+	_, err = tempFile.Write(json)
+	if err != nil {
+		// #nosec G104 - the write error is the one worth reporting
+		tempFile.Close()
+		return err
+	}
+
+	err = tempFile.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tempFile.Name(), path)
 }
 
-func (c *FileCache) GetDirectory(logger lager.Logger, cacheKey string) (string, CachingInfoType, error) {
-	logger = logger.Session("file-cache.get-directory", lager.Data{"cache_key": cacheKey})
+// Load restores the cache metadata from a file written by Save, if such a file
+// exists. Entries keep the access times they were saved with, so eviction
+// follows the same recency order as before the restart. Files in the cache
+// directory that are not tracked by the restored metadata are removed, and
+// entries are evicted if the restored cache does not fit in maxSizeInBytes.
+func (c *FileCache) Load(logger lager.Logger, path string) error {
+	logger = logger.Session("file-cache.load", lager.Data{"path": path})
+	defer c.notifyEvictions()
 	lock.Lock()
 	defer lock.Unlock()
 
 	logger.Info("starting")
 	defer logger.Info("finished")
 
-	entry := c.Entries[cacheKey]
-	if entry == nil {
-		return "", CachingInfoType{}, EntryNotFound
+	if c.closed {
+		return ClosedErr
 	}
 
-	// Was it expanded before
-	if entry.dirDoesNotExist() {
-		// Do we have enough room to double the size?
-		c.makeRoom(logger, entry.Size, cacheKey)
-		entry.Size = entry.Size * 2
+	file, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
 	}
 
-	entry.Access = time.Now()
-	dir, err := entry.expandedDirectory()
-	if err != nil {
-		return "", CachingInfoType{}, err
+	if err == nil {
+		// parse the file only if it exists
+		// #nosec G104 - we explicitly don't want json decoding errors to propagate here
+		json.NewDecoder(file).Decode(c)
+		// #nosec G104 - we explicitly don't want file.Close errors to propagate here
+		file.Close()
 	}
 
-	return dir, entry.CachingInfo, nil
-}
+	c.recount()
 
-func (c *FileCache) Remove(logger lager.Logger, cacheKey string) {
-	logger = logger.Session("file-cache.remove", lager.Data{"cache_key": cacheKey})
+	// set the inuse count to 0 since all containers will be recreated
+	for _, entry := range c.Entries {
+		// inuseCount starts at 1 (i.e. 1 == no references to the entry)
+		entry.directoryInUseCount = 0
+		entry.fileInUseCount = 0
+	}
+
+	// delete files that aren't in the cache. **note** if there is no
+	// saved state, then all files will be deleted
+	trackedFiles := map[string]struct{}{}
+
+	for _, entry := range c.Entries {
+		trackedFiles[entry.FilePath] = struct{}{}
+		trackedFiles[entry.ExpandedDirectoryPath] = struct{}{}
+	}
+
+	paths, err := c.cacheFiles()
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for _, path := range paths {
+		_, err = c.removeFileIfUntracked(path, trackedFiles)
+		if err != nil {
+			return err
+		}
+	}
+
+	// free some disk space in case the maxSizeInBytes was changed
+	c.makeRoom(logger, 0, "")
+	return nil
+}
 
+// RemoveFileIfUntracked removes path if no entry of the cache refers to it,
+// and reports whether it was removed. Paths outside the cache directory are
+// rejected with OutsideCacheErr.
+func (c *FileCache) RemoveFileIfUntracked(logger lager.Logger, path string) (bool, error) {
+	logger = logger.Session("file-cache.remove-file-if-untracked", lager.Data{"path": path})
 	lock.Lock()
+	defer lock.Unlock()
+
 	logger.Info("starting")
-	c.remove(logger, cacheKey)
-	lock.Unlock()
-	logger.Info("finished")
+	defer logger.Info("finished")
+
+	if c.closed {
+		return false, ClosedErr
+	}
+	removed, err := c.removeFileIfUntracked(path, c.trackedFiles())
+	if err != nil {
+		logger.Error("failed-to-remove-file", err)
+		return false, err
+	}
+	return removed, nil
 }
 
-func (c *FileCache) remove(logger lager.Logger, cacheKey string) {
-	entry := c.Entries[cacheKey]
-	if entry != nil {
-		entry.decrementUse()
-		c.updateOldEntries(logger, cacheKey, entry)
-		delete(c.Entries, cacheKey)
+func pathInUse(path string, trackedFiles map[string]struct{}) bool {
+	if _, ok := trackedFiles[path]; ok {
+		return true
+	}
+	_, err := os.Lstat(path)
+	return !os.IsNotExist(err)
+}
+
+// trackedFiles returns the files and directories that entries, including
+// entries that were replaced but are still in use, refer to.
+func (c *FileCache) trackedFiles() map[string]struct{} {
+	trackedFiles := map[string]struct{}{}
+	for _, entries := range []map[string]*FileCacheEntry{c.Entries, c.OldEntries} {
+		for _, entry := range entries {
+			trackedFiles[entry.FilePath] = struct{}{}
+			trackedFiles[entry.ExpandedDirectoryPath] = struct{}{}
+		}
+	}
+	return trackedFiles
+}
+
+func (c *FileCache) removeFileIfUntracked(path string, trackedFiles map[string]struct{}) (bool, error) {
+	path = filepath.Clean(path)
+	rel, err := filepath.Rel(c.CachedPath, path)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return false, OutsideCacheErr
+	}
+
+	// paths inside a tracked directory are tracked as well
+	for p := path; p != c.CachedPath; p = filepath.Dir(p) {
+		if _, ok := trackedFiles[p]; ok {
+			return false, nil
+		}
+	}
+
+	err = os.RemoveAll(path)
+	if err != nil {
+		return false, err
 	}
+	return true, nil
 }
 
 func (c *FileCache) updateOldEntries(logger lager.Logger, cacheKey string, entry *FileCacheEntry) {
+	c.mutated()
+	if entry != nil && entry.acquiredCount > 0 {
+		// somebody acquired the file and will release it by its path
+		c.OldEntries[cacheKey+entry.FilePath] = entry
+	}
+
 	if entry != nil {
 		if entry.ExpandedDirectoryPath != "" {
 			// put it in the oldEntries Cache since somebody may still be using the directory
@@ -376,43 +4370,535 @@ func (c *FileCache) updateOldEntries(logger lager.Logger, cacheKey string, entry
 	}
 }
 
-func (c *FileCache) makeRoom(logger lager.Logger, size int64, excludedCacheKey string) {
-	usedSpace := c.usedSpace(logger)
-	for c.maxSizeInBytes < usedSpace+size {
-		var oldestEntry *FileCacheEntry
-		oldestAccessTime, oldestCacheKey := maxTime(), ""
-		for ck, f := range c.Entries {
-			if f.Access.Before(oldestAccessTime) && ck != excludedCacheKey && !f.inUse() {
-				oldestAccessTime = f.Access
-				oldestEntry = f
-				oldestCacheKey = ck
+// makeRoom evicts entries until size more bytes fit in the cache and returns
+// the keys it evicted, in eviction order. fits is false if there is not enough
+// room because the remaining entries are in use (or excluded), in which case
+// the cache will be over its limit.
+func (c *FileCache) makeRoom(logger lager.Logger, size int64, excludedCacheKey string) (evicted []string, fits bool) {
+	// failures to delete evicted files are logged by remove
+	result := c.evictDownTo(logger, c.maxSizeInBytes-size, excludedCacheKey)
+	if !result.fits {
+		logger.Info("not-enough-space", lager.Data{"requested_bytes": size, "max_bytes": c.maxSizeInBytes})
+	}
+	return result.evicted, result.fits
+}
+
+// planRoomForKey selects the entries to evict so that an entry for cacheKey
+// fits under MaxEntries, in eviction order. Replacing the entry for cacheKey
+// does not add to the number of entries, so cacheKey itself is never
+// selected.
+func (c *FileCache) planRoomForKey(logger lager.Logger, cacheKey string) []string {
+	if c.MaxEntries <= 0 {
+		return nil
+	}
+
+	limit := c.MaxEntries
+	if _, ok := c.Entries[cacheKey]; !ok {
+		limit--
+	}
+	excess := len(c.Entries) - limit
+	if excess <= 0 {
+		return nil
+	}
+
+	victims := []string{}
+	c.eachVictim(cacheKey, func(victim *FileCacheEntry) bool {
+		victims = append(victims, victim.cacheKey)
+		return len(victims) < excess
+	})
+	if len(victims) < excess {
+		logger.Info("too-many-entries", lager.Data{"entries": len(c.Entries), "max_entries": c.MaxEntries})
+	}
+	return victims
+}
+
+// evictPlanned evicts the victims planned for an add of cacheKey once it has
+// committed and returns the keys it evicted. The entry for cacheKey has been
+// replaced by then, and keepReserve may have evicted some of the victims
+// already, so those are skipped.
+func (c *FileCache) evictPlanned(logger lager.Logger, cacheKey string, victims []string) []string {
+	remaining := []string{}
+	for _, victimCacheKey := range victims {
+		if victimCacheKey != cacheKey && c.Entries[victimCacheKey] != nil {
+			remaining = append(remaining, victimCacheKey)
+		}
+	}
+	// failures to delete evicted files are logged by remove
+	c.evict(logger, remaining)
+	return remaining
+}
+
+type evictResult struct {
+	// freed is the number of bytes accounted to the evicted entries
+	freed   int64
+	evicted []string
+	// fits reports whether the target was reached
+	fits bool
+	// err is the first error from deleting the files of evicted entries
+	err error
+}
+
+// evictDownTo evicts entries until no more than targetBytes are used.
+func (c *FileCache) evictDownTo(logger lager.Logger, targetBytes int64, excludedCacheKey string) evictResult {
+	result := c.planEviction(targetBytes, excludedCacheKey)
+	result.err = c.evict(logger, result.evicted)
+	return result
+}
+
+// evict removes the entries of victimCacheKeys to make room, in one
+// "file-cache.evict" span, and returns the first error from deleting their
+// files.
+func (c *FileCache) evict(logger lager.Logger, victimCacheKeys []string) error {
+	if len(victimCacheKeys) == 0 {
+		return nil
+	}
+	defer c.startSpan("file-cache.evict").End()
+
+	var firstErr error
+	for _, victimCacheKey := range victimCacheKeys {
+		err := c.remove(logger, victimCacheKey, EvictReasonCapacity)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// planEviction selects the entries evictDownTo would evict, without evicting
+// them.
+func (c *FileCache) planEviction(targetBytes int64, excludedCacheKey string) evictResult {
+	return c.planEvictionAfter(nil, targetBytes, excludedCacheKey)
+}
+
+// planEvictionAfter plans an eviction like planEviction, once the entries of
+// victims, which are already planned to be evicted, are gone. They are not
+// part of the result.
+func (c *FileCache) planEvictionAfter(victims []string, targetBytes int64, excludedCacheKey string) evictResult {
+	// planned counts the victims holding each shared content, which is only
+	// freed with the last entry that holds it
+	planned := map[string]int{}
+	skipped := map[string]struct{}{}
+	usedSpace := c.usedBytes
+	for _, victimCacheKey := range victims {
+		victim := c.Entries[victimCacheKey]
+		if !victim.shareable() || c.shared[victim.ContentHash]-planned[victim.ContentHash] <= 1 {
+			usedSpace -= victim.Size
+		}
+		if victim.shareable() {
+			planned[victim.ContentHash]++
+		}
+		skipped[victimCacheKey] = struct{}{}
+	}
+
+	result := evictResult{fits: targetBytes >= usedSpace}
+	if result.fits {
+		return result
+	}
+
+	eachVictim := c.eachVictim
+	if c.EvictFewest {
+		eachVictim = c.eachVictimLargestFirst
+	}
+
+	eachVictim(excludedCacheKey, func(victim *FileCacheEntry) bool {
+		if _, ok := skipped[victim.cacheKey]; ok {
+			return true
+		}
+		if !victim.shareable() || c.shared[victim.ContentHash]-planned[victim.ContentHash] <= 1 {
+			usedSpace -= victim.Size
+			result.freed += victim.Size
+		}
+		if victim.shareable() {
+			planned[victim.ContentHash]++
+		}
+		result.evicted = append(result.evicted, victim.cacheKey)
+		return targetBytes < usedSpace
+	})
+	result.fits = targetBytes >= usedSpace
+	return result
+}
+
+// eachVictimLargestFirst calls visit with the entries in the order
+// EvictFewest evicts them: the expired entries, then the older half of the
+// others from the largest to the smallest, then the rest, each group in the
+// order eachVictim visits it.
+func (c *FileCache) eachVictimLargestFirst(excludedCacheKey string, visit func(victim *FileCacheEntry) bool) {
+	expired := []*FileCacheEntry{}
+	others := []*FileCacheEntry{}
+	c.eachVictim(excludedCacheKey, func(victim *FileCacheEntry) bool {
+		if victim.expired() {
+			expired = append(expired, victim)
+		} else {
+			others = append(others, victim)
+		}
+		return true
+	})
+
+	older := append([]*FileCacheEntry{}, others[:(len(others)+1)/2]...)
+	sort.SliceStable(older, func(i, j int) bool {
+		return older[i].Size > older[j].Size
+	})
+
+	for _, group := range [][]*FileCacheEntry{expired, older, others[len(older):]} {
+		for _, victim := range group {
+			if !visit(victim) {
+				return
 			}
 		}
+	}
+}
 
-		if oldestEntry == nil {
+// planEvictionAmong plans an eviction like planEviction, but only among
+// entries, which take up usedSpace, by scanning them. Victims are deleted from entries.
+func (c *FileCache) planEvictionAmong(entries map[string]*FileCacheEntry, usedSpace, targetBytes int64, excludedCacheKey string) evictResult {
+	result := evictResult{fits: true}
+	for targetBytes < usedSpace {
+		victimCacheKey, victim := c.victimAmong(entries, excludedCacheKey)
+		if victim == nil {
 			// could not find anything we could remove
+			result.fits = false
+			return result
+		}
+
+		if !sharesContent(entries, victimCacheKey, victim) {
+			usedSpace -= victim.Size
+			result.freed += victim.Size
+		}
+		result.evicted = append(result.evicted, victimCacheKey)
+		delete(entries, victimCacheKey)
+	}
+	return result
+}
+
+// WouldEvict returns the keys that adding size bytes would evict, in eviction
+// order, without evicting anything. fits is false if the cache would still be
+// over its limit after evicting every entry that is not in use. size is
+// rounded up to BlockSize as Add rounds it. Only evictions to stay under the
+// size limit are predicted: those to stay under MaxEntries and to keep the
+// free-space reserve of WithReserve are not.
+func (c *FileCache) WouldEvict(size int64) (victims []string, fits bool) {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	result := c.planEviction(c.maxSizeInBytes-c.roundToBlock(size), "")
+	return result.evicted, result.fits
+}
+
+var freeBytes = diskFreeBytes
+
+// keepReserve evicts entries until adding size bytes leaves at least
+// minFreeBytes free on disk. If free space cannot be measured the reserve is
+// not enforced.
+func (c *FileCache) keepReserve(logger lager.Logger, size int64) ([]string, error) {
+	if c.minFreeBytes <= 0 {
+		return nil, nil
+	}
+
+	evicted := []string{}
+	for {
+		free, err := freeBytes(c.CachedPath)
+		if err != nil {
+			logger.Error("failed-to-measure-free-space", err)
+			return evicted, nil
+		}
+		if free-size >= c.minFreeBytes {
+			return evicted, nil
+		}
+
+		victimCacheKey, victim := c.nextVictim("")
+		if victim == nil {
+			logger.Info("not-enough-free-space", lager.Data{"free_bytes": free, "min_free_bytes": c.minFreeBytes})
+			return evicted, NotEnoughFreeSpaceErr
+		}
+		if len(evicted) == 0 {
+			defer c.startSpan("file-cache.evict").End()
+		}
+		evicted = append(evicted, victimCacheKey)
+		c.remove(logger, victimCacheKey, EvictReasonCapacity)
+	}
+}
+
+// nextVictim returns the entry the eviction policy would remove next, skipping
+// entries that are in use and the excluded cache key.
+func (c *FileCache) nextVictim(excludedCacheKey string) (string, *FileCacheEntry) {
+	var next *FileCacheEntry
+	c.eachVictim(excludedCacheKey, func(victim *FileCacheEntry) bool {
+		next = victim
+		return false
+	})
+	if next == nil {
+		return "", nil
+	}
+	return next.cacheKey, next
+}
+
+// eachVictim calls visit with the entries in the order the eviction policy
+// would remove them, skipping entries that are in use or pinned and the
+// excluded cache key, until visit returns false. Expired entries come first,
+// then the others in the order of the evictor, or of the victims heap for the
+// policies other than LRU, so that visiting k entries does not take time
+// proportional to the number of entries.
+func (c *FileCache) eachVictim(excludedCacheKey string, visit func(victim *FileCacheEntry) bool) {
+	evictable := func(e *FileCacheEntry) bool {
+		return e.cacheKey != excludedCacheKey && e.evictable()
+	}
+
+	// an entry expires no later than its children in the expiring heap, so
+	// the walk stops at entries that have not expired
+	expired := map[*FileCacheEntry]struct{}{}
+	expiredInOrder := []*FileCacheEntry{}
+	c.expiring.walk(func(e *FileCacheEntry) bool { return !e.expired() }, func(e *FileCacheEntry) bool {
+		expired[e] = struct{}{}
+		expiredInOrder = append(expiredInOrder, e)
+		return true
+	})
+	sort.Slice(expiredInOrder, func(i, j int) bool {
+		return c.ranksBefore(expiredInOrder[i], expiredInOrder[j])
+	})
+	for _, e := range expiredInOrder {
+		if evictable(e) && !visit(e) {
 			return
 		}
+	}
+
+	if c.evictor != nil {
+		c.evictor.Victims(func(cacheKey string) bool {
+			e := c.Entries[cacheKey]
+			if e == nil || !evictable(e) {
+				return true
+			}
+			if _, ok := expired[e]; ok {
+				return true
+			}
+			return visit(e)
+		})
+		return
+	}
+
+	c.victims.walk(nil, func(e *FileCacheEntry) bool {
+		if _, ok := expired[e]; ok || !evictable(e) {
+			return true
+		}
+		return visit(e)
+	})
+}
+
+// victimAmong picks the next victim like nextVictim, but by scanning entries.
+func (c *FileCache) victimAmong(entries map[string]*FileCacheEntry, excludedCacheKey string) (string, *FileCacheEntry) {
+	var victim *FileCacheEntry
+	victimCacheKey := ""
+	for ck, f := range entries {
+		if ck == excludedCacheKey || !f.evictable() {
+			continue
+		}
+		if victim == nil || c.evictsBefore(f, victim) {
+			victim = f
+			victimCacheKey = ck
+		}
+	}
+	return victimCacheKey, victim
+}
+
+func (c *FileCache) evictsBefore(a, b *FileCacheEntry) bool {
+	if a.expired() != b.expired() {
+		return a.expired()
+	}
+	return c.ranksBefore(a, b)
+}
 
-		usedSpace -= oldestEntry.Size
-		c.remove(logger, oldestCacheKey)
+// ranksBefore orders entries like evictsBefore, leaving out whether they have
+// expired, which changes with time rather than with the entries. Entries are
+// compared by one key at a time, cost per byte first, so that the order is
+// consistent however the entries are compared.
+func (c *FileCache) ranksBefore(a, b *FileCacheEntry) bool {
+	if costA, costB := a.costPerByte(), b.costPerByte(); costA != costB {
+		return costA < costB
 	}
+	if c.policy == SLRU && a.protected() != b.protected() {
+		return !a.protected()
+	}
+	if c.policy == LFU && a.AccessCount != b.AccessCount {
+		return a.AccessCount < b.AccessCount
+	}
+	if !a.Access.Equal(b.Access) {
+		return a.Access.Before(b.Access)
+	}
+	return a.Seq < b.Seq
 }
 
-func (c *FileCache) usedSpace(logger lager.Logger) int64 {
+// usage walks the entries once, returning the space used and the oldest
+// access time (the zero time if the cache is empty). The space is summed from
+// scratch, which tests use to check that usedBytes does not drift.
+func (c *FileCache) usage() (int64, time.Time) {
 	space := int64(0)
+	oldestAccess := time.Time{}
+	sharedContent := map[string]struct{}{}
 	for _, f := range c.Entries {
+		if oldestAccess.IsZero() || f.Access.Before(oldestAccess) {
+			oldestAccess = f.Access
+		}
+		if f.shareable() {
+			if _, ok := sharedContent[f.ContentHash]; ok {
+				continue
+			}
+			sharedContent[f.ContentHash] = struct{}{}
+		}
+		space += f.Size
+	}
+	return space, oldestAccess
+}
+
+// spaceUsedBy sums the space used by entries, counting shared content once.
+func spaceUsedBy(entries map[string]*FileCacheEntry) int64 {
+	space := int64(0)
+	sharedContent := map[string]struct{}{}
+	for _, f := range entries {
+		if f.shareable() {
+			if _, ok := sharedContent[f.ContentHash]; ok {
+				continue
+			}
+			sharedContent[f.ContentHash] = struct{}{}
+		}
 		space += f.Size
 	}
 	return space
 }
 
+var rename = os.Rename
+
+// moveFile moves sourcePath to destinationPath, retrying up to MoveAttempts
+// times while the move fails with an error that may go away on its own.
+func (c *FileCache) moveFile(ctx context.Context, logger lager.Logger, sourcePath, destinationPath string) error {
+	wait := c.MoveBackoff
+	for attempt := 1; ; attempt++ {
+		err := moveFile(ctx, sourcePath, destinationPath)
+		if err == nil || attempt >= c.MoveAttempts || !transientMoveErr(err) {
+			return err
+		}
+		logger.Info("retrying-move", lager.Data{"attempt": attempt, "error": err.Error()})
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
+
+// transientMoveErr reports whether a failed move may succeed if retried.
+func transientMoveErr(err error) bool {
+	return errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EBUSY)
+}
+
+var removeAll = os.RemoveAll
+
+// moveFile renames sourcePath to destinationPath, falling back to copying the
+// file when the two are on different devices.
+func moveFile(ctx context.Context, sourcePath, destinationPath string) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+
+	err = rename(sourcePath, destinationPath)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	err = copyFile(ctx, sourcePath, destinationPath)
+	if err != nil {
+		return err
+	}
+	return os.Remove(sourcePath)
+}
+
+// copyFile copies sourcePath to a temporary file next to destinationPath and
+// renames it into place, so destinationPath never holds a partial copy.
+func copyFile(ctx context.Context, sourcePath, destinationPath string) error {
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	info, err := source.Stat()
+	if err != nil {
+		return err
+	}
+
+	tempFile, err := os.CreateTemp(filepath.Dir(destinationPath), filepath.Base(destinationPath)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+
+	_, err = io.Copy(tempFile, &contextReader{ctx: ctx, reader: source})
+	if err == nil {
+		err = tempFile.Chmod(info.Mode().Perm())
+	}
+	if err != nil {
+		// #nosec G104 - the copy error is the one worth reporting
+		tempFile.Close()
+		return err
+	}
+
+	err = tempFile.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tempFile.Name(), destinationPath)
+}
+
+// contextReader stops reading once its context is done.
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	err := r.ctx.Err()
+	if err != nil {
+		return 0, err
+	}
+	return r.reader.Read(p)
+}
+
+// entrySize measures the content at path: the size of a file, or the total
+// size of the regular files under a directory.
+func entrySize(path string) (int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	if !info.IsDir() {
+		return info.Size(), nil
+	}
+	return directorySize(path)
+}
+
+// directorySize returns the total size of the regular files under dir.
+func directorySize(dir string) (int64, error) {
+	size := int64(0)
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
+
 func extractTarToDirectory(sourcePath, destinationDir string) error {
 	e := extractor.NewTar()
 	return e.Extract(sourcePath, destinationDir)
 }
-
-func maxTime() time.Time {
-	unixToInternal := int64((1969*365 + 1969/4 - 1969/100 + 1969/400) * 24 * 60 * 60)
-	return time.Unix(1<<63-1-unixToInternal, 999999999)
-}
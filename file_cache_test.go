@@ -2,15 +2,29 @@ package cacheddownloader_test
 
 import (
 	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"testing/iotest"
+	"time"
 
 	"code.cloudfoundry.org/cacheddownloader"
+	"code.cloudfoundry.org/lager/v3"
 	"code.cloudfoundry.org/lager/v3/lagertest"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
 )
 
 var _ = Describe("FileCache", func() {
@@ -37,11 +51,37 @@ var _ = Describe("FileCache", func() {
 	})
 
 	AfterEach(func() {
+		// the running count of used bytes never drifts from the entries
+		Expect(cache.UsedBytesDrift()).To(BeZero())
+		// the victims heap picks the same victim as scanning every entry
+		Expect(cache.VictimsAgree()).To(BeTrue())
+		// the content index holds exactly the entries with a content hash
+		Expect(cache.ContentIndexAgrees()).To(BeTrue())
+
 		os.RemoveAll(sourceFile.Name())
 		os.RemoveAll(sourceArchive.Name())
 		os.RemoveAll(cacheDir)
 	})
 
+	// tryAdd adds a file of 100 bytes starting with "content-"+cacheKey as the
+	// entry for cacheKey, unless opts say otherwise.
+	tryAdd := func(cacheKey string, opts ...addOption) error {
+		spec := addSpec{content: "content-" + cacheKey, size: 100}
+		for _, opt := range opts {
+			opt(&spec)
+		}
+		source := createSizedFile("cache-test-file", spec.content, spec.size)
+		reader, err := cache.AddWithOptions(context.Background(), logger, cacheKey, source.Name(), spec.size, spec.cachingInfo, spec.opts)
+		if err != nil {
+			return err
+		}
+		return reader.Close()
+	}
+
+	add := func(cacheKey string, opts ...addOption) {
+		Expect(tryAdd(cacheKey, opts...)).To(Succeed())
+	}
+
 	Describe("Add", func() {
 		var (
 			cacheKey   string
@@ -184,6 +224,57 @@ var _ = Describe("FileCache", func() {
 				Expect(err).NotTo(HaveOccurred())
 				Expect(readCloser).NotTo(BeNil())
 			})
+
+			It("fails with CacheBusyErr without evicting entries that are in use", func() {
+				cache = cacheddownloader.NewCache(cacheDir, 150)
+				inUse, err := cache.Add(logger, "in-use-key", createSizedFile("cache-test-file", "in-use", 100).Name(), 100, cacheInfo)
+				Expect(err).NotTo(HaveOccurred())
+				defer inUse.Close()
+
+				source := createSizedFile("cache-test-file", "new", 100)
+				done := make(chan struct{})
+				go func() {
+					defer GinkgoRecover()
+					defer close(done)
+					reader, err := cache.Add(logger, cacheKey, source.Name(), 100, cacheInfo)
+					Expect(err).To(Equal(cacheddownloader.CacheBusyErr))
+					Expect(reader).To(BeNil())
+				}()
+				Eventually(done).Should(BeClosed())
+
+				Expect(cache.Keys()).To(ConsistOf("in-use-key"))
+				Expect(cache.UsedBytes()).To(BeEquivalentTo(100))
+				Expect(source.Name()).To(BeARegularFile())
+				Expect(logger).To(gbytes.Say("not-enough-space"))
+			})
+
+			It("fails with CacheBusyErr when every entry is in use", func() {
+				cache = cacheddownloader.NewCache(cacheDir, 300)
+				for _, key := range []string{"key-1", "key-2", "key-3"} {
+					reader, err := cache.Add(logger, key, createSizedFile("cache-test-file", key, 100).Name(), 100, cacheInfo)
+					Expect(err).NotTo(HaveOccurred())
+					defer reader.Close()
+				}
+
+				_, err := cache.Add(logger, cacheKey, sourceFile.Name(), 100, cacheInfo)
+				Expect(err).To(Equal(cacheddownloader.CacheBusyErr))
+				Expect(cache.Keys()).To(ConsistOf("key-1", "key-2", "key-3"))
+				Expect(cache.UsedBytes()).To(BeEquivalentTo(300))
+			})
+
+			It("fails with CacheBusyErr without evicting the entries that are not in use", func() {
+				cache = cacheddownloader.NewCache(cacheDir, 200)
+				reader, err := cache.Add(logger, "idle-key", createSizedFile("cache-test-file", "idle", 100).Name(), 100, cacheInfo)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(reader.Close()).To(Succeed())
+				inUse, err := cache.Add(logger, "in-use-key", createSizedFile("cache-test-file", "in-use", 100).Name(), 100, cacheInfo)
+				Expect(err).NotTo(HaveOccurred())
+				defer inUse.Close()
+
+				_, err = cache.Add(logger, cacheKey, createSizedFile("cache-test-file", "new", 150).Name(), 150, cacheInfo)
+				Expect(err).To(Equal(cacheddownloader.CacheBusyErr))
+				Expect(cache.Keys()).To(ConsistOf("idle-key", "in-use-key"))
+			})
 		})
 	})
 
@@ -196,7 +287,7 @@ var _ = Describe("FileCache", func() {
 
 		BeforeEach(func() {
 			cacheKey = "the-cache-key"
-			fileSize = 100
+			fileSize = fileSizeOf(sourceArchive)
 			cacheInfo = cacheddownloader.CachingInfoType{}
 		})
 
@@ -359,6 +450,13 @@ var _ = Describe("FileCache", func() {
 				Expect(reader).To(BeNil())
 				Expect(ci).To(Equal(cacheInfo))
 			})
+
+			It("does not create an entry for the key", func() {
+				cache.Get(logger, cacheKey)
+				cache.GetDirectory(logger, cacheKey)
+				cache.Acquire(logger, cacheKey)
+				Expect(cache.Keys()).To(BeEmpty())
+			})
 		})
 
 		Context("when there is an item", func() {
@@ -432,6 +530,10 @@ var _ = Describe("FileCache", func() {
 				dir string
 			)
 
+			BeforeEach(func() {
+				fileSize = fileSizeOf(sourceArchive)
+			})
+
 			JustBeforeEach(func() {
 				var err error
 				cacheInfo.LastModified = "1234"
@@ -515,12 +617,12 @@ var _ = Describe("FileCache", func() {
 
 			Context("when there is not enough space in the cache", func() {
 				BeforeEach(func() {
-					maxSizeInBytes = 150
+					maxSizeInBytes = fileSize * 3 / 2
 					cache = cacheddownloader.NewCache(cacheDir, maxSizeInBytes)
 				})
 
 				JustBeforeEach(func() {
-					readCloser, err := cache.Add(logger, "new-cache-key", sourceFile.Name(), 20, cacheddownloader.CachingInfoType{})
+					readCloser, err := cache.Add(logger, "new-cache-key", sourceFile.Name(), fileSizeOf(sourceFile), cacheddownloader.CachingInfoType{})
 					Expect(err).NotTo(HaveOccurred())
 					Expect(readCloser.Close()).To(Succeed())
 				})
@@ -545,7 +647,7 @@ var _ = Describe("FileCache", func() {
 
 		BeforeEach(func() {
 			cacheKey = "key"
-			fileSize = 100
+			fileSize = fileSizeOf(sourceArchive)
 			cacheInfo = cacheddownloader.CachingInfoType{}
 		})
 
@@ -922,91 +1024,5254 @@ var _ = Describe("FileCache", func() {
 			})
 		})
 	})
-})
 
-func createFile(filename string, content string) *os.File {
-	sourceFile, err := os.CreateTemp("", filename)
-	Expect(err).NotTo(HaveOccurred())
-	sourceFile.WriteString(content)
-	sourceFile.Close()
+	Describe("Keys", func() {
+		Context("when the cache is empty", func() {
+			It("returns no keys", func() {
+				Expect(cache.Keys()).To(BeEmpty())
+				Expect(cache.Len()).To(Equal(0))
+			})
+		})
 
-	return sourceFile
-}
+		Context("when there are entries", func() {
+			BeforeEach(func() {
+				reader, err := cache.Add(logger, "key-1", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(reader.Close()).To(Succeed())
 
-func createArchive(filename, sampleData string) *os.File {
-	sourceFile, err := os.CreateTemp("", filename)
+				dir, err := cache.AddDirectory(logger, "key-2", sourceArchive.Name(), 100, cacheddownloader.CachingInfoType{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(cache.CloseDirectory(logger, "key-2", dir)).To(Succeed())
+			})
 
-	Expect(err).NotTo(HaveOccurred())
+			It("returns all of the cache keys", func() {
+				Expect(cache.Keys()).To(ConsistOf("key-1", "key-2"))
+				Expect(cache.Len()).To(Equal(2))
+			})
 
-	// Create a new tar archive.
-	tw := tar.NewWriter(sourceFile)
+			It("returns a copy of the keys", func() {
+				keys := cache.Keys()
+				keys[0] = "bogus"
+				Expect(cache.Keys()).To(ConsistOf("key-1", "key-2"))
+			})
 
-	// Add some files to the archive.
-	var files = []struct {
-		Name, Body string
-		Type       byte
-		Mode       int64
-	}{
-		{"bin/readme.txt", "This archive contains some text files.", tar.TypeReg, 0600},
-		{"diego.txt", "Diego names:\nVizzini\nGeoffrey\nPrincess Buttercup\n", tar.TypeReg, 0600},
-		{"testdir", "", tar.TypeDir, 0766},
-		{"testdir/file.txt", sampleData, tar.TypeReg, 0600},
-		{"testdir/fileLink.txt", "/diego.txt", tar.TypeSymlink, 0600},
-	}
-	for _, file := range files {
-		var hdr *tar.Header
-		if file.Type == tar.TypeSymlink {
-			hdr = &tar.Header{
-				Name:     file.Name,
-				Typeflag: file.Type,
-				Mode:     file.Mode,
-				Linkname: file.Body,
-			}
-			hdr.Mode &^= 040000 // c_ISDIR
-			hdr.Mode |= 0120000 // c_ISLNK
-		} else {
-			hdr = &tar.Header{
-				Name:     file.Name,
-				Typeflag: file.Type,
-				Mode:     file.Mode,
-				Size:     int64(len(file.Body)),
-			}
-		}
-		err := tw.WriteHeader(hdr)
-		Expect(err).NotTo(HaveOccurred())
-		if file.Type != tar.TypeSymlink {
-			_, err = tw.Write([]byte(file.Body))
+			It("does not report removed keys", func() {
+				cache.Remove(logger, "key-1")
+				Expect(cache.Keys()).To(ConsistOf("key-2"))
+				Expect(cache.Len()).To(Equal(1))
+			})
+		})
+	})
+
+	Describe("Stats", func() {
+		Context("when the cache is empty", func() {
+			It("reports no usage", func() {
+				stats := cache.Stats()
+				Expect(stats.UsedBytes).To(BeZero())
+				Expect(stats.MaxBytes).To(Equal(maxSizeInBytes))
+				Expect(stats.EntryCount).To(BeZero())
+				Expect(stats.OldestAccess).To(BeZero())
+			})
+		})
+
+		Context("when there are entries", func() {
+			var before time.Time
+
+			BeforeEach(func() {
+				before = time.Now()
+				reader, err := cache.Add(logger, "key-1", createSizedFile("cache-test-file", "content", 100).Name(), 100, cacheddownloader.CachingInfoType{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(reader.Close()).To(Succeed())
+
+				sourceFile2 := createSizedFile("cache-test-file", "more-content", 50)
+				reader, err = cache.Add(logger, "key-2", sourceFile2.Name(), 50, cacheddownloader.CachingInfoType{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(reader.Close()).To(Succeed())
+			})
+
+			It("reports the aggregate usage", func() {
+				stats := cache.Stats()
+				Expect(stats.UsedBytes).To(BeEquivalentTo(150))
+				Expect(stats.MaxBytes).To(Equal(maxSizeInBytes))
+				Expect(stats.EntryCount).To(Equal(2))
+				Expect(stats.OldestAccess).To(Equal(cache.Entries["key-1"].Access))
+				Expect(stats.OldestAccess).To(BeTemporally(">=", before))
+			})
+		})
+	})
+
+	Describe("HitMissCounts", func() {
+		It("starts at zero", func() {
+			hits, misses := cache.HitMissCounts()
+			Expect(hits).To(BeZero())
+			Expect(misses).To(BeZero())
+		})
+
+		Context("when entries are looked up", func() {
+			BeforeEach(func() {
+				dir, err := cache.AddDirectory(logger, "key", sourceArchive.Name(), 100, cacheddownloader.CachingInfoType{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(cache.CloseDirectory(logger, "key", dir)).To(Succeed())
+			})
+
+			It("counts hits and misses for Get and GetDirectory", func() {
+				reader, _, err := cache.Get(logger, "key")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(reader.Close()).To(Succeed())
+
+				dir, _, err := cache.GetDirectory(logger, "key")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(cache.CloseDirectory(logger, "key", dir)).To(Succeed())
+
+				_, _, err = cache.Get(logger, "bogus")
+				Expect(err).To(Equal(cacheddownloader.EntryNotFound))
+
+				hits, misses := cache.HitMissCounts()
+				Expect(hits).To(BeEquivalentTo(2))
+				Expect(misses).To(BeEquivalentTo(1))
+			})
+		})
+	})
+
+	Describe("NewCacheWithPolicy", func() {
+		var policy cacheddownloader.EvictionPolicy
+
+		get := func(cacheKey string) {
+			reader, _, err := cache.Get(logger, cacheKey)
 			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
 		}
-	}
-	// Make sure to check the error on Close.
-	err = tw.Close()
-	Expect(err).NotTo(HaveOccurred())
-	err = sourceFile.Close()
-	Expect(err).NotTo(HaveOccurred())
-	return sourceFile
-}
 
-func filenamesInDir(dir string) []string {
-	entries, err := os.ReadDir(dir)
-	Expect(err).NotTo(HaveOccurred())
+		JustBeforeEach(func() {
+			cache = cacheddownloader.NewCacheWithPolicy(cacheDir, 300, policy)
 
-	result := []string{}
-	for _, entry := range entries {
-		result = append(result, entry.Name())
-	}
+			add("frequent")
+			get("frequent")
+			get("frequent")
+			add("tie-old")
+			add("tie-new")
+			get("tie-new")
+		})
 
-	return result
-}
+		Context("with the LRU policy", func() {
+			BeforeEach(func() {
+				policy = cacheddownloader.LRU
+			})
 
-func recursiveList(dir string) []string {
-	paths := []string{}
-	filepath.Walk(dir, func(path string, _ os.FileInfo, _ error) error {
-		path = strings.TrimPrefix(path, dir)
-		if path != "" {
-			paths = append(paths, filepath.ToSlash(path))
-		}
-		return nil
+			It("evicts the least recently used entry", func() {
+				add("new-key")
+				Expect(cache.Keys()).To(ConsistOf("tie-old", "tie-new", "new-key"))
+			})
+		})
+
+		Context("with the LFU policy", func() {
+			BeforeEach(func() {
+				policy = cacheddownloader.LFU
+			})
+
+			It("evicts the least frequently used entry", func() {
+				add("new-key")
+				Expect(cache.Keys()).To(ConsistOf("frequent", "tie-new", "new-key"))
+			})
+
+			It("breaks ties by evicting the least recently used entry", func() {
+				get("tie-old")
+				add("new-key")
+				Expect(cache.Keys()).To(ConsistOf("frequent", "tie-old", "new-key"))
+			})
+		})
+
+		Context("with the SLRU policy", func() {
+			BeforeEach(func() {
+				policy = cacheddownloader.SLRU
+			})
+
+			It("evicts entries on probation before protected entries", func() {
+				add("new-key")
+				Expect(cache.Keys()).To(ConsistOf("frequent", "tie-new", "new-key"))
+			})
+
+			It("evicts protected entries once nothing is on probation", func() {
+				add("new-key")
+				get("new-key")
+				add("newer-key")
+				Expect(cache.Keys()).To(ConsistOf("tie-new", "new-key", "newer-key"))
+			})
+		})
 	})
-	return paths
+
+	Describe("AddWithOptions", func() {
+		It("combines the options", func() {
+			value, err := cacheddownloader.HexValue("sha256", "the-file-content")
+			Expect(err).NotTo(HaveOccurred())
+			checksum := cacheddownloader.ChecksumInfoType{Algorithm: "sha256", Value: value}
+			tags := map[string]string{"content-type": "application/x-tar"}
+
+			reader, err := cache.AddWithOptions(context.Background(), logger, "key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{}, cacheddownloader.AddOptions{
+				TTL:      time.Hour,
+				Cost:     10,
+				Tags:     tags,
+				Checksum: checksum,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+
+			entry := cache.Entries["key"]
+			Expect(entry.Expiry).To(BeTemporally("~", entry.Access.Add(time.Hour)))
+			Expect(entry.Cost).To(BeEquivalentTo(10))
+			Expect(entry.Tags).To(Equal(tags))
+			Expect(cache.Verify(logger, "key")).To(BeTrue())
+		})
+
+		It("adds like Add without options", func() {
+			reader, err := cache.AddWithOptions(context.Background(), logger, "key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{}, cacheddownloader.AddOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			defer reader.Close()
+			Expect(io.ReadAll(reader)).To(Equal([]byte("the-file-content")))
+
+			entry := cache.Entries["key"]
+			Expect(entry.Expiry).To(BeZero())
+			Expect(entry.Tags).To(BeNil())
+		})
+	})
+
+	Describe("AddWithTTL", func() {
+		var ttl time.Duration
+
+		JustBeforeEach(func() {
+			reader, err := cache.AddWithTTL(logger, "key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{}, ttl)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+		})
+
+		Context("when the ttl is zero", func() {
+			BeforeEach(func() {
+				ttl = 0
+			})
+
+			It("never expires the entry", func() {
+				Expect(cache.Entries["key"].Expiry).To(BeZero())
+
+				reader, _, err := cache.Get(logger, "key")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(reader.Close()).To(Succeed())
+			})
+		})
+
+		Context("when the ttl elapses", func() {
+			BeforeEach(func() {
+				ttl = 10 * time.Millisecond
+			})
+
+			It("treats the entry as absent and removes it", func() {
+				Eventually(func() error {
+					reader, _, err := cache.Get(logger, "key")
+					if reader != nil {
+						reader.Close()
+					}
+					return err
+				}).Should(Equal(cacheddownloader.EntryNotFound))
+
+				Expect(cache.Keys()).To(BeEmpty())
+				Expect(filenamesInDir(cacheDir)).To(BeEmpty())
+			})
+
+			It("evicts the expired entry before older entries", func() {
+				cache = cacheddownloader.NewCache(cacheDir, 200)
+				source := createSizedFile("cache-test-file", "old-content", 100)
+				reader, err := cache.Add(logger, "old-key", source.Name(), 100, cacheddownloader.CachingInfoType{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(reader.Close()).To(Succeed())
+
+				source = createSizedFile("cache-test-file", "expiring-content", 100)
+				reader, err = cache.AddWithTTL(logger, "expiring-key", source.Name(), 100, cacheddownloader.CachingInfoType{}, time.Nanosecond)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(reader.Close()).To(Succeed())
+
+				source = createSizedFile("cache-test-file", "new-content", 100)
+				reader, err = cache.Add(logger, "new-key", source.Name(), 100, cacheddownloader.CachingInfoType{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(reader.Close()).To(Succeed())
+
+				Expect(cache.Keys()).To(ConsistOf("old-key", "new-key"))
+			})
+		})
+	})
+
+	Describe("Acquire", func() {
+		Context("when there is nothing", func() {
+			It("returns EntryNotFound", func() {
+				path, err := cache.Acquire(logger, "key")
+				Expect(err).To(Equal(cacheddownloader.EntryNotFound))
+				Expect(path).To(BeEmpty())
+			})
+		})
+
+		Context("when there is an item", func() {
+			var path string
+
+			BeforeEach(func() {
+				reader, err := cache.Add(logger, "key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(reader.Close()).To(Succeed())
+
+				path, err = cache.Acquire(logger, "key")
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("returns the path of the cached file", func() {
+				content, err := os.ReadFile(path)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(content)).To(Equal("the-file-content"))
+			})
+
+			It("keeps the file until it is released when the entry is removed", func() {
+				cache.Remove(logger, "key")
+				Expect(path).To(BeAnExistingFile())
+
+				Expect(cache.Release(logger, "key", path)).To(Succeed())
+				Expect(path).NotTo(BeAnExistingFile())
+			})
+
+			It("keeps the file until it is released when the entry is replaced", func() {
+				newSource := createSizedFile("cache-test-file", "new-file-content", 100)
+				reader, err := cache.Add(logger, "key", newSource.Name(), 100, cacheddownloader.CachingInfoType{LastModified: "123"})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(reader.Close()).To(Succeed())
+				Expect(path).To(BeAnExistingFile())
+
+				Expect(cache.Release(logger, "key", path)).To(Succeed())
+				Expect(path).NotTo(BeAnExistingFile())
+				Expect(filenamesInDir(cacheDir)).To(HaveLen(1))
+			})
+
+			It("is not evicted while acquired", func() {
+				cache = cacheddownloader.NewCache(cacheDir, 150)
+				reader, err := cache.Add(logger, "key", createSizedFile("cache-test-file", "content", 100).Name(), 100, cacheddownloader.CachingInfoType{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(reader.Close()).To(Succeed())
+				path, err := cache.Acquire(logger, "key")
+				Expect(err).NotTo(HaveOccurred())
+
+				_, err = cache.Add(logger, "other-key", createSizedFile("cache-test-file", "other", 100).Name(), 100, cacheddownloader.CachingInfoType{})
+				Expect(err).To(Equal(cacheddownloader.CacheBusyErr))
+
+				Expect(cache.Keys()).To(ContainElement("key"))
+				Expect(path).To(BeAnExistingFile())
+			})
+
+			Context("when released more than once", func() {
+				It("fails", func() {
+					Expect(cache.Release(logger, "key", path)).To(Succeed())
+					Expect(cache.Release(logger, "key", path)).To(Equal(cacheddownloader.AlreadyReleased))
+				})
+			})
+
+			Context("when releasing an unknown path", func() {
+				It("returns EntryNotFound", func() {
+					Expect(cache.Release(logger, "key", "bogus")).To(Equal(cacheddownloader.EntryNotFound))
+				})
+			})
+		})
+	})
+
+	Describe("Save and Load", func() {
+		var statePath string
+
+		BeforeEach(func() {
+			statePath = filepath.Join(cacheDir, "saved_cache.json")
+
+			reader, err := cache.Add(logger, "key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{ETag: "etag"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+
+			Expect(cache.Save(logger, statePath)).To(Succeed())
+		})
+
+		It("writes the metadata without leaving temporary files behind", func() {
+			Expect(statePath).To(BeARegularFile())
+			Expect(filenamesInDir(cacheDir)).To(HaveLen(2))
+		})
+
+		It("restores the entries into a new cache", func() {
+			untrackedFile := filepath.Join(cacheDir, "untracked")
+			Expect(os.WriteFile(untrackedFile, []byte("foo"), 0600)).To(Succeed())
+
+			cache = cacheddownloader.NewCache(cacheDir, maxSizeInBytes)
+			Expect(cache.Load(logger, statePath)).To(Succeed())
+			Expect(cache.Keys()).To(ConsistOf("key"))
+			Expect(untrackedFile).NotTo(BeAnExistingFile())
+
+			reader, ci, err := cache.Get(logger, "key")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ci.ETag).To(Equal("etag"))
+			content, err := io.ReadAll(reader)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(content)).To(Equal("the-file-content"))
+			Expect(reader.Close()).To(Succeed())
+		})
+
+		It("restores access times so that eviction keeps the saved recency order", func() {
+			for _, cacheKey := range []string{"key-2", "key-3"} {
+				source := createSizedFile("cache-test-file", "content-"+cacheKey, 100)
+				reader, err := cache.Add(logger, cacheKey, source.Name(), 100, cacheddownloader.CachingInfoType{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(reader.Close()).To(Succeed())
+			}
+			lastAccess := time.Now().Add(-time.Hour)
+			cache.Entries["key"].Access = lastAccess
+			cache.Entries["key-2"].Access = lastAccess.Add(-2 * time.Hour)
+			cache.Entries["key-3"].Access = lastAccess.Add(-time.Hour)
+			Expect(cache.Save(logger, statePath)).To(Succeed())
+
+			cache = cacheddownloader.NewCache(cacheDir, maxSizeInBytes)
+			Expect(cache.Load(logger, statePath)).To(Succeed())
+			Expect(cache.Entries["key"].Access).To(BeTemporally("==", lastAccess))
+
+			// just too large to fit without evicting the oldest entry
+			size := maxSizeInBytes - cache.UsedBytes() + 50
+			reader, err := cache.Add(logger, "large", createSizedFile("cache-test-file", "large", size).Name(), size, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+			Expect(cache.Keys()).To(ConsistOf("key", "key-3", "large"))
+		})
+
+		Context("when the state file does not exist", func() {
+			It("removes every file in the cache directory", func() {
+				Expect(os.Remove(statePath)).To(Succeed())
+
+				cache = cacheddownloader.NewCache(cacheDir, maxSizeInBytes)
+				Expect(cache.Load(logger, statePath)).To(Succeed())
+				Expect(cache.Keys()).To(BeEmpty())
+				Expect(filenamesInDir(cacheDir)).To(BeEmpty())
+			})
+		})
+	})
+
+	Describe("OnEvict", func() {
+		type evictionEvent struct {
+			cacheKey string
+			size     int64
+			reason   cacheddownloader.EvictReason
+		}
+
+		var events []evictionEvent
+
+		BeforeEach(func() {
+			events = nil
+			cache = cacheddownloader.NewCache(cacheDir, 200)
+			cache.OnEvict = func(cacheKey string, size int64, reason cacheddownloader.EvictReason) {
+				// calling back into the cache must not deadlock
+				cache.Keys()
+				events = append(events, evictionEvent{cacheKey, size, reason})
+			}
+		})
+
+		It("reports entries evicted to make room", func() {
+			add("key-1")
+			add("key-2")
+			add("key-3")
+			Expect(events).To(Equal([]evictionEvent{{"key-1", 100, cacheddownloader.EvictReasonCapacity}}))
+		})
+
+		It("reports removed entries", func() {
+			add("key-1")
+			cache.Remove(logger, "key-1")
+			Expect(events).To(Equal([]evictionEvent{{"key-1", 100, cacheddownloader.EvictReasonRemoved}}))
+		})
+
+		It("reports replaced entries", func() {
+			add("key-1")
+			add("key-1", withCachingInfo(cacheddownloader.CachingInfoType{ETag: "new"}))
+			Expect(events).To(Equal([]evictionEvent{{"key-1", 100, cacheddownloader.EvictReasonReplaced}}))
+		})
+
+		It("does nothing when unset", func() {
+			cache.OnEvict = nil
+			add("key-1")
+			Expect(func() { cache.Remove(logger, "key-1") }).NotTo(Panic())
+		})
+
+		It("may add the key being added again", func() {
+			readded := false
+			cache.OnEvict = func(cacheKey string, size int64, reason cacheddownloader.EvictReason) {
+				if !readded {
+					readded = true
+					add(cacheKey, withCachingInfo(cacheddownloader.CachingInfoType{ETag: "again"}))
+				}
+			}
+			add("key-1")
+
+			done := make(chan struct{})
+			go func() {
+				defer GinkgoRecover()
+				defer close(done)
+				add("key-1", withCachingInfo(cacheddownloader.CachingInfoType{ETag: "new"}))
+			}()
+			Eventually(done).Should(BeClosed())
+			Expect(readded).To(BeTrue())
+			Expect(cache.Entries["key-1"].CachingInfo.ETag).To(Equal("again"))
+		})
+
+		It("does not hold up adds of the same key to another cache", func() {
+			otherDir, err := os.MkdirTemp("", "cache-test-other")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(otherDir)
+			other := cacheddownloader.NewCache(otherDir, 200)
+
+			// hold the first add in staging, where it has the key's stripe
+			// but not the cache lock
+			var staging atomic.Bool
+			renaming := make(chan struct{})
+			release := make(chan struct{})
+			defer cacheddownloader.SetRename(func(oldpath, newpath string) error {
+				if strings.HasPrefix(newpath, cacheDir) && staging.CompareAndSwap(false, true) {
+					close(renaming)
+					<-release
+				}
+				return os.Rename(oldpath, newpath)
+			})()
+
+			done := make(chan struct{})
+			go func() {
+				defer GinkgoRecover()
+				defer close(done)
+				add("key-1")
+			}()
+			Eventually(renaming).Should(BeClosed())
+
+			source := createSizedFile("cache-test-file", "content-key-1", 100)
+			reader, err := other.Add(logger, "key-1", source.Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+
+			close(release)
+			Eventually(done).Should(BeClosed())
+		})
+	})
+
+	Describe("AddWithChecksum", func() {
+		var checksum cacheddownloader.ChecksumInfoType
+
+		BeforeEach(func() {
+			value, err := cacheddownloader.HexValue("sha256", "the-file-content")
+			Expect(err).NotTo(HaveOccurred())
+			checksum = cacheddownloader.ChecksumInfoType{Algorithm: "sha256", Value: value}
+		})
+
+		JustBeforeEach(func() {
+			reader, err := cache.AddWithChecksum(logger, "key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{}, checksum)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+		})
+
+		It("records the checksum", func() {
+			Expect(cache.Entries["key"].Checksum).To(Equal(checksum))
+		})
+
+		Describe("Verify", func() {
+			It("reports an intact file as valid", func() {
+				ok, err := cache.Verify(logger, "key")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ok).To(BeTrue())
+			})
+
+			It("reports a corrupted file as invalid", func() {
+				Expect(os.WriteFile(cache.Entries["key"].FilePath, []byte("corrupted"), 0600)).To(Succeed())
+
+				ok, err := cache.Verify(logger, "key")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ok).To(BeFalse())
+			})
+
+			It("returns EntryNotFound for unknown keys", func() {
+				_, err := cache.Verify(logger, "bogus")
+				Expect(err).To(Equal(cacheddownloader.EntryNotFound))
+			})
+		})
+
+		Context("when VerifyOnRead is set", func() {
+			BeforeEach(func() {
+				cache.VerifyOnRead = true
+			})
+
+			It("returns intact files", func() {
+				reader, _, err := cache.Get(logger, "key")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(reader.Close()).To(Succeed())
+			})
+
+			It("removes corrupted files and reports a miss", func() {
+				Expect(os.WriteFile(cache.Entries["key"].FilePath, []byte("corrupted"), 0600)).To(Succeed())
+
+				_, _, err := cache.Get(logger, "key")
+				Expect(err).To(Equal(cacheddownloader.EntryNotFound))
+				Expect(cache.Keys()).To(BeEmpty())
+				Expect(filenamesInDir(cacheDir)).To(BeEmpty())
+			})
+		})
+	})
+
+	Describe("Prune", func() {
+		BeforeEach(func() {
+			add("key-1")
+			add("key-2")
+			add("key-3")
+		})
+
+		It("evicts the least recently used entries down to the target", func() {
+			reclaimed, err := cache.Prune(logger, 150)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reclaimed).To(BeEquivalentTo(200))
+			Expect(cache.Keys()).To(ConsistOf("key-3"))
+			Expect(filenamesInDir(cacheDir)).To(HaveLen(1))
+		})
+
+		It("does nothing when already below the target", func() {
+			reclaimed, err := cache.Prune(logger, 300)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reclaimed).To(BeZero())
+			Expect(cache.Len()).To(Equal(3))
+		})
+
+		It("does not evict entries that are in use", func() {
+			reader, _, err := cache.Get(logger, "key-1")
+			Expect(err).NotTo(HaveOccurred())
+			defer reader.Close()
+
+			reclaimed, err := cache.Prune(logger, 0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reclaimed).To(BeEquivalentTo(200))
+			Expect(cache.Keys()).To(ConsistOf("key-1"))
+		})
+	})
+
+	Describe("WouldEvict", func() {
+		BeforeEach(func() {
+			cache = cacheddownloader.NewCache(cacheDir, 300)
+			for _, cacheKey := range []string{"key-1", "key-2", "key-3"} {
+				source := createSizedFile("cache-test-file", "content-"+cacheKey, 100)
+				reader, err := cache.Add(logger, cacheKey, source.Name(), 100, cacheddownloader.CachingInfoType{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(reader.Close()).To(Succeed())
+			}
+		})
+
+		It("returns the keys that would be evicted without evicting them", func() {
+			victims, fits := cache.WouldEvict(150)
+			Expect(fits).To(BeTrue())
+			Expect(victims).To(Equal([]string{"key-1", "key-2"}))
+			Expect(cache.Len()).To(Equal(3))
+			Expect(filenamesInDir(cacheDir)).To(HaveLen(3))
+		})
+
+		It("returns nothing when the size already fits", func() {
+			Expect(cache.Remove(logger, "key-3")).To(Succeed())
+
+			victims, fits := cache.WouldEvict(100)
+			Expect(fits).To(BeTrue())
+			Expect(victims).To(BeEmpty())
+		})
+
+		It("skips entries that are in use", func() {
+			reader, _, err := cache.Get(logger, "key-1")
+			Expect(err).NotTo(HaveOccurred())
+			defer reader.Close()
+
+			victims, fits := cache.WouldEvict(150)
+			Expect(fits).To(BeTrue())
+			Expect(victims).To(Equal([]string{"key-2", "key-3"}))
+		})
+
+		It("reports when the size would not fit", func() {
+			victims, fits := cache.WouldEvict(400)
+			Expect(fits).To(BeFalse())
+			Expect(victims).To(ConsistOf("key-1", "key-2", "key-3"))
+			Expect(cache.Len()).To(Equal(3))
+		})
+
+		It("rounds the size up to BlockSize like Add", func() {
+			cache.BlockSize = 64
+			Expect(cache.Remove(logger, "key-3")).To(Succeed())
+
+			victims, fits := cache.WouldEvict(90)
+			Expect(fits).To(BeTrue())
+			Expect(victims).To(Equal([]string{"key-1"}))
+		})
+	})
+
+	Describe("SetMaxSize", func() {
+		BeforeEach(func() {
+			for _, cacheKey := range []string{"key-1", "key-2"} {
+				source := createSizedFile("cache-test-file", "content-"+cacheKey, 100)
+				reader, err := cache.Add(logger, cacheKey, source.Name(), 100, cacheddownloader.CachingInfoType{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(reader.Close()).To(Succeed())
+			}
+		})
+
+		It("updates the limit", func() {
+			Expect(cache.SetMaxSize(logger, 1000)).To(BeZero())
+			Expect(cache.Stats().MaxBytes).To(BeEquivalentTo(1000))
+			Expect(cache.Len()).To(Equal(2))
+		})
+
+		Context("when the limit is lowered below the used space", func() {
+			It("evicts entries down to the new limit", func() {
+				Expect(cache.SetMaxSize(logger, 150)).To(BeEquivalentTo(100))
+				Expect(cache.Keys()).To(ConsistOf("key-2"))
+			})
+
+			It("does not hang when the remaining entries are in use", func() {
+				reader, _, err := cache.Get(logger, "key-1")
+				Expect(err).NotTo(HaveOccurred())
+				defer reader.Close()
+
+				Expect(cache.SetMaxSize(logger, 10)).To(BeEquivalentTo(100))
+				Expect(cache.Keys()).To(ConsistOf("key-1"))
+
+				source := createSizedFile("cache-test-file", "new-content", 100)
+				newReader, err := cache.Add(logger, "key-3", source.Name(), 100, cacheddownloader.CachingInfoType{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(newReader.Close()).To(Succeed())
+			})
+		})
+	})
+
+	Describe("Clear", func() {
+		BeforeEach(func() {
+			reader, err := cache.Add(logger, "file-key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+
+			dir, err := cache.AddDirectory(logger, "dir-key", sourceArchive.Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cache.CloseDirectory(logger, "dir-key", dir)).To(Succeed())
+		})
+
+		It("removes every entry and file", func() {
+			Expect(cache.Clear(logger)).To(Succeed())
+			Expect(cache.Keys()).To(BeEmpty())
+			Expect(filenamesInDir(cacheDir)).To(BeEmpty())
+		})
+
+		It("keeps files that are in use until they are closed", func() {
+			reader, _, err := cache.Get(logger, "file-key")
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(cache.Clear(logger)).To(Succeed())
+			Expect(cache.Keys()).To(BeEmpty())
+			Expect(filenamesInDir(cacheDir)).To(HaveLen(1))
+
+			Expect(reader.Close()).To(Succeed())
+			Expect(filenamesInDir(cacheDir)).To(BeEmpty())
+		})
+	})
+
+	Describe("moving files into the cache", func() {
+		var restore func()
+
+		AfterEach(func() {
+			restore()
+		})
+
+		Context("when the source is on a different device", func() {
+			BeforeEach(func() {
+				Expect(os.Chmod(sourceFile.Name(), 0640)).To(Succeed())
+				restore = cacheddownloader.SetRename(func(oldpath, newpath string) error {
+					return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+				})
+			})
+
+			It("copies the file into the cache and removes the source", func() {
+				reader, err := cache.Add(logger, "key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{})
+				Expect(err).NotTo(HaveOccurred())
+				defer reader.Close()
+
+				content, err := io.ReadAll(reader)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(content)).To(Equal("the-file-content"))
+				Expect(sourceFile.Name()).NotTo(BeAnExistingFile())
+				Expect(filenamesInDir(cacheDir)).To(HaveLen(1))
+
+				info, err := os.Stat(reader.Name())
+				Expect(err).NotTo(HaveOccurred())
+				Expect(info.Mode().Perm()).To(Equal(os.FileMode(0640)))
+			})
+		})
+
+		Context("when the rename fails for another reason", func() {
+			BeforeEach(func() {
+				restore = cacheddownloader.SetRename(func(oldpath, newpath string) error {
+					return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EACCES}
+				})
+			})
+
+			It("returns the error without tracking the entry", func() {
+				_, err := cache.Add(logger, "key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{})
+				Expect(err).To(MatchError(syscall.EACCES))
+				Expect(cache.Keys()).To(BeEmpty())
+				Expect(sourceFile.Name()).To(BeAnExistingFile())
+				Expect(filenamesInDir(cacheDir)).To(BeEmpty())
+			})
+		})
+
+		Context("when the rename fails transiently", func() {
+			var failures, attempts int
+
+			BeforeEach(func() {
+				failures = 2
+				attempts = 0
+				restore = cacheddownloader.SetRename(func(oldpath, newpath string) error {
+					attempts++
+					if attempts <= failures {
+						return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EBUSY}
+					}
+					return os.Rename(oldpath, newpath)
+				})
+			})
+
+			It("does not retry by default", func() {
+				_, err := cache.Add(logger, "key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{})
+				Expect(err).To(MatchError(syscall.EBUSY))
+				Expect(attempts).To(Equal(1))
+				Expect(sourceFile.Name()).To(BeAnExistingFile())
+			})
+
+			Context("when retries are configured", func() {
+				BeforeEach(func() {
+					cache.MoveAttempts = 3
+					cache.MoveBackoff = time.Millisecond
+				})
+
+				It("retries until the rename succeeds", func() {
+					reader, err := cache.Add(logger, "key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{})
+					Expect(err).NotTo(HaveOccurred())
+					defer reader.Close()
+
+					content, err := io.ReadAll(reader)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(string(content)).To(Equal("the-file-content"))
+					Expect(cache.Keys()).To(ConsistOf("key"))
+					Expect(filenamesInDir(cacheDir)).To(HaveLen(1))
+				})
+
+				It("returns the last error once the attempts are exhausted", func() {
+					failures = 3
+
+					_, err := cache.Add(logger, "key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{})
+					Expect(err).To(MatchError(syscall.EBUSY))
+					Expect(attempts).To(Equal(3))
+					Expect(cache.Keys()).To(BeEmpty())
+					Expect(sourceFile.Name()).To(BeAnExistingFile())
+					Expect(filenamesInDir(cacheDir)).To(BeEmpty())
+				})
+			})
+		})
+
+		Context("when the rename fails permanently and retries are configured", func() {
+			var attempts int
+
+			BeforeEach(func() {
+				attempts = 0
+				cache.MoveAttempts = 3
+				restore = cacheddownloader.SetRename(func(oldpath, newpath string) error {
+					attempts++
+					return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EACCES}
+				})
+			})
+
+			It("does not retry", func() {
+				_, err := cache.Add(logger, "key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{})
+				Expect(err).To(MatchError(syscall.EACCES))
+				Expect(attempts).To(Equal(1))
+			})
+		})
+	})
+
+	Describe("cached file names", func() {
+		It("does not collide for different keys whose sources share a name", func() {
+			var paths []string
+			for _, cacheKey := range []string{"key-1", "key-2"} {
+				sourceDir, err := os.MkdirTemp("", "cache-test-source")
+				Expect(err).NotTo(HaveOccurred())
+				defer os.RemoveAll(sourceDir)
+
+				sourcePath := filepath.Join(sourceDir, "artifact.tgz")
+				Expect(os.WriteFile(sourcePath, []byte("content-"+cacheKey), 0600)).To(Succeed())
+
+				reader, err := cache.Add(logger, cacheKey, sourcePath, 100, cacheddownloader.CachingInfoType{})
+				Expect(err).NotTo(HaveOccurred())
+				paths = append(paths, reader.Name())
+				Expect(reader.Close()).To(Succeed())
+			}
+
+			Expect(paths[0]).NotTo(Equal(paths[1]))
+			Expect(filepath.Ext(paths[0])).To(Equal(".tgz"))
+			Expect(filenamesInDir(cacheDir)).To(HaveLen(2))
+
+			for i, cacheKey := range []string{"key-1", "key-2"} {
+				content, err := os.ReadFile(paths[i])
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(content)).To(Equal("content-" + cacheKey))
+			}
+		})
+	})
+
+	Describe("AddWithContext", func() {
+		var (
+			ctx    context.Context
+			cancel context.CancelFunc
+		)
+
+		BeforeEach(func() {
+			ctx, cancel = context.WithCancel(context.Background())
+		})
+
+		AfterEach(func() {
+			cancel()
+		})
+
+		It("adds the file when the context is not done", func() {
+			reader, err := cache.AddWithContext(ctx, logger, "key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+			Expect(cache.Keys()).To(ConsistOf("key"))
+		})
+
+		It("does not add the file when the context is already cancelled", func() {
+			cancel()
+			_, err := cache.AddWithContext(ctx, logger, "key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).To(Equal(context.Canceled))
+			Expect(cache.Keys()).To(BeEmpty())
+			Expect(sourceFile.Name()).To(BeAnExistingFile())
+		})
+
+		Context("when the context is cancelled while copying across devices", func() {
+			var restore func()
+
+			BeforeEach(func() {
+				restore = cacheddownloader.SetRename(func(oldpath, newpath string) error {
+					cancel()
+					return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+				})
+			})
+
+			AfterEach(func() {
+				restore()
+			})
+
+			It("aborts the copy and removes the partial file", func() {
+				_, err := cache.AddWithContext(ctx, logger, "key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{})
+				Expect(err).To(Equal(context.Canceled))
+				Expect(cache.Keys()).To(BeEmpty())
+				Expect(filenamesInDir(cacheDir)).To(BeEmpty())
+				Expect(sourceFile.Name()).To(BeAnExistingFile())
+			})
+		})
+
+		Describe("AddDirectoryWithContext", func() {
+			It("does not add the directory when the context is already cancelled", func() {
+				cancel()
+				_, err := cache.AddDirectoryWithContext(ctx, logger, "key", sourceArchive.Name(), 100, cacheddownloader.CachingInfoType{})
+				Expect(err).To(Equal(context.Canceled))
+				Expect(cache.Keys()).To(BeEmpty())
+			})
+		})
+	})
+
+	Describe("AddExpandedDirectory", func() {
+		var sourceDir string
+
+		BeforeEach(func() {
+			var err error
+			sourceDir, err = os.MkdirTemp("", "expanded-dir")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(os.WriteFile(filepath.Join(sourceDir, "a"), []byte("12345"), 0644)).To(Succeed())
+			Expect(os.Mkdir(filepath.Join(sourceDir, "sub"), 0755)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(sourceDir, "sub", "b"), []byte("123"), 0644)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(sourceDir)
+		})
+
+		It("moves the directory into the cache", func() {
+			dir, err := cache.AddExpandedDirectory(logger, "key", sourceDir, cacheddownloader.CachingInfoType{ETag: "e"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filepath.Dir(dir)).To(Equal(cacheDir))
+			Expect(sourceDir).NotTo(BeADirectory())
+			Expect(os.ReadFile(filepath.Join(dir, "sub", "b"))).To(Equal([]byte("123")))
+			Expect(cache.CloseDirectory(logger, "key", dir)).To(Succeed())
+		})
+
+		It("records the entry as a directory sized by its files", func() {
+			dir, err := cache.AddExpandedDirectory(logger, "key", sourceDir, cacheddownloader.CachingInfoType{ETag: "e"})
+			Expect(err).NotTo(HaveOccurred())
+
+			info, err := cache.Info("key")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.IsDirectory()).To(BeTrue())
+			Expect(info.DirectoryPath).To(Equal(dir))
+			Expect(info.Size).To(BeEquivalentTo(8))
+			Expect(info.CachingInfo.ETag).To(Equal("e"))
+		})
+
+		It("can be read back as a tarball", func() {
+			dir, err := cache.AddExpandedDirectory(logger, "key", sourceDir, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cache.CloseDirectory(logger, "key", dir)).To(Succeed())
+
+			reader, _, err := cache.Get(logger, "key")
+			Expect(err).NotTo(HaveOccurred())
+			defer reader.Close()
+
+			tarReader := tar.NewReader(reader)
+			names := []string{}
+			for {
+				header, err := tarReader.Next()
+				if err == io.EOF {
+					break
+				}
+				Expect(err).NotTo(HaveOccurred())
+				names = append(names, filepath.Base(header.Name))
+			}
+			Expect(names).To(ContainElements("a", "b"))
+		})
+
+		It("returns CacheBusyErr and leaves the directory alone if the entries to evict are in use", func() {
+			cache = cacheddownloader.NewCache(cacheDir, 10)
+			reader, err := cache.Add(logger, "in-use", createSizedFile("cache-test-file", "12345", 5).Name(), 5, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			defer reader.Close()
+
+			_, err = cache.AddExpandedDirectory(logger, "key", sourceDir, cacheddownloader.CachingInfoType{})
+			Expect(err).To(Equal(cacheddownloader.CacheBusyErr))
+			Expect(cache.Entries).NotTo(HaveKey("key"))
+			Expect(os.ReadFile(filepath.Join(sourceDir, "sub", "b"))).To(Equal([]byte("123")))
+		})
+
+		It("refuses directories larger than MaxEntryBytes", func() {
+			cache.MaxEntryBytes = 4
+			_, err := cache.AddExpandedDirectory(logger, "key", sourceDir, cacheddownloader.CachingInfoType{})
+			Expect(err).To(Equal(cacheddownloader.EntryTooLargeErr))
+			Expect(os.ReadFile(filepath.Join(sourceDir, "a"))).To(Equal([]byte("12345")))
+		})
+
+		It("gives the directory DirMode and its files FileMode", func() {
+			cache.DirMode = 0700
+			cache.FileMode = 0600
+			dir, err := cache.AddExpandedDirectory(logger, "key", sourceDir, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+
+			info, err := os.Stat(filepath.Join(dir, "sub"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0700)))
+			info, err = os.Stat(filepath.Join(dir, "sub", "b"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+		})
+
+		It("refuses the directory of a cached entry", func() {
+			dir, err := cache.AddExpandedDirectory(logger, "key", sourceDir, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = cache.AddExpandedDirectory(logger, "other-key", dir, cacheddownloader.CachingInfoType{})
+			Expect(err).To(MatchError(cacheddownloader.InvalidSourceErr))
+			Expect(dir).To(BeADirectory())
+		})
+	})
+
+	Describe("Info", func() {
+		It("returns EntryNotFound for an unknown key", func() {
+			_, err := cache.Info("unknown")
+			Expect(err).To(Equal(cacheddownloader.EntryNotFound))
+		})
+
+		It("describes file entries", func() {
+			reader, err := cache.Add(logger, "key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{ETag: "e"})
+			Expect(err).NotTo(HaveOccurred())
+			reader.Close()
+
+			info, err := cache.Info("key")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.IsDirectory()).To(BeFalse())
+			Expect(info.Size).To(BeEquivalentTo(len("the-file-content")))
+			Expect(info.FilePath).To(BeAnExistingFile())
+			Expect(info.CachingInfo.ETag).To(Equal("e"))
+		})
+	})
+
+	Describe("InfoOK", func() {
+		It("reports whether there is an entry, even without caching info", func() {
+			_, ok := cache.InfoOK("key")
+			Expect(ok).To(BeFalse())
+
+			reader, err := cache.Add(logger, "key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+
+			info, ok := cache.InfoOK("key")
+			Expect(ok).To(BeTrue())
+			Expect(info).To(Equal(cacheddownloader.CachingInfoType{}))
+		})
+	})
+
+	Describe("OpenForKey", func() {
+		It("returns EntryNotFound for an unknown key", func() {
+			_, err := cache.OpenForKey(logger, "unknown")
+			Expect(err).To(Equal(cacheddownloader.EntryNotFound))
+		})
+
+		It("keeps the file readable after the entry is evicted", func() {
+			reader, err := cache.Add(logger, "key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			reader.Close()
+
+			file, err := cache.OpenForKey(logger, "key")
+			Expect(err).NotTo(HaveOccurred())
+			defer file.Close()
+
+			path := cache.Entries["key"].FilePath
+			cache.Remove(logger, "key")
+			Expect(path).NotTo(BeAnExistingFile())
+
+			Expect(io.ReadAll(file)).To(Equal([]byte("the-file-content")))
+		})
+	})
+
+	Describe("TempFile", func() {
+		It("creates the file in the cache directory", func() {
+			Expect(cache.Dir()).To(Equal(cacheDir))
+
+			file, err := cache.TempFile("key")
+			Expect(err).NotTo(HaveOccurred())
+			_, err = file.WriteString("staged")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(file.Close()).To(Succeed())
+			Expect(filepath.Dir(file.Name())).To(Equal(cacheDir))
+		})
+
+		It("can be added to the cache with a rename", func() {
+			file, err := cache.TempFile("key")
+			Expect(err).NotTo(HaveOccurred())
+			_, err = file.WriteString("staged")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(file.Close()).To(Succeed())
+
+			restore := cacheddownloader.SetRename(func(oldpath, newpath string) error {
+				Expect(filepath.Dir(oldpath)).To(Equal(filepath.Dir(newpath)))
+				return os.Rename(oldpath, newpath)
+			})
+			defer restore()
+
+			reader, err := cache.Add(logger, "key", file.Name(), 6, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			defer reader.Close()
+			Expect(file.Name()).NotTo(BeAnExistingFile())
+			Expect(io.ReadAll(reader)).To(Equal([]byte("staged")))
+		})
+
+		It("refuses the file of a cached entry", func() {
+			reader, err := cache.Add(logger, "key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+			info, err := cache.Info("key")
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = cache.Add(logger, "other", info.FilePath, 100, cacheddownloader.CachingInfoType{})
+			Expect(err).To(MatchError(cacheddownloader.InvalidSourceErr))
+			Expect(cache.Keys()).To(ConsistOf("key"))
+
+			reader, _, err = cache.Get(logger, "key")
+			Expect(err).NotTo(HaveOccurred())
+			defer reader.Close()
+			Expect(info.FilePath).To(BeARegularFile())
+		})
+	})
+
+	Describe("adding with the wrong size", func() {
+		It("accounts for the size of the file on disk and logs the mismatch", func() {
+			reader, err := cache.Add(logger, "key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			reader.Close()
+
+			Expect(logger).To(gbytes.Say("size-mismatch"))
+
+			Expect(cache.Stats().UsedBytes).To(BeEquivalentTo(len("the-file-content")))
+			info, err := cache.Info("key")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Size).To(BeEquivalentTo(len("the-file-content")))
+		})
+	})
+
+	Describe("AddWithCost", func() {
+		BeforeEach(func() {
+			cache = cacheddownloader.NewCache(cacheDir, 300)
+		})
+
+		It("evicts the entry with the lowest cost per byte first", func() {
+			add("expensive", withCost(500))
+			add("cheap-per-byte", withSize(200), withCost(100))
+			add("new-key", withCost(500))
+			Expect(cache.Keys()).To(ConsistOf("expensive", "new-key"))
+		})
+
+		It("evicts the least recently used entry when costs are equal", func() {
+			add("old-key", withCost(10))
+			add("newer-key", withCost(10))
+			add("newest-key", withCost(10))
+			add("new-key", withCost(10))
+			Expect(cache.Keys()).To(ConsistOf("newer-key", "newest-key", "new-key"))
+		})
+
+		It("orders entries with the same cost per byte by access, whatever their costs", func() {
+			cache = cacheddownloader.NewCache(cacheDir, 1000)
+			add("key-0", withSize(200), withCost(2))
+			add("key-1", withCost(1))
+			add("key-2", withSize(300), withCost(3))
+			add("key-3", withCost(1))
+			add("key-4", withSize(200), withCost(2))
+			add("key-5", withCost(1))
+			Expect(cache.EvictionOrder()).To(Equal([]string{"key-0", "key-1", "key-2", "key-3", "key-4", "key-5"}))
+		})
+	})
+
+	Describe("ContainsKey", func() {
+		BeforeEach(func() {
+			cache = cacheddownloader.NewCache(cacheDir, 200)
+		})
+
+		It("reports whether the key is cached", func() {
+			add("key")
+			Expect(cache.ContainsKey("key")).To(BeTrue())
+			Expect(cache.ContainsKey("unknown")).To(BeFalse())
+		})
+
+		It("does not change the eviction order", func() {
+			add("old-key")
+			add("new-key")
+			for i := 0; i < 3; i++ {
+				Expect(cache.ContainsKey("old-key")).To(BeTrue())
+			}
+
+			add("newest-key")
+			Expect(cache.Keys()).To(ConsistOf("new-key", "newest-key"))
+		})
+	})
+
+	Describe("RemoveFileIfUntracked", func() {
+		It("removes untracked files in the cache directory", func() {
+			untrackedFile := filepath.Join(cacheDir, "untracked")
+			Expect(os.WriteFile(untrackedFile, []byte("foo"), 0600)).To(Succeed())
+
+			removed, err := cache.RemoveFileIfUntracked(logger, untrackedFile)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(removed).To(BeTrue())
+			Expect(untrackedFile).NotTo(BeAnExistingFile())
+		})
+
+		It("keeps tracked files and the contents of tracked directories", func() {
+			reader, err := cache.Add(logger, "file-key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			reader.Close()
+			info, err := cache.Info("file-key")
+			Expect(err).NotTo(HaveOccurred())
+
+			dir, err := cache.AddDirectory(logger, "dir-key", sourceArchive.Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+
+			for _, path := range []string{info.FilePath, dir, filepath.Join(dir, "testdir", "file.txt")} {
+				removed, err := cache.RemoveFileIfUntracked(logger, path)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(removed).To(BeFalse())
+				Expect(path).To(BeAnExistingFile())
+			}
+		})
+
+		It("rejects paths outside the cache directory", func() {
+			outside, err := os.MkdirTemp("", "outside-cache")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(outside)
+
+			for _, path := range []string{outside, cacheDir, filepath.Join(cacheDir, "..", filepath.Base(outside))} {
+				removed, err := cache.RemoveFileIfUntracked(logger, path)
+				Expect(err).To(Equal(cacheddownloader.OutsideCacheErr))
+				Expect(removed).To(BeFalse())
+			}
+			Expect(outside).To(BeADirectory())
+			Expect(cacheDir).To(BeADirectory())
+		})
+	})
+
+	Describe("StartJanitor", func() {
+		var stop func()
+
+		AfterEach(func() {
+			stop()
+		})
+
+		It("removes expired entries", func() {
+			reader, err := cache.AddWithTTL(logger, "expiring", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{}, 50*time.Millisecond)
+			Expect(err).NotTo(HaveOccurred())
+			reader.Close()
+
+			stop = cache.StartJanitor(logger, 10*time.Millisecond)
+			Eventually(cache.Keys).Should(BeEmpty())
+		})
+
+		It("removes orphaned cache files but leaves other files alone", func() {
+			orphan := filepath.Join(cacheDir, "orphan-1791955850922471559-1.tgz")
+			Expect(os.WriteFile(orphan, []byte("orphan"), 0600)).To(Succeed())
+			savedState := filepath.Join(cacheDir, "saved_cache.json")
+			Expect(os.WriteFile(savedState, []byte("{}"), 0600)).To(Succeed())
+
+			reader, err := cache.Add(logger, "key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			reader.Close()
+			info, err := cache.Info("key")
+			Expect(err).NotTo(HaveOccurred())
+
+			stop = cache.StartJanitor(logger, 10*time.Millisecond)
+			Eventually(orphan).ShouldNot(BeAnExistingFile())
+			Expect(savedState).To(BeAnExistingFile())
+			Expect(info.FilePath).To(BeAnExistingFile())
+		})
+
+		It("can be stopped more than once", func() {
+			stop = cache.StartJanitor(logger, 10*time.Millisecond)
+			stop()
+			stop()
+		})
+	})
+
+	Describe("AddStream", func() {
+		BeforeEach(func() {
+			cache = cacheddownloader.NewCache(cacheDir, 10)
+		})
+
+		It("adds the stream to the cache", func() {
+			added, written, err := cache.AddStream(logger, "key", strings.NewReader("streamed"), cacheddownloader.CachingInfoType{ETag: "e"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(added).To(BeTrue())
+			Expect(written).To(BeEquivalentTo(len("streamed")))
+
+			reader, cachingInfo, err := cache.Get(logger, "key")
+			Expect(err).NotTo(HaveOccurred())
+			defer reader.Close()
+			Expect(cachingInfo.ETag).To(Equal("e"))
+			Expect(io.ReadAll(reader)).To(Equal([]byte("streamed")))
+			Expect(cache.Stats().UsedBytes).To(BeEquivalentTo(len("streamed")))
+		})
+
+		It("discards streams larger than the cache", func() {
+			added, written, err := cache.AddStream(logger, "key", strings.NewReader("much too long to fit"), cacheddownloader.CachingInfoType{})
+			Expect(errors.Is(err, cacheddownloader.TooLargeErr)).To(BeTrue())
+			Expect(added).To(BeFalse())
+			Expect(written).To(BeEquivalentTo(11))
+
+			Expect(cache.ContainsKey("key")).To(BeFalse())
+			Expect(os.ReadDir(cacheDir)).To(BeEmpty())
+		})
+
+		It("discards streams larger than MaxEntryBytes", func() {
+			cache.MaxEntryBytes = 4
+			added, written, err := cache.AddStream(logger, "key", strings.NewReader("streamed"), cacheddownloader.CachingInfoType{})
+			Expect(err).To(MatchError(cacheddownloader.EntryTooLargeErr))
+			Expect(added).To(BeFalse())
+			Expect(written).To(BeEquivalentTo(5))
+			Expect(os.ReadDir(cacheDir)).To(BeEmpty())
+		})
+
+		It("cleans up when the stream fails", func() {
+			failing := io.MultiReader(strings.NewReader("part"), iotest.ErrReader(errors.New("boom")))
+			added, written, err := cache.AddStream(logger, "key", failing, cacheddownloader.CachingInfoType{})
+			Expect(err).To(MatchError("boom"))
+			Expect(added).To(BeFalse())
+			Expect(written).To(BeEquivalentTo(4))
+			Expect(os.ReadDir(cacheDir)).To(BeEmpty())
+		})
+
+		It("waits for an add of the same key that is staging its file", func() {
+			// hold the add in staging, where it has the key's stripe but not
+			// the cache lock
+			var staging atomic.Bool
+			renaming := make(chan struct{})
+			release := make(chan struct{})
+			defer cacheddownloader.SetRename(func(oldpath, newpath string) error {
+				if strings.HasPrefix(newpath, cacheDir) && staging.CompareAndSwap(false, true) {
+					close(renaming)
+					<-release
+				}
+				return os.Rename(oldpath, newpath)
+			})()
+
+			added := make(chan struct{})
+			go func() {
+				defer GinkgoRecover()
+				defer close(added)
+				reader, err := cache.Add(logger, "key", createFile("cache-test-file", "added").Name(), 5, cacheddownloader.CachingInfoType{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(reader.Close()).To(Succeed())
+			}()
+			Eventually(renaming).Should(BeClosed())
+
+			done := make(chan struct{})
+			go func() {
+				defer GinkgoRecover()
+				defer close(done)
+				_, _, err := cache.AddStream(logger, "key", strings.NewReader("streamed"), cacheddownloader.CachingInfoType{})
+				Expect(err).NotTo(HaveOccurred())
+			}()
+			Consistently(done).ShouldNot(BeClosed())
+
+			close(release)
+			Eventually(added).Should(BeClosed())
+			Eventually(done).Should(BeClosed())
+			reader, _, err := cache.Get(logger, "key")
+			Expect(err).NotTo(HaveOccurred())
+			defer reader.Close()
+			Expect(io.ReadAll(reader)).To(Equal([]byte("streamed")))
+		})
+
+		Context("when the same key is added concurrently", func() {
+			It("reads one stream and moves one file into the cache", func() {
+				var renames int32
+				restore := cacheddownloader.SetRename(func(oldpath, newpath string) error {
+					atomic.AddInt32(&renames, 1)
+					return os.Rename(oldpath, newpath)
+				})
+				defer restore()
+
+				// the first stream blocks until every add has started
+				release := make(chan struct{})
+				var reads int32
+				results := make(chan int64, 5)
+				for i := 0; i < 5; i++ {
+					go func() {
+						defer GinkgoRecover()
+						r := &countingReader{Reader: strings.NewReader("streamed"), reads: &reads, release: release}
+						added, written, err := cache.AddStream(logger, "key", r, cacheddownloader.CachingInfoType{})
+						Expect(err).NotTo(HaveOccurred())
+						Expect(added).To(BeTrue())
+						results <- written
+					}()
+				}
+				Eventually(func() int32 { return atomic.LoadInt32(&reads) }).Should(BeEquivalentTo(1))
+				Eventually(logger).Should(gbytes.Say("waiting-for-concurrent-add"))
+				close(release)
+
+				for i := 0; i < 5; i++ {
+					Eventually(results).Should(Receive(BeEquivalentTo(len("streamed"))))
+				}
+				Expect(atomic.LoadInt32(&reads)).To(BeEquivalentTo(1))
+				Expect(atomic.LoadInt32(&renames)).To(BeEquivalentTo(1))
+			})
+		})
+	})
+
+	Describe("NewCacheWithReserve", func() {
+		var restore func()
+
+		BeforeEach(func() {
+			// pretend the cache directory is on a 100 byte filesystem
+			restore = cacheddownloader.SetFreeBytes(func(path string) (int64, error) {
+				used := int64(0)
+				files, err := os.ReadDir(path)
+				Expect(err).NotTo(HaveOccurred())
+				for _, file := range files {
+					info, err := file.Info()
+					Expect(err).NotTo(HaveOccurred())
+					used += info.Size()
+				}
+				return 100 - used, nil
+			})
+		})
+
+		AfterEach(func() {
+			restore()
+		})
+
+		It("evicts entries to keep the reserve free", func() {
+			cache = cacheddownloader.NewCacheWithReserve(cacheDir, 1000, 70)
+			for _, cacheKey := range []string{"a", "b", "c", "d"} {
+				add(cacheKey, withSize(9))
+			}
+			Expect(cache.Keys()).To(ConsistOf("b", "c", "d"))
+		})
+
+		It("rejects adds that would use the reserve", func() {
+			cache = cacheddownloader.NewCacheWithReserve(cacheDir, 1000, 95)
+			Expect(tryAdd("a", withSize(9))).To(MatchError(cacheddownloader.NotEnoughFreeSpaceErr))
+			Expect(cache.Keys()).To(BeEmpty())
+		})
+
+		It("does not enforce a reserve by default", func() {
+			add("a", withSize(9))
+		})
+	})
+
+	Describe("failing to delete evicted files", func() {
+		var (
+			restore   func()
+			removeErr = errors.New("permission denied")
+		)
+
+		BeforeEach(func() {
+			reader, err := cache.Add(logger, "key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			reader.Close()
+
+			restore = cacheddownloader.SetRemoveAll(func(path string) error {
+				return removeErr
+			})
+		})
+
+		AfterEach(func() {
+			restore()
+		})
+
+		It("returns the error from Remove", func() {
+			Expect(cache.Remove(logger, "key")).To(MatchError(removeErr))
+			Expect(cache.ContainsKey("key")).To(BeFalse())
+		})
+
+		It("returns the error from Prune", func() {
+			_, err := cache.Prune(logger, 0)
+			Expect(err).To(MatchError(removeErr))
+			Expect(logger).To(gbytes.Say("failed-to-delete-entry"))
+		})
+	})
+
+	Describe("Snapshot", func() {
+		It("is empty for an empty cache", func() {
+			Expect(cache.Snapshot()).To(BeEmpty())
+		})
+
+		It("describes every entry", func() {
+			reader, err := cache.Add(logger, "key-1", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{ETag: "e1"})
+			Expect(err).NotTo(HaveOccurred())
+			reader.Close()
+			dir, err := cache.AddDirectory(logger, "key-2", sourceArchive.Name(), 100, cacheddownloader.CachingInfoType{ETag: "e2"})
+			Expect(err).NotTo(HaveOccurred())
+
+			snapshot := cache.Snapshot()
+			Expect(snapshot).To(HaveLen(2))
+			infos := map[string]cacheddownloader.EntryInfo{}
+			for _, info := range snapshot {
+				infos[info.CacheKey] = info
+			}
+
+			Expect(infos["key-1"].Size).To(BeEquivalentTo(len("the-file-content")))
+			Expect(infos["key-1"].CachingInfo.ETag).To(Equal("e1"))
+			Expect(infos["key-1"].FilePath).To(BeAnExistingFile())
+			Expect(infos["key-1"].Access).NotTo(BeZero())
+			Expect(infos["key-2"].DirectoryPath).To(Equal(dir))
+			Expect(infos["key-2"].CachingInfo.ETag).To(Equal("e2"))
+		})
+
+		It("is not affected by later changes to the cache", func() {
+			reader, err := cache.Add(logger, "key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			reader.Close()
+
+			snapshot := cache.Snapshot()
+			cache.Remove(logger, "key")
+			Expect(snapshot).To(HaveLen(1))
+			Expect(snapshot[0].CacheKey).To(Equal("key"))
+		})
+	})
+
+	Describe("Deduplicate", func() {
+		read := func(cacheKey string) string {
+			reader, _, err := cache.Get(logger, cacheKey)
+			Expect(err).NotTo(HaveOccurred())
+			defer reader.Close()
+			content, err := io.ReadAll(reader)
+			Expect(err).NotTo(HaveOccurred())
+			// without the padding that sizes the file
+			return strings.TrimRight(string(content), ".")
+		}
+
+		BeforeEach(func() {
+			cache = cacheddownloader.NewCache(cacheDir, 250)
+			cache.Deduplicate = true
+		})
+
+		It("links identical content instead of storing it twice", func() {
+			add("key-1", withContent("same"))
+			add("key-2", withContent("same"))
+
+			first, err := cache.Info("key-1")
+			Expect(err).NotTo(HaveOccurred())
+			second, err := cache.Info("key-2")
+			Expect(err).NotTo(HaveOccurred())
+			firstStat, err := os.Stat(first.FilePath)
+			Expect(err).NotTo(HaveOccurred())
+			secondStat, err := os.Stat(second.FilePath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(os.SameFile(firstStat, secondStat)).To(BeTrue())
+
+			Expect(cache.Stats().UsedBytes).To(BeEquivalentTo(100))
+			Expect(read("key-2")).To(Equal("same"))
+		})
+
+		It("keeps the shared content until the last key is evicted", func() {
+			add("key-1", withContent("same"))
+			add("key-2", withContent("same"))
+
+			cache.Remove(logger, "key-1")
+			Expect(read("key-2")).To(Equal("same"))
+			Expect(cache.Stats().UsedBytes).To(BeEquivalentTo(100))
+
+			cache.Remove(logger, "key-2")
+			Expect(os.ReadDir(cacheDir)).To(BeEmpty())
+		})
+
+		It("does not account shared content when making room", func() {
+			add("key-1", withContent("same"))
+			add("key-2", withContent("same"))
+			add("key-3", withContent("different"))
+
+			Expect(cache.Keys()).To(ConsistOf("key-1", "key-2", "key-3"))
+			Expect(cache.Stats().UsedBytes).To(BeEquivalentTo(200))
+		})
+
+		It("stores different content separately", func() {
+			add("key-1", withContent("one"))
+			add("key-2", withContent("two"))
+
+			Expect(read("key-1")).To(Equal("one"))
+			Expect(read("key-2")).To(Equal("two"))
+			Expect(cache.Stats().UsedBytes).To(BeEquivalentTo(200))
+		})
+	})
+
+	Describe("AddWithResult", func() {
+		BeforeEach(func() {
+			cache = cacheddownloader.NewCache(cacheDir, 300)
+		})
+
+		It("reports no evictions when there is room", func() {
+			source := createSizedFile("cache-test-file", "content", 100)
+			result, err := cache.AddWithResult(logger, "key-1", source.Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.File.Close()).To(Succeed())
+			Expect(result.Evicted).To(BeEmpty())
+		})
+
+		It("reports the evicted keys in eviction order", func() {
+			add("key-1")
+			add("key-2")
+			add("key-3")
+
+			source := createSizedFile("cache-test-file", "big", 250)
+			result, err := cache.AddWithResult(logger, "big", source.Name(), 250, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			defer result.File.Close()
+			Expect(result.Evicted).To(Equal([]string{"key-1", "key-2", "key-3"}))
+		})
+	})
+
+	Describe("eviction of entries with equal access times", func() {
+		It("evicts the entry that was added first", func() {
+			access := time.Now().Add(-time.Hour)
+			for i := 0; i < 10; i++ {
+				entries := map[string]*cacheddownloader.FileCacheEntry{}
+				for seq, cacheKey := range []string{"first", "second"} {
+					path := filepath.Join(cacheDir, fmt.Sprintf("%s-%d-%d", cacheKey, i, seq+1))
+					Expect(os.WriteFile(path, []byte(cacheKey), 0600)).To(Succeed())
+					entries[cacheKey] = &cacheddownloader.FileCacheEntry{
+						Size:        100,
+						Access:      access,
+						AccessCount: 1,
+						Seq:         uint64(seq + 1),
+						FilePath:    path,
+					}
+				}
+				state, err := json.Marshal(&cacheddownloader.FileCache{CachedPath: cacheDir, Entries: entries, OldEntries: map[string]*cacheddownloader.FileCacheEntry{}, Seq: 2})
+				Expect(err).NotTo(HaveOccurred())
+				statePath := filepath.Join(cacheDir, "saved_cache.json")
+				Expect(os.WriteFile(statePath, state, 0600)).To(Succeed())
+
+				cache = cacheddownloader.NewCache(cacheDir, 200)
+				Expect(cache.Load(logger, statePath)).To(Succeed())
+
+				reader, err := cache.Add(logger, "new-key", createSizedFile("cache-test-file", "new", 100).Name(), 100, cacheddownloader.CachingInfoType{})
+				Expect(err).NotTo(HaveOccurred())
+				reader.Close()
+				Expect(cache.Keys()).To(ConsistOf("second", "new-key"))
+			}
+		})
+	})
+
+	Describe("Walk", func() {
+		BeforeEach(func() {
+			for _, cacheKey := range []string{"key-1", "key-2", "key-3"} {
+				source := createSizedFile("cache-test-file", "content-"+cacheKey, 100)
+				reader, err := cache.Add(logger, cacheKey, source.Name(), 100, cacheddownloader.CachingInfoType{ETag: cacheKey})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(reader.Close()).To(Succeed())
+			}
+		})
+
+		It("visits every entry", func() {
+			visited := map[string]string{}
+			cache.Walk(func(cacheKey string, entry cacheddownloader.EntryInfo) bool {
+				visited[cacheKey] = entry.CachingInfo.ETag
+				return true
+			})
+			Expect(visited).To(Equal(map[string]string{"key-1": "key-1", "key-2": "key-2", "key-3": "key-3"}))
+		})
+
+		It("stops when the visitor returns false", func() {
+			visits := 0
+			cache.Walk(func(cacheKey string, entry cacheddownloader.EntryInfo) bool {
+				visits++
+				return false
+			})
+			Expect(visits).To(Equal(1))
+		})
+	})
+
+	Describe("GetOrLoad", func() {
+		var loads int32
+
+		loader := func(content string) func() (string, int64, cacheddownloader.CachingInfoType, error) {
+			return func() (string, int64, cacheddownloader.CachingInfoType, error) {
+				atomic.AddInt32(&loads, 1)
+				time.Sleep(10 * time.Millisecond)
+				return createFile("cache-test-file", content).Name(), int64(len(content)), cacheddownloader.CachingInfoType{ETag: content}, nil
+			}
+		}
+
+		BeforeEach(func() {
+			atomic.StoreInt32(&loads, 0)
+		})
+
+		It("loads and acquires the file on a miss", func() {
+			path, err := cache.GetOrLoad(logger, "key", loader("loaded"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(os.ReadFile(path)).To(Equal([]byte("loaded")))
+			Expect(atomic.LoadInt32(&loads)).To(BeEquivalentTo(1))
+			Expect(cache.Release(logger, "key", path)).To(Succeed())
+		})
+
+		It("returns the cached file on a hit", func() {
+			path, err := cache.GetOrLoad(logger, "key", loader("loaded"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cache.Release(logger, "key", path)).To(Succeed())
+
+			path, err = cache.GetOrLoad(logger, "key", loader("reloaded"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(os.ReadFile(path)).To(Equal([]byte("loaded")))
+			Expect(atomic.LoadInt32(&loads)).To(BeEquivalentTo(1))
+			Expect(cache.Release(logger, "key", path)).To(Succeed())
+		})
+
+		It("runs the loader once for concurrent misses", func() {
+			paths := make(chan string, 5)
+			for i := 0; i < 5; i++ {
+				go func() {
+					defer GinkgoRecover()
+					path, err := cache.GetOrLoad(logger, "key", loader("loaded"))
+					Expect(err).NotTo(HaveOccurred())
+					paths <- path
+				}()
+			}
+
+			for i := 0; i < 5; i++ {
+				var path string
+				Eventually(paths).Should(Receive(&path))
+				Expect(cache.Release(logger, "key", path)).To(Succeed())
+			}
+			Expect(atomic.LoadInt32(&loads)).To(BeEquivalentTo(1))
+		})
+
+		It("returns the loader's error", func() {
+			_, err := cache.GetOrLoad(logger, "key", func() (string, int64, cacheddownloader.CachingInfoType, error) {
+				return "", 0, cacheddownloader.CachingInfoType{}, errors.New("boom")
+			})
+			Expect(err).To(MatchError("boom"))
+			Expect(cache.ContainsKey("key")).To(BeFalse())
+		})
+	})
+
+	Describe("adding with NoCache", func() {
+		It("moves the file into the cache directory without tracking it", func() {
+			reader, err := cache.Add(logger, "key", sourceFile.Name(), cacheddownloader.NoCache, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(filepath.Dir(reader.Name())).To(Equal(cacheDir))
+			Expect(sourceFile.Name()).NotTo(BeAnExistingFile())
+			Expect(io.ReadAll(reader)).To(Equal([]byte("the-file-content")))
+			Expect(cache.ContainsKey("key")).To(BeFalse())
+			Expect(cache.Stats().UsedBytes).To(BeZero())
+
+			Expect(reader.Close()).To(Succeed())
+			Expect(reader.Name()).NotTo(BeAnExistingFile())
+		})
+
+		It("keeps the existing entry for the key", func() {
+			reader, err := cache.Add(logger, "key", createFile("cache-test-file", "cached").Name(), 6, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			reader.Close()
+
+			reader, err = cache.Add(logger, "key", sourceFile.Name(), -5, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			reader.Close()
+
+			reader, _, err = cache.Get(logger, "key")
+			Expect(err).NotTo(HaveOccurred())
+			defer reader.Close()
+			Expect(io.ReadAll(reader)).To(Equal([]byte("cached")))
+		})
+	})
+
+	Describe("EmitMetrics", func() {
+		It("sends the cache metrics", func() {
+			cache = cacheddownloader.NewCache(cacheDir, 200)
+			for _, cacheKey := range []string{"key-1", "key-2", "key-3"} {
+				source := createSizedFile("cache-test-file", "content-"+cacheKey, 100)
+				reader, err := cache.Add(logger, cacheKey, source.Name(), 100, cacheddownloader.CachingInfoType{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(reader.Close()).To(Succeed())
+			}
+			reader, _, err := cache.Get(logger, "key-3")
+			Expect(err).NotTo(HaveOccurred())
+			reader.Close()
+			_, _, err = cache.Get(logger, "unknown")
+			Expect(err).To(HaveOccurred())
+
+			emitter := &fakeMetricsEmitter{values: map[string]float64{}, units: map[string]string{}}
+			cache.EmitMetrics(emitter)
+
+			Expect(emitter.values).To(Equal(map[string]float64{
+				cacheddownloader.MetricUsedBytes: 200,
+				cacheddownloader.MetricEntries:   2,
+				cacheddownloader.MetricHitRatio:  0.5,
+				cacheddownloader.MetricEvictions: 1,
+			}))
+			Expect(emitter.units[cacheddownloader.MetricUsedBytes]).To(Equal("B"))
+		})
+	})
+
+	Describe("cached file name collisions", func() {
+		var (
+			restore func()
+			clock   time.Time
+		)
+
+		BeforeEach(func() {
+			clock = time.Now()
+			restore = cacheddownloader.SetNow(func() time.Time { return clock })
+		})
+
+		AfterEach(func() {
+			restore()
+		})
+
+		It("does not reuse the file of an entry restored with a stale sequence number", func() {
+			// the state of an earlier run, saved before the sequence number was bumped
+			collidingPath := filepath.Join(cacheDir, fmt.Sprintf("key-%d-1", clock.UnixNano()))
+			Expect(os.WriteFile(collidingPath, []byte("other-content"), 0600)).To(Succeed())
+			state, err := json.Marshal(&cacheddownloader.FileCache{
+				CachedPath: cacheDir,
+				Entries: map[string]*cacheddownloader.FileCacheEntry{
+					"other-key": {Size: 100, Access: clock, AccessCount: 1, FilePath: collidingPath},
+				},
+				OldEntries: map[string]*cacheddownloader.FileCacheEntry{},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			statePath := filepath.Join(cacheDir, "saved_cache.json")
+			Expect(os.WriteFile(statePath, state, 0600)).To(Succeed())
+			Expect(cache.Load(logger, statePath)).To(Succeed())
+
+			reader, err := cache.Add(logger, "key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Name()).NotTo(Equal(collidingPath))
+			reader.Close()
+
+			Expect(os.ReadFile(collidingPath)).To(Equal([]byte("other-content")))
+			other, _, err := cache.Get(logger, "other-key")
+			Expect(err).NotTo(HaveOccurred())
+			defer other.Close()
+			Expect(io.ReadAll(other)).To(Equal([]byte("other-content")))
+		})
+
+		It("does not overwrite untracked files in the cache directory", func() {
+			leftover := filepath.Join(cacheDir, fmt.Sprintf("key-%d-1", clock.UnixNano()))
+			Expect(os.WriteFile(leftover, []byte("leftover"), 0600)).To(Succeed())
+
+			reader, err := cache.Add(logger, "key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			defer reader.Close()
+			Expect(reader.Name()).NotTo(Equal(leftover))
+			Expect(os.ReadFile(leftover)).To(Equal([]byte("leftover")))
+		})
+	})
+
+	Describe("AddIfNewer", func() {
+		BeforeEach(func() {
+			reader, err := cache.Add(logger, "key", createFile("cache-test-file", "original").Name(), 8, cacheddownloader.CachingInfoType{ETag: "etag"})
+			Expect(err).NotTo(HaveOccurred())
+			reader.Close()
+		})
+
+		read := func() string {
+			reader, _, err := cache.Get(logger, "key")
+			Expect(err).NotTo(HaveOccurred())
+			defer reader.Close()
+			content, err := io.ReadAll(reader)
+			Expect(err).NotTo(HaveOccurred())
+			return string(content)
+		}
+
+		It("leaves the entry alone when the caching info is unchanged", func() {
+			source := createFile("cache-test-file", "refreshed")
+			updated, err := cache.AddIfNewer(logger, "key", source.Name(), 9, cacheddownloader.CachingInfoType{ETag: "etag"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(updated).To(BeFalse())
+			Expect(source.Name()).To(BeAnExistingFile())
+			Expect(read()).To(Equal("original"))
+		})
+
+		It("compares ETags weakly", func() {
+			reader, err := cache.Add(logger, "key", createFile("cache-test-file", "original").Name(), 8, cacheddownloader.CachingInfoType{ETag: `W/"etag"`})
+			Expect(err).NotTo(HaveOccurred())
+			reader.Close()
+
+			updated, err := cache.AddIfNewer(logger, "key", createFile("cache-test-file", "refreshed").Name(), 9, cacheddownloader.CachingInfoType{ETag: `"etag"`})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(updated).To(BeFalse())
+			Expect(read()).To(Equal("original"))
+
+			info, ok := cache.InfoOK("key")
+			Expect(ok).To(BeTrue())
+			Expect(info.ETag).To(Equal(`W/"etag"`))
+		})
+
+		It("replaces the entry when the caching info changed", func() {
+			updated, err := cache.AddIfNewer(logger, "key", createFile("cache-test-file", "refreshed").Name(), 9, cacheddownloader.CachingInfoType{ETag: "new-etag"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(updated).To(BeTrue())
+			Expect(read()).To(Equal("refreshed"))
+		})
+
+		It("replaces the entry when there is no caching info to compare", func() {
+			updated, err := cache.AddIfNewer(logger, "key", createFile("cache-test-file", "refreshed").Name(), 9, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(updated).To(BeTrue())
+		})
+
+		It("adds missing entries", func() {
+			updated, err := cache.AddIfNewer(logger, "other-key", createFile("cache-test-file", "new").Name(), 3, cacheddownloader.CachingInfoType{ETag: "etag"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(updated).To(BeTrue())
+			Expect(cache.ContainsKey("other-key")).To(BeTrue())
+		})
+	})
+	Describe("when an add fails after moving the file", func() {
+		It("moves the source back without tracking an entry", func() {
+			_, err := cache.AddDirectory(logger, "key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).To(HaveOccurred())
+			Expect(cache.Keys()).To(BeEmpty())
+			Expect(filenamesInDir(cacheDir)).To(BeEmpty())
+
+			content, err := os.ReadFile(sourceFile.Name())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(content)).To(Equal("the-file-content"))
+		})
+
+		It("keeps the previous entry for the key", func() {
+			dirPath, err := cache.AddDirectory(logger, "key", sourceArchive.Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cache.CloseDirectory(logger, "key", dirPath)).To(Succeed())
+
+			_, err = cache.AddDirectory(logger, "key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).To(HaveOccurred())
+			Expect(sourceFile.Name()).To(BeAnExistingFile())
+			Expect(filenamesInDir(cacheDir)).To(ConsistOf(filepath.Base(dirPath)))
+
+			Expect(cache.GetDirectory(logger, "key")).To(Equal(dirPath))
+			Expect(filepath.Join(dirPath, "diego.txt")).To(BeAnExistingFile())
+		})
+
+		It("removes the link to a duplicate", func() {
+			cache.Deduplicate = true
+			duplicate := createFile("cache-test-duplicate", "the-file-content")
+			defer os.Remove(duplicate.Name())
+
+			reader, err := cache.Add(logger, "original", duplicate.Name(), 16, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+
+			_, err = cache.AddDirectory(logger, "key", sourceFile.Name(), 16, cacheddownloader.CachingInfoType{})
+			Expect(err).To(HaveOccurred())
+			Expect(cache.Keys()).To(ConsistOf("original"))
+			Expect(sourceFile.Name()).To(BeAnExistingFile())
+			Expect(filenamesInDir(cacheDir)).To(ConsistOf(filepath.Base(reader.Name())))
+		})
+
+		Context("when the file cannot be moved back", func() {
+			It("removes it from the cache directory", func() {
+				renames := 0
+				restore := cacheddownloader.SetRename(func(oldpath, newpath string) error {
+					renames++
+					if renames > 1 {
+						return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EACCES}
+					}
+					return os.Rename(oldpath, newpath)
+				})
+				defer restore()
+
+				_, err := cache.AddDirectory(logger, "key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{})
+				Expect(err).To(HaveOccurred())
+				Expect(cache.Keys()).To(BeEmpty())
+				Expect(filenamesInDir(cacheDir)).To(BeEmpty())
+			})
+		})
+	})
+	Describe("NewCacheWithCompression", func() {
+		var content string
+
+		BeforeEach(func() {
+			cache = cacheddownloader.NewCacheWithCompression(cacheDir, maxSizeInBytes)
+			content = strings.Repeat("compressible ", 1000)
+			Expect(os.WriteFile(sourceFile.Name(), []byte(content), 0600)).To(Succeed())
+		})
+
+		It("stores the file gzipped and accounts for its compressed size", func() {
+			reader, err := cache.Add(logger, "key", sourceFile.Name(), int64(len(content)), cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+			Expect(sourceFile.Name()).NotTo(BeAnExistingFile())
+
+			entry := cache.Entries["key"]
+			Expect(entry.Compressed).To(BeTrue())
+			stored, err := os.ReadFile(entry.FilePath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stored[:2]).To(Equal([]byte{0x1f, 0x8b}))
+			Expect(entry.Size).To(Equal(int64(len(stored))))
+			Expect(entry.Size).To(BeNumerically("<", len(content)))
+			Expect(cache.Stats().UsedBytes).To(Equal(entry.Size))
+		})
+
+		It("hands out decompressed copies that are removed on close", func() {
+			reader, err := cache.Add(logger, "key", sourceFile.Name(), int64(len(content)), cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(io.ReadAll(reader)).To(Equal([]byte(content)))
+			Expect(reader.Close()).To(Succeed())
+
+			reader, _, err = cache.Get(logger, "key")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(io.ReadAll(reader)).To(Equal([]byte(content)))
+			Expect(reader.Close()).To(Succeed())
+			Expect(filenamesInDir(cacheDir)).To(HaveLen(1))
+		})
+
+		It("decompresses the file read through OpenForKey", func() {
+			reader, err := cache.Add(logger, "key", sourceFile.Name(), int64(len(content)), cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+
+			file, err := cache.OpenForKey(logger, "key")
+			Expect(err).NotTo(HaveOccurred())
+			defer file.Close()
+			Expect(io.ReadAll(file)).To(Equal([]byte(content)))
+		})
+
+		It("verifies the checksum of the decompressed content", func() {
+			value, err := cacheddownloader.HexValue("sha256", content)
+			Expect(err).NotTo(HaveOccurred())
+			checksum := cacheddownloader.ChecksumInfoType{Algorithm: "sha256", Value: value}
+
+			reader, err := cache.AddWithChecksum(logger, "key", sourceFile.Name(), int64(len(content)), cacheddownloader.CachingInfoType{}, checksum)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+			Expect(cache.Verify(logger, "key")).To(BeTrue())
+		})
+
+		It("expands compressed directories", func() {
+			dirPath, err := cache.AddDirectory(logger, "key", sourceArchive.Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filepath.Join(dirPath, "diego.txt")).To(BeAnExistingFile())
+			Expect(cache.CloseDirectory(logger, "key", dirPath)).To(Succeed())
+
+			reader, _, err := cache.Get(logger, "key")
+			Expect(err).NotTo(HaveOccurred())
+			defer reader.Close()
+
+			tarReader := tar.NewReader(reader)
+			names := []string{}
+			for {
+				hdr, err := tarReader.Next()
+				if err == io.EOF {
+					break
+				}
+				Expect(err).NotTo(HaveOccurred())
+				names = append(names, hdr.Name)
+			}
+			Expect(names).To(ContainElement("diego.txt"))
+		})
+	})
+	Describe("adding different keys concurrently", func() {
+		It("does not hold up other keys while a file is moved into the cache", func() {
+			slowSource := createFile("cache-test-slow", "slow-content")
+			defer os.Remove(slowSource.Name())
+
+			moving := make(chan struct{})
+			unblock := make(chan struct{})
+			restore := cacheddownloader.SetRename(func(oldpath, newpath string) error {
+				if oldpath == slowSource.Name() {
+					close(moving)
+					<-unblock
+				}
+				return os.Rename(oldpath, newpath)
+			})
+			defer restore()
+
+			done := make(chan error)
+			go func() {
+				defer GinkgoRecover()
+				reader, err := cache.Add(logger, "slow", slowSource.Name(), 100, cacheddownloader.CachingInfoType{})
+				if err == nil {
+					err = reader.Close()
+				}
+				done <- err
+			}()
+			Eventually(moving).Should(BeClosed())
+
+			reader, err := cache.Add(logger, "key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+			Expect(cache.ContainsKey("key")).To(BeTrue())
+
+			close(unblock)
+			Eventually(done).Should(Receive(BeNil()))
+			Expect(cache.Keys()).To(ConsistOf("slow", "key"))
+		})
+	})
+	Describe("adding a symlink", func() {
+		var linkDir, linkPath string
+
+		BeforeEach(func() {
+			linkDir, err = os.MkdirTemp("", "cache-test-link")
+			Expect(err).NotTo(HaveOccurred())
+			linkPath = filepath.Join(linkDir, "link")
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(linkDir)
+		})
+
+		expectRegularFile := func(path string) {
+			info, err := os.Lstat(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Mode().IsRegular()).To(BeTrue())
+		}
+
+		Context("when it points outside the cache directory", func() {
+			BeforeEach(func() {
+				Expect(os.Symlink(sourceFile.Name(), linkPath)).To(Succeed())
+			})
+
+			It("caches a copy of the target and removes the link", func() {
+				reader, err := cache.Add(logger, "key", linkPath, 100, cacheddownloader.CachingInfoType{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(io.ReadAll(reader)).To(Equal([]byte("the-file-content")))
+				Expect(reader.Close()).To(Succeed())
+
+				expectRegularFile(cache.Entries["key"].FilePath)
+				Expect(linkPath).NotTo(BeAnExistingFile())
+				Expect(os.ReadFile(sourceFile.Name())).To(Equal([]byte("the-file-content")))
+			})
+
+			It("keeps the link when the add fails", func() {
+				_, err := cache.AddDirectory(logger, "key", linkPath, 100, cacheddownloader.CachingInfoType{})
+				Expect(err).To(HaveOccurred())
+				Expect(cache.Keys()).To(BeEmpty())
+				Expect(filenamesInDir(cacheDir)).To(BeEmpty())
+
+				target, err := os.Readlink(linkPath)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(target).To(Equal(sourceFile.Name()))
+				Expect(sourceFile.Name()).To(BeAnExistingFile())
+			})
+		})
+
+		Context("when it points to a cached file", func() {
+			var cachedPath string
+
+			BeforeEach(func() {
+				reader, err := cache.Add(logger, "original", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(reader.Close()).To(Succeed())
+				cachedPath = cache.Entries["original"].FilePath
+				Expect(os.Symlink(cachedPath, linkPath)).To(Succeed())
+			})
+
+			It("caches a copy without touching the cached file", func() {
+				reader, err := cache.Add(logger, "key", linkPath, 100, cacheddownloader.CachingInfoType{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(reader.Close()).To(Succeed())
+
+				expectRegularFile(cache.Entries["key"].FilePath)
+				Expect(cache.Entries["key"].FilePath).NotTo(Equal(cachedPath))
+				Expect(linkPath).NotTo(BeAnExistingFile())
+
+				Expect(cache.Remove(logger, "key")).To(Succeed())
+				reader, _, err = cache.Get(logger, "original")
+				Expect(err).NotTo(HaveOccurred())
+				defer reader.Close()
+				Expect(io.ReadAll(reader)).To(Equal([]byte("the-file-content")))
+			})
+		})
+	})
+	Describe("Seed", func() {
+		var seedDir string
+
+		seedFile := func(name, content string) string {
+			path := filepath.Join(seedDir, name)
+			Expect(os.WriteFile(path, []byte(content), 0600)).To(Succeed())
+			return path
+		}
+
+		BeforeEach(func() {
+			seedDir, err = os.MkdirTemp("", "cache-test-seed")
+			Expect(err).NotTo(HaveOccurred())
+			cache = cacheddownloader.NewCache(cacheDir, 20)
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(seedDir)
+		})
+
+		It("adopts the files into the cache", func() {
+			cachingInfo := cacheddownloader.CachingInfoType{ETag: "etag"}
+			value, err := cacheddownloader.HexValue("sha256", "content-a")
+			Expect(err).NotTo(HaveOccurred())
+			checksum := cacheddownloader.ChecksumInfoType{Algorithm: "sha256", Value: value}
+
+			err = cache.Seed(logger, []cacheddownloader.SeedEntry{
+				{CacheKey: "a", SourcePath: seedFile("a", "content-a"), CachingInfo: cachingInfo, Checksum: checksum},
+				{CacheKey: "b", SourcePath: seedFile("b", "content-b")},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cache.Keys()).To(ConsistOf("a", "b"))
+			Expect(filenamesInDir(seedDir)).To(BeEmpty())
+
+			reader, info, err := cache.Get(logger, "a")
+			Expect(err).NotTo(HaveOccurred())
+			defer reader.Close()
+			Expect(info).To(Equal(cachingInfo))
+			Expect(io.ReadAll(reader)).To(Equal([]byte("content-a")))
+			Expect(cache.Verify(logger, "a")).To(BeTrue())
+		})
+
+		It("evicts earlier entries to stay under the limit", func() {
+			err := cache.Seed(logger, []cacheddownloader.SeedEntry{
+				{CacheKey: "a", SourcePath: seedFile("a", "content-a")},
+				{CacheKey: "b", SourcePath: seedFile("b", "content-b")},
+				{CacheKey: "c", SourcePath: seedFile("c", "content-c")},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cache.Keys()).To(ConsistOf("b", "c"))
+		})
+
+		It("reports the files it could not adopt and leaves them in place", func() {
+			tooLarge := seedFile("too-large", "content-that-does-not-fit")
+			mismatched := seedFile("mismatched", "content-m")
+
+			err := cache.Seed(logger, []cacheddownloader.SeedEntry{
+				{CacheKey: "too-large", SourcePath: tooLarge},
+				{CacheKey: "missing", SourcePath: filepath.Join(seedDir, "missing")},
+				{CacheKey: "mismatched", SourcePath: mismatched, Checksum: cacheddownloader.ChecksumInfoType{Algorithm: "sha256", Value: "0000"}},
+				{CacheKey: "a", SourcePath: seedFile("a", "content-a")},
+			})
+			Expect(err).To(MatchError(cacheddownloader.DoesNotFitErr))
+			Expect(err).To(MatchError(os.ErrNotExist))
+			Expect(err).To(MatchError(ContainSubstring("could not seed mismatched")))
+			Expect(cache.Keys()).To(ConsistOf("a"))
+
+			Expect(tooLarge).To(BeAnExistingFile())
+			Expect(mismatched).To(BeAnExistingFile())
+			Expect(filenamesInDir(cacheDir)).To(HaveLen(1))
+		})
+
+		It("rounds sizes up to BlockSize when checking that files fit", func() {
+			cache.BlockSize = 16
+			tooLarge := seedFile("too-large", "content-of-17-byt")
+
+			err := cache.Seed(logger, []cacheddownloader.SeedEntry{
+				{CacheKey: "too-large", SourcePath: tooLarge},
+			})
+			Expect(err).To(MatchError(cacheddownloader.DoesNotFitErr))
+			Expect(tooLarge).To(BeAnExistingFile())
+		})
+	})
+	Describe("UsedBytes and FreeBytes", func() {
+		It("track the space used as entries are added and removed", func() {
+			Expect(cache.UsedBytes()).To(BeZero())
+			Expect(cache.FreeBytes()).To(Equal(maxSizeInBytes))
+
+			reader, err := cache.Add(logger, "file", createSizedFile("cache-test-file", "content", 100).Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+			dirSize := fileSizeOf(sourceArchive)
+			_, err = cache.AddDirectory(logger, "dir", sourceArchive.Name(), dirSize, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cache.UsedBytes()).To(Equal(100 + dirSize))
+			Expect(cache.FreeBytes()).To(Equal(maxSizeInBytes - 100 - dirSize))
+
+			Expect(cache.Remove(logger, "file")).To(Succeed())
+			Expect(cache.UsedBytes()).To(Equal(dirSize))
+		})
+
+		It("count both the file and the directory of an entry in use as both", func() {
+			size := fileSizeOf(sourceArchive)
+			reader, err := cache.Add(logger, "key", sourceArchive.Name(), size, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+
+			dirPath, _, err := cache.GetDirectory(logger, "key")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cache.UsedBytes()).To(Equal(2 * size))
+
+			Expect(reader.Close()).To(Succeed())
+			Expect(cache.UsedBytes()).To(Equal(size))
+			Expect(cache.CloseDirectory(logger, "key", dirPath)).To(Succeed())
+			Expect(cache.UsedBytes()).To(Equal(size))
+		})
+
+		It("count shared content once", func() {
+			cache.Deduplicate = true
+			for _, cacheKey := range []string{"a", "b"} {
+				source := createSizedFile("cache-test-file", "same-content", 12)
+				reader, err := cache.Add(logger, cacheKey, source.Name(), 12, cacheddownloader.CachingInfoType{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(reader.Close()).To(Succeed())
+			}
+			Expect(cache.UsedBytes()).To(BeEquivalentTo(12))
+
+			Expect(cache.Remove(logger, "a")).To(Succeed())
+			Expect(cache.UsedBytes()).To(BeEquivalentTo(12))
+			Expect(cache.Remove(logger, "b")).To(Succeed())
+			Expect(cache.UsedBytes()).To(BeZero())
+		})
+	})
+	Describe("FilenameFunc", func() {
+		var sourceDir, sourcePath string
+
+		BeforeEach(func() {
+			sourceDir, err = os.MkdirTemp("", "cache-test-source")
+			Expect(err).NotTo(HaveOccurred())
+
+			sourcePath = filepath.Join(sourceDir, strings.Repeat("long-name-", 20)+".tgz")
+			Expect(os.WriteFile(sourcePath, []byte("the-content"), 0600)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(sourceDir)
+		})
+
+		It("names cached files after the cache key by default", func() {
+			reader, err := cache.Add(logger, "key", sourcePath, 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+			Expect(filepath.Base(cache.Entries["key"].FilePath)).To(MatchRegexp(`^key-\d+-\d+\.tgz$`))
+		})
+
+		It("derives cached file names from the configured function", func() {
+			cache.FilenameFunc = cacheddownloader.HashedFilename
+			reader, err := cache.Add(logger, "key", sourcePath, 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+
+			name := cacheddownloader.HashedFilename("key", filepath.Base(sourcePath))
+			Expect(name).To(MatchRegexp(`^[0-9a-f]{16}\.tgz$`))
+			Expect(filepath.Base(cache.Entries["key"].FilePath)).To(MatchRegexp(`^` + strings.TrimSuffix(name, ".tgz") + `-\d+-\d+\.tgz$`))
+		})
+
+		It("rejects names that are not a single path segment", func() {
+			for _, name := range []string{"", "..", "dir/name", "../name"} {
+				cache.FilenameFunc = func(string, string) string { return name }
+				_, err := cache.Add(logger, "key", sourcePath, 100, cacheddownloader.CachingInfoType{})
+				Expect(err).To(Equal(cacheddownloader.InvalidFilenameErr), name)
+				Expect(cache.Keys()).To(BeEmpty())
+				Expect(sourcePath).To(BeAnExistingFile())
+				Expect(filenamesInDir(cacheDir)).To(BeEmpty())
+			}
+		})
+	})
+	Describe("Take", func() {
+		It("returns false for an unknown key", func() {
+			path, ok := cache.Take(logger, "unknown")
+			Expect(ok).To(BeFalse())
+			Expect(path).To(BeEmpty())
+		})
+
+		It("removes the entry and hands back its file", func() {
+			reader, err := cache.Add(logger, "key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+
+			path, ok := cache.Take(logger, "key")
+			Expect(ok).To(BeTrue())
+			defer os.Remove(path)
+			Expect(os.ReadFile(path)).To(Equal([]byte("the-file-content")))
+			Expect(cache.ContainsKey("key")).To(BeFalse())
+			Expect(cache.UsedBytes()).To(BeZero())
+
+			Expect(cache.Clear(logger)).To(Succeed())
+			Expect(path).To(BeAnExistingFile())
+		})
+
+		It("archives an expanded directory back into a file", func() {
+			dirPath, err := cache.AddDirectory(logger, "key", sourceArchive.Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cache.CloseDirectory(logger, "key", dirPath)).To(Succeed())
+
+			path, ok := cache.Take(logger, "key")
+			Expect(ok).To(BeTrue())
+			defer os.Remove(path)
+			Expect(path).To(BeARegularFile())
+			Expect(dirPath).NotTo(BeADirectory())
+		})
+
+		It("does not take an entry that is in use", func() {
+			reader, err := cache.Add(logger, "key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			defer reader.Close()
+
+			_, ok := cache.Take(logger, "key")
+			Expect(ok).To(BeFalse())
+			Expect(cache.ContainsKey("key")).To(BeTrue())
+		})
+	})
+
+	Describe("Namespace", func() {
+		var tenantA, tenantB *cacheddownloader.Namespace
+
+		addTo := func(namespace *cacheddownloader.Namespace, cacheKey string, size int64) {
+			source := createSizedFile("cache-test-file", "the-file-content", size)
+			file, err := namespace.Add(logger, cacheKey, source.Name(), size, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(file.Close()).To(Succeed())
+		}
+
+		BeforeEach(func() {
+			cache = cacheddownloader.NewCache(cacheDir, 500)
+			tenantA = cache.Namespace("a", 250)
+			tenantB = cache.Namespace("b", 250)
+		})
+
+		It("evicts only entries of the same namespace to stay under its limit", func() {
+			addTo(tenantA, "a-1", 100)
+			addTo(tenantB, "b-1", 100)
+			addTo(tenantA, "a-2", 100)
+			addTo(tenantA, "a-3", 100)
+
+			Expect(cache.Keys()).To(ConsistOf("b-1", "a-2", "a-3"))
+			Expect(tenantA.UsedBytes()).To(BeEquivalentTo(200))
+			Expect(tenantB.UsedBytes()).To(BeEquivalentTo(100))
+		})
+
+		It("does not evict anything for an add that fails", func() {
+			addTo(tenantA, "a-1", 100)
+			addTo(tenantA, "a-2", 100)
+
+			defer cacheddownloader.SetRename(func(oldpath, newpath string) error {
+				if !strings.Contains(newpath, "-staging-") {
+					return errors.New("rename failed")
+				}
+				return os.Rename(oldpath, newpath)
+			})()
+			source := createSizedFile("cache-test-file", "the-file-content", 100)
+			_, err := tenantA.Add(logger, "a-3", source.Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).To(MatchError("rename failed"))
+			Expect(cache.Keys()).To(ConsistOf("a-1", "a-2"))
+		})
+
+		It("still caps the entries of all namespaces with the cache's limit", func() {
+			tenantA = cache.Namespace("a", 400)
+			tenantB = cache.Namespace("b", 400)
+			addTo(tenantA, "a-1", 200)
+			addTo(tenantA, "a-2", 200)
+			addTo(tenantB, "b-1", 200)
+
+			Expect(cache.Keys()).To(ConsistOf("a-2", "b-1"))
+			Expect(cache.UsedBytes()).To(BeEquivalentTo(400))
+		})
+
+		It("applies a changed limit on the next add", func() {
+			addTo(tenantA, "a-1", 100)
+			addTo(tenantA, "a-2", 100)
+
+			tenantA = cache.Namespace("a", 150)
+			addTo(tenantA, "a-3", 50)
+
+			Expect(cache.Keys()).To(ConsistOf("a-2", "a-3"))
+		})
+
+		It("does not find entries of other namespaces", func() {
+			addTo(tenantA, "key", 100)
+
+			_, _, err := tenantB.Get(logger, "key")
+			Expect(err).To(Equal(cacheddownloader.EntryNotFound))
+			_, err = tenantB.Acquire(logger, "key")
+			Expect(err).To(Equal(cacheddownloader.EntryNotFound))
+
+			file, _, err := tenantA.Get(logger, "key")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(file.Close()).To(Succeed())
+
+			path, err := tenantA.Acquire(logger, "key")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cache.Release(logger, "key", path)).To(Succeed())
+		})
+
+		It("moves a key to the namespace that adds it last", func() {
+			addTo(tenantA, "key", 100)
+			addTo(tenantB, "key", 100)
+
+			Expect(tenantA.UsedBytes()).To(BeZero())
+			Expect(tenantB.UsedBytes()).To(BeEquivalentTo(100))
+		})
+	})
+
+	Describe("MarkMiss", func() {
+		It("reports a marked key as missing rather than unknown", func() {
+			Expect(cache.Lookup("key")).To(Equal(cacheddownloader.KeyUnknown))
+
+			cache.MarkMiss("key", time.Minute)
+			Expect(cache.Lookup("key")).To(Equal(cacheddownloader.KeyMissing))
+			Expect(cache.ContainsKey("key")).To(BeFalse())
+			Expect(cache.UsedBytes()).To(BeZero())
+		})
+
+		It("forgets the mark once it expires", func() {
+			cache.MarkMiss("key", time.Nanosecond)
+			Eventually(func() cacheddownloader.KeyStatus {
+				return cache.Lookup("key")
+			}).Should(Equal(cacheddownloader.KeyUnknown))
+		})
+
+		It("clears the mark when an entry is added for the key", func() {
+			cache.MarkMiss("key", time.Minute)
+
+			reader, err := cache.Add(logger, "key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+
+			Expect(cache.Lookup("key")).To(Equal(cacheddownloader.KeyCached))
+			Expect(cache.Remove(logger, "key")).To(Succeed())
+			Expect(cache.Lookup("key")).To(Equal(cacheddownloader.KeyUnknown))
+		})
+	})
+
+	Describe("NewCacheWithValidation", func() {
+		It("creates a missing cache directory", func() {
+			dir := filepath.Join(cacheDir, "nested", "cache")
+
+			validated, err := cacheddownloader.NewCacheWithValidation(dir, maxSizeInBytes)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(validated.Dir()).To(Equal(dir))
+			Expect(dir).To(BeADirectory())
+			Expect(os.ReadDir(dir)).To(BeEmpty())
+		})
+
+		It("fails if the directory cannot be created", func() {
+			validated, err := cacheddownloader.NewCacheWithValidation(filepath.Join(sourceFile.Name(), "cache"), maxSizeInBytes)
+			Expect(err).To(HaveOccurred())
+			Expect(validated).To(BeNil())
+		})
+	})
+
+	Describe("Migrate", func() {
+		BeforeEach(func() {
+			for _, cacheKey := range []string{"key-1", "key-2"} {
+				source := createSizedFile("cache-test-file", "content-"+cacheKey, 100)
+				reader, err := cache.Add(logger, cacheKey, source.Name(), 100, cacheddownloader.CachingInfoType{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(reader.Close()).To(Succeed())
+			}
+		})
+
+		It("renames the cached files after the new scheme", func() {
+			oldPath := cache.Entries["key-1"].FilePath
+
+			Expect(cache.Migrate(logger, func(cacheKey, sourceBase string) string {
+				return "migrated-" + cacheKey
+			})).To(Succeed())
+
+			Expect(oldPath).NotTo(BeAnExistingFile())
+			Expect(filepath.Base(cache.Entries["key-1"].FilePath)).To(HavePrefix("migrated-key-1-"))
+			Expect(filepath.Base(cache.Entries["key-2"].FilePath)).To(HavePrefix("migrated-key-2-"))
+			Expect(filenamesInDir(cacheDir)).To(HaveLen(2))
+
+			reader, _, err := cache.Get(logger, "key-1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(io.ReadAll(reader)).To(Equal([]byte(sizedContent("content-key-1", 100))))
+			Expect(reader.Close()).To(Succeed())
+
+			source := createSizedFile("cache-test-file", "content", 100)
+			reader, err = cache.Add(logger, "key-3", source.Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+			Expect(filepath.Base(cache.Entries["key-3"].FilePath)).To(HavePrefix("migrated-key-3-"))
+		})
+
+		It("keeps the old names of files that cannot be renamed and reports them", func() {
+			path, err := cache.Acquire(logger, "key-1")
+			Expect(err).NotTo(HaveOccurred())
+			defer cache.Release(logger, "key-1", path)
+
+			restore := cacheddownloader.SetRename(func(oldpath, newpath string) error {
+				return errors.New("rename failed")
+			})
+			defer restore()
+			oldPath := cache.Entries["key-2"].FilePath
+
+			err = cache.Migrate(logger, cacheddownloader.HashedFilename)
+			Expect(err).To(MatchError(ContainSubstring("could not migrate key-1")))
+			Expect(errors.Is(err, cacheddownloader.EntryInUseErr)).To(BeTrue())
+			Expect(err).To(MatchError(ContainSubstring("could not migrate key-2: rename failed")))
+
+			Expect(cache.Entries["key-1"].FilePath).To(Equal(path))
+			Expect(cache.Entries["key-2"].FilePath).To(Equal(oldPath))
+			Expect(oldPath).To(BeARegularFile())
+		})
+	})
+
+	Describe("MaxEntries", func() {
+		BeforeEach(func() {
+			cache.MaxEntries = 2
+		})
+
+		It("evicts the least recently used entries beyond the limit", func() {
+			add("key-1")
+			add("key-2")
+			add("key-3")
+			Expect(cache.Keys()).To(ConsistOf("key-2", "key-3"))
+			Expect(cache.Len()).To(Equal(2))
+		})
+
+		It("does not evict anything to replace an entry", func() {
+			add("key-1")
+			add("key-2")
+			add("key-1")
+			Expect(cache.Keys()).To(ConsistOf("key-1", "key-2"))
+		})
+
+		It("reports the entries it evicted", func() {
+			add("key-1")
+			add("key-2")
+
+			source := createFile("cache-test-file", "c")
+			result, err := cache.AddWithResult(logger, "key-3", source.Name(), 1, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.File.Close()).To(Succeed())
+			Expect(result.Evicted).To(Equal([]string{"key-1"}))
+		})
+
+		It("is unlimited when zero", func() {
+			cache.MaxEntries = 0
+			for i := 0; i < 5; i++ {
+				add(fmt.Sprintf("key-%d", i))
+			}
+			Expect(cache.Len()).To(Equal(5))
+		})
+
+		It("does not evict anything for an add that fails", func() {
+			add("key-1")
+			add("key-2")
+
+			_, err := cache.AddDirectory(logger, "key-3", createSizedFile("cache-test-file", "not-a-tarball", 13).Name(), 13, cacheddownloader.CachingInfoType{})
+			Expect(err).To(HaveOccurred())
+			Expect(cache.Keys()).To(ConsistOf("key-1", "key-2"))
+		})
+	})
+
+	Describe("Durable", func() {
+		var synced []string
+
+		BeforeEach(func() {
+			synced = nil
+			cache.Durable = true
+		})
+
+		It("flushes added files to disk", func() {
+			restore := cacheddownloader.SetSyncFile(func(file *os.File) error {
+				synced = append(synced, file.Name())
+				return file.Sync()
+			})
+			defer restore()
+
+			reader, err := cache.Add(logger, "key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+			Expect(synced).To(Equal([]string{cache.Entries["key"].FilePath}))
+		})
+
+		It("fails the add and restores the source if the file cannot be flushed", func() {
+			restore := cacheddownloader.SetSyncFile(func(file *os.File) error {
+				return errors.New("sync failed")
+			})
+			defer restore()
+
+			_, err := cache.Add(logger, "key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).To(MatchError("sync failed"))
+			Expect(cache.ContainsKey("key")).To(BeFalse())
+			Expect(sourceFile.Name()).To(BeARegularFile())
+			Expect(filenamesInDir(cacheDir)).To(BeEmpty())
+		})
+
+		It("does not flush when unset", func() {
+			cache.Durable = false
+			restore := cacheddownloader.SetSyncFile(func(file *os.File) error {
+				synced = append(synced, file.Name())
+				return nil
+			})
+			defer restore()
+
+			reader, err := cache.Add(logger, "key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+			Expect(synced).To(BeEmpty())
+		})
+	})
+
+	Describe("Close", func() {
+		BeforeEach(func() {
+			reader, err := cache.Add(logger, "key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+		})
+
+		It("saves the metadata to StatePath", func() {
+			cache.StatePath = filepath.Join(cacheDir, "saved_cache.json")
+			Expect(cache.Close(logger)).To(Succeed())
+
+			restored := cacheddownloader.NewCache(cacheDir, maxSizeInBytes)
+			Expect(restored.Load(logger, cache.StatePath)).To(Succeed())
+			Expect(restored.Keys()).To(ConsistOf("key"))
+		})
+
+		It("stops the janitors", func() {
+			stop := cache.StartJanitor(logger, time.Millisecond)
+			Expect(cache.Close(logger)).To(Succeed())
+			Expect(stop).NotTo(Panic())
+
+			Expect(cache.StartJanitor(logger, time.Millisecond)).NotTo(Panic())
+		})
+
+		It("fails later operations with ClosedErr", func() {
+			Expect(cache.Close(logger)).To(Succeed())
+
+			source := createFile("cache-test-file", "content")
+			defer os.Remove(source.Name())
+			_, err := cache.Add(logger, "other", source.Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).To(Equal(cacheddownloader.ClosedErr))
+			Expect(source.Name()).To(BeARegularFile())
+
+			_, _, err = cache.Get(logger, "key")
+			Expect(err).To(Equal(cacheddownloader.ClosedErr))
+			_, err = cache.Acquire(logger, "key")
+			Expect(err).To(Equal(cacheddownloader.ClosedErr))
+			Expect(cache.Remove(logger, "key")).To(Equal(cacheddownloader.ClosedErr))
+			Expect(cache.Save(logger, filepath.Join(cacheDir, "saved_cache.json"))).To(Equal(cacheddownloader.ClosedErr))
+			Expect(cache.ContainsKey("key")).To(BeTrue())
+		})
+
+		It("leaves the entries alone on later changes", func() {
+			info, err := cache.Info("key")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cache.Close(logger)).To(Succeed())
+
+			Expect(cache.SetMaxSize(logger, 0)).To(BeZero())
+			Expect(info.FilePath).To(BeARegularFile())
+			Expect(cache.Pin("key")).To(BeFalse())
+			Expect(cache.UpdateInfo("key", cacheddownloader.CachingInfoType{ETag: "etag"})).To(BeFalse())
+			_, ok := cache.Touch("key")
+			Expect(ok).To(BeFalse())
+			cache.MarkMiss("other", time.Minute)
+			Expect(cache.Lookup("other")).To(Equal(cacheddownloader.KeyUnknown))
+			_, err = cache.RemoveFileIfUntracked(logger, filepath.Join(cacheDir, "untracked"))
+			Expect(err).To(Equal(cacheddownloader.ClosedErr))
+
+			Expect(cache.Keys()).To(ConsistOf("key"))
+			Expect(cache.Info("key")).To(Equal(info))
+		})
+
+		It("can be called more than once", func() {
+			Expect(cache.Close(logger)).To(Succeed())
+			Expect(cache.Close(logger)).To(Succeed())
+		})
+	})
+
+	Describe("ReaderAt", func() {
+		It("returns EntryNotFound for an unknown key", func() {
+			_, _, _, err := cache.ReaderAt(logger, "unknown")
+			Expect(err).To(Equal(cacheddownloader.EntryNotFound))
+		})
+
+		It("reads ranges of the cached file until it is released", func() {
+			reader, err := cache.Add(logger, "key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+			cachedPath := cache.Entries["key"].FilePath
+
+			r, size, release, err := cache.ReaderAt(logger, "key")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(size).To(BeEquivalentTo(len("the-file-content")))
+			Expect(io.ReadAll(io.NewSectionReader(r, 4, 4))).To(Equal([]byte("file")))
+
+			Expect(cache.Remove(logger, "key")).To(Succeed())
+			Expect(cachedPath).To(BeAnExistingFile())
+
+			release()
+			release()
+			Expect(cachedPath).NotTo(BeAnExistingFile())
+		})
+
+		It("reads the decompressed content of a compressed cache", func() {
+			cache = cacheddownloader.NewCacheWithCompression(cacheDir, maxSizeInBytes)
+			reader, err := cache.Add(logger, "key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+
+			r, size, release, err := cache.ReaderAt(logger, "key")
+			Expect(err).NotTo(HaveOccurred())
+			defer release()
+			Expect(io.ReadAll(io.NewSectionReader(r, 0, size))).To(Equal([]byte("the-file-content")))
+		})
+	})
+
+	Describe("EvictionAgeHistogram", func() {
+		BeforeEach(func() {
+			cache = cacheddownloader.NewCache(cacheDir, 200)
+		})
+
+		It("passes the age of evicted entries to OnEviction", func() {
+			var evictions []cacheddownloader.Eviction
+			cache.OnEviction = func(eviction cacheddownloader.Eviction) {
+				evictions = append(evictions, eviction)
+			}
+
+			add("key-1")
+			cache.Entries["key-1"].Access = time.Now().Add(-2 * time.Hour)
+			Expect(cache.Remove(logger, "key-1")).To(Succeed())
+
+			Expect(evictions).To(HaveLen(1))
+			Expect(evictions[0].CacheKey).To(Equal("key-1"))
+			Expect(evictions[0].Size).To(BeEquivalentTo(100))
+			Expect(evictions[0].Reason).To(Equal(cacheddownloader.EvictReasonRemoved))
+			Expect(evictions[0].Age).To(BeNumerically("~", 2*time.Hour, time.Minute))
+		})
+
+		It("buckets the ages of entries evicted to make room", func() {
+			add("key-1")
+			add("key-2")
+			cache.Entries["key-1"].Access = time.Now().Add(-2 * time.Hour)
+			add("key-3")
+			add("key-4")
+			Expect(cache.Remove(logger, "key-3")).To(Succeed())
+
+			histogram := cache.EvictionAgeHistogram()
+			Expect(histogram.Counts).To(HaveLen(len(histogram.Bounds) + 1))
+			Expect(histogram.Bounds[0]).To(Equal(time.Minute))
+			Expect(histogram.Counts[0]).To(BeEquivalentTo(1))
+			Expect(histogram.Bounds[3]).To(Equal(6 * time.Hour))
+			Expect(histogram.Counts[3]).To(BeEquivalentTo(1))
+
+			total := uint64(0)
+			for _, count := range histogram.Counts {
+				total += count
+			}
+			Expect(total).To(BeEquivalentTo(2))
+		})
+	})
+
+	Describe("RemoveWithResult", func() {
+		It("reports that nothing was removed for an unknown key", func() {
+			removed, freed, err := cache.RemoveWithResult(logger, "unknown")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(removed).To(BeFalse())
+			Expect(freed).To(BeZero())
+		})
+
+		It("reports the bytes freed by removing the entry", func() {
+			reader, err := cache.Add(logger, "key", createSizedFile("cache-test-file", "content", 100).Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+
+			removed, freed, err := cache.RemoveWithResult(logger, "key")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(removed).To(BeTrue())
+			Expect(freed).To(BeEquivalentTo(100))
+		})
+
+		It("does not count content still shared with another entry as freed", func() {
+			cache.Deduplicate = true
+			for _, cacheKey := range []string{"key-1", "key-2"} {
+				source := createSizedFile("cache-test-file", "same-content", 100)
+				reader, err := cache.Add(logger, cacheKey, source.Name(), 100, cacheddownloader.CachingInfoType{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(reader.Close()).To(Succeed())
+			}
+
+			removed, freed, err := cache.RemoveWithResult(logger, "key-1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(removed).To(BeTrue())
+			Expect(freed).To(BeZero())
+
+			_, freed, err = cache.RemoveWithResult(logger, "key-2")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(freed).To(BeEquivalentTo(100))
+		})
+	})
+
+	Describe("ExtractTo", func() {
+		var destDir string
+
+		addArchive := func(cacheKey, path string) {
+			reader, err := cache.Add(logger, cacheKey, path, 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+		}
+
+		BeforeEach(func() {
+			destDir = filepath.Join(cacheDir, "dest")
+		})
+
+		It("extracts a tar archive and keeps it cached", func() {
+			addArchive("key", createTarEntries(archiveEntry{name: "testdir/file.txt", content: "Data in Test File"}).Name())
+
+			Expect(cache.ExtractTo(logger, "key", destDir)).To(Succeed())
+			Expect(os.ReadFile(filepath.Join(destDir, "testdir", "file.txt"))).To(Equal([]byte("Data in Test File")))
+			Expect(cache.ContainsKey("key")).To(BeTrue())
+			Expect(cache.Entries["key"].FilePath).To(BeARegularFile())
+		})
+
+		It("extracts a gzipped tar archive", func() {
+			addArchive("key", createTgz(createTarEntries(archiveEntry{name: "diego.txt", content: "Vizzini"}).Name()).Name())
+
+			Expect(cache.ExtractTo(logger, "key", destDir)).To(Succeed())
+			Expect(filepath.Join(destDir, "diego.txt")).To(BeARegularFile())
+		})
+
+		It("extracts a zip archive", func() {
+			addArchive("key", createZip(map[string]string{"dir/file.txt": "zipped"}).Name())
+
+			Expect(cache.ExtractTo(logger, "key", destDir)).To(Succeed())
+			Expect(os.ReadFile(filepath.Join(destDir, "dir", "file.txt"))).To(Equal([]byte("zipped")))
+		})
+
+		It("extracts archives from a compressed cache", func() {
+			cache = cacheddownloader.NewCacheWithCompression(cacheDir, maxSizeInBytes)
+			addArchive("key", createZip(map[string]string{"file.txt": "zipped"}).Name())
+
+			Expect(cache.ExtractTo(logger, "key", destDir)).To(Succeed())
+			Expect(os.ReadFile(filepath.Join(destDir, "file.txt"))).To(Equal([]byte("zipped")))
+		})
+
+		It("rejects archives with entries outside the destination", func() {
+			addArchive("key", createZip(map[string]string{"ok.txt": "fine", "../escaped.txt": "evil"}).Name())
+
+			err := cache.ExtractTo(logger, "key", destDir)
+			Expect(errors.Is(err, cacheddownloader.UnsafeArchivePathErr)).To(BeTrue())
+			Expect(filepath.Join(destDir, "ok.txt")).NotTo(BeAnExistingFile())
+			Expect(filepath.Join(cacheDir, "escaped.txt")).NotTo(BeAnExistingFile())
+		})
+
+		It("extracts links that stay inside the destination", func() {
+			addArchive("key", createTarEntries(
+				archiveEntry{name: "dir/file.txt", content: "linked"},
+				archiveEntry{name: "link", symlink: "dir/file.txt"},
+				archiveEntry{name: "dir/link", symlink: "file.txt"},
+			).Name())
+
+			Expect(cache.ExtractTo(logger, "key", destDir)).To(Succeed())
+			Expect(os.ReadFile(filepath.Join(destDir, "link"))).To(Equal([]byte("linked")))
+			Expect(os.ReadFile(filepath.Join(destDir, "dir", "link"))).To(Equal([]byte("linked")))
+		})
+
+		DescribeTable("rejects tar archives with links out of the destination",
+			func(entries ...archiveEntry) {
+				addArchive("key", createTarEntries(entries...).Name())
+
+				err := cache.ExtractTo(logger, "key", destDir)
+				Expect(errors.Is(err, cacheddownloader.UnsafeArchivePathErr)).To(BeTrue())
+				Expect(destDir).NotTo(BeADirectory())
+			},
+			Entry("an absolute symlink", archiveEntry{name: "evil", symlink: "/tmp"}),
+			Entry("a symlink out of the destination", archiveEntry{name: "dir/evil", symlink: "../../x"}),
+			Entry("a hard link out of the destination", archiveEntry{name: "evil", hardlink: "../x"}),
+			Entry("an entry through a symlink",
+				archiveEntry{name: "dir/file.txt", content: "fine"},
+				archiveEntry{name: "evil", symlink: "dir"},
+				archiveEntry{name: "evil/payload", content: "evil"},
+			),
+			Entry("a hard link through a symlink",
+				archiveEntry{name: "dir/file.txt", content: "fine"},
+				archiveEntry{name: "evil", symlink: "dir"},
+				archiveEntry{name: "hardlink", hardlink: "evil/file.txt"},
+			),
+		)
+
+		DescribeTable("rejects zip archives with links out of the destination",
+			func(entries ...archiveEntry) {
+				addArchive("key", createZipEntries(entries...).Name())
+
+				err := cache.ExtractTo(logger, "key", destDir)
+				Expect(errors.Is(err, cacheddownloader.UnsafeArchivePathErr)).To(BeTrue())
+				Expect(destDir).NotTo(BeADirectory())
+			},
+			Entry("an absolute symlink", archiveEntry{name: "evil", symlink: "/tmp"}),
+			Entry("a symlink out of the destination", archiveEntry{name: "dir/evil", symlink: "../../x"}),
+			Entry("an entry through a symlink",
+				archiveEntry{name: "dir/file.txt", content: "fine"},
+				archiveEntry{name: "evil", symlink: "dir"},
+				archiveEntry{name: "evil/payload", content: "evil"},
+			),
+		)
+
+		It("rejects files that are not archives", func() {
+			addArchive("key", sourceFile.Name())
+			Expect(cache.ExtractTo(logger, "key", destDir)).To(Equal(cacheddownloader.UnsupportedArchiveErr))
+		})
+
+		It("returns EntryNotFound for an unknown key", func() {
+			Expect(cache.ExtractTo(logger, "unknown", destDir)).To(Equal(cacheddownloader.EntryNotFound))
+		})
+	})
+
+	Describe("NewCacheWithClock", func() {
+		var clock *fakeClock
+
+		BeforeEach(func() {
+			clock = &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+			cache = cacheddownloader.NewCacheWithClock(cacheDir, 200, clock)
+		})
+
+		It("expires entries when the clock passes their TTL", func() {
+			add("key", withTTL(time.Hour))
+			Expect(cache.ContainsKey("key")).To(BeTrue())
+
+			clock.Advance(59 * time.Minute)
+			Expect(cache.ContainsKey("key")).To(BeTrue())
+
+			clock.Advance(time.Minute)
+			Expect(cache.ContainsKey("key")).To(BeFalse())
+		})
+
+		It("combines with other options", func() {
+			cache = cacheddownloader.NewCache(cacheDir, 200, cacheddownloader.WithCompression(), cacheddownloader.WithClock(clock))
+			add("key", withTTL(time.Hour))
+			Expect(cache.Entries["key"].Compressed).To(BeTrue())
+
+			clock.Advance(time.Hour)
+			Expect(cache.ContainsKey("key")).To(BeFalse())
+		})
+
+		It("orders accesses by the clock", func() {
+			add("key-1")
+			clock.Advance(time.Second)
+			add("key-2")
+			Expect(cache.Entries["key-2"].Access).To(Equal(clock.Now()))
+
+			clock.Advance(time.Second)
+			reader, _, err := cache.Get(logger, "key-1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+
+			add("key-3")
+			Expect(cache.Keys()).To(ConsistOf("key-1", "key-3"))
+		})
+
+		It("expires MarkMiss marks by the clock", func() {
+			cache.MarkMiss("key", time.Minute)
+			clock.Advance(time.Minute)
+			Expect(cache.Lookup("key")).To(Equal(cacheddownloader.KeyUnknown))
+		})
+	})
+
+	Describe("AddBatch", func() {
+		item := func(cacheKey string) cacheddownloader.AddItem {
+			source := createSizedFile("cache-test-file", "content-"+cacheKey, 100)
+			return cacheddownloader.AddItem{CacheKey: cacheKey, SourcePath: source.Name(), Size: 100}
+		}
+
+		BeforeEach(func() {
+			cache = cacheddownloader.NewCache(cacheDir, 200)
+		})
+
+		It("adds every item and reports which were added", func() {
+			missing := cacheddownloader.AddItem{CacheKey: "missing", SourcePath: filepath.Join(cacheDir, "missing"), Size: 100}
+
+			added, err := cache.AddBatch(logger, []cacheddownloader.AddItem{item("key-1"), missing, item("key-2")})
+			Expect(err).To(MatchError(ContainSubstring("could not add missing")))
+			Expect(added).To(Equal([]bool{true, false, true}))
+			Expect(cache.Keys()).To(ConsistOf("key-1", "key-2"))
+
+			reader, _, err := cache.Get(logger, "key-2")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(io.ReadAll(reader)).To(Equal([]byte(sizedContent("content-key-2", 100))))
+			Expect(reader.Close()).To(Succeed())
+		})
+
+		It("makes room once, after replacing entries", func() {
+			_, err := cache.AddBatch(logger, []cacheddownloader.AddItem{item("key-1"), item("key-2")})
+			Expect(err).NotTo(HaveOccurred())
+
+			added, err := cache.AddBatch(logger, []cacheddownloader.AddItem{item("key-2")})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(added).To(Equal([]bool{true}))
+			Expect(cache.Keys()).To(ConsistOf("key-1", "key-2"))
+		})
+
+		It("evicts down to the limit at the end", func() {
+			added, err := cache.AddBatch(logger, []cacheddownloader.AddItem{item("key-1"), item("key-2"), item("key-3")})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(added).To(Equal([]bool{true, true, true}))
+			Expect(cache.Keys()).To(ConsistOf("key-2", "key-3"))
+			Expect(cache.UsedBytes()).To(BeEquivalentTo(200))
+		})
+
+		It("adds items for the same key in order", func() {
+			first, second := item("key"), item("key")
+			Expect(os.WriteFile(second.SourcePath, []byte("second"), 0600)).To(Succeed())
+
+			_, err := cache.AddBatch(logger, []cacheddownloader.AddItem{first, second})
+			Expect(err).NotTo(HaveOccurred())
+
+			reader, _, err := cache.Get(logger, "key")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(io.ReadAll(reader)).To(Equal([]byte("second")))
+			Expect(reader.Close()).To(Succeed())
+		})
+	})
+
+	Describe("Pin", func() {
+		BeforeEach(func() {
+			cache = cacheddownloader.NewCache(cacheDir, 200)
+			add("key-1")
+			add("key-2")
+		})
+
+		It("keeps pinned entries when making room", func() {
+			Expect(cache.Pin("key-1")).To(BeTrue())
+			add("key-3")
+			Expect(cache.Keys()).To(ConsistOf("key-1", "key-3"))
+			Expect(cache.UsedBytes()).To(BeEquivalentTo(200))
+		})
+
+		It("evicts entries again once unpinned", func() {
+			Expect(cache.Pin("key-1")).To(BeTrue())
+			Expect(cache.Unpin("key-1")).To(BeTrue())
+			add("key-3")
+			Expect(cache.Keys()).To(ConsistOf("key-2", "key-3"))
+		})
+
+		It("fails with CacheBusyErr when only pinned entries are left", func() {
+			Expect(cache.Pin("key-1")).To(BeTrue())
+			Expect(cache.Pin("key-2")).To(BeTrue())
+			_, err := cache.Add(logger, "key-3", createSizedFile("cache-test-file", "key-3", 100).Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).To(Equal(cacheddownloader.CacheBusyErr))
+			Expect(cache.Keys()).To(ConsistOf("key-1", "key-2"))
+		})
+
+		It("keeps the pin when the entry is replaced", func() {
+			Expect(cache.Pin("key-1")).To(BeTrue())
+			add("key-1")
+			add("key-3")
+			Expect(cache.Keys()).To(ConsistOf("key-1", "key-3"))
+		})
+
+		It("reports missing entries", func() {
+			Expect(cache.Pin("missing")).To(BeFalse())
+			Expect(cache.Unpin("missing")).To(BeFalse())
+		})
+
+		It("is saved with the entry", func() {
+			Expect(cache.Pin("key-1")).To(BeTrue())
+			statePath := filepath.Join(cacheDir, "state.json")
+			Expect(cache.Save(logger, statePath)).To(Succeed())
+
+			cache = cacheddownloader.NewCache(cacheDir, 200)
+			Expect(cache.Load(logger, statePath)).To(Succeed())
+			Expect(cache.Entries["key-1"].Pinned).To(BeTrue())
+			Expect(cache.Entries["key-2"].Pinned).To(BeFalse())
+		})
+	})
+
+	Describe("EntriesByLRU", func() {
+		It("lists entries in eviction order", func() {
+			clock := &fakeClock{now: time.Now()}
+			cache = cacheddownloader.NewCacheWithClock(cacheDir, 1000, clock)
+			for _, cacheKey := range []string{"key-1", "key-2", "key-3"} {
+				reader, err := cache.Add(logger, cacheKey, createSizedFile("cache-test-file", cacheKey, 100).Name(), 100, cacheddownloader.CachingInfoType{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(reader.Close()).To(Succeed())
+				clock.Advance(time.Second)
+			}
+			reader, _, err := cache.Get(logger, "key-1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+
+			keys := []string{}
+			for _, info := range cache.EntriesByLRU() {
+				keys = append(keys, info.CacheKey)
+			}
+			Expect(keys).To(Equal([]string{"key-2", "key-3", "key-1"}))
+
+			victims, _ := cache.WouldEvict(1000)
+			Expect(victims).To(Equal(keys))
+		})
+
+		It("breaks ties in access time by insertion order", func() {
+			clock := &fakeClock{now: time.Now()}
+			cache = cacheddownloader.NewCacheWithClock(cacheDir, 1000, clock)
+			for _, cacheKey := range []string{"key-b", "key-a"} {
+				reader, err := cache.Add(logger, cacheKey, createSizedFile("cache-test-file", cacheKey, 100).Name(), 100, cacheddownloader.CachingInfoType{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(reader.Close()).To(Succeed())
+			}
+
+			infos := cache.EntriesByLRU()
+			Expect(infos).To(HaveLen(2))
+			Expect(infos[0].CacheKey).To(Equal("key-b"))
+			Expect(infos[1].CacheKey).To(Equal("key-a"))
+		})
+	})
+
+	Describe("AddWithTags", func() {
+		It("keeps a copy of the tags with the entry", func() {
+			tags := map[string]string{"content-type": "application/gzip", "build": "42"}
+			reader, err := cache.AddWithTags(logger, "key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{}, tags)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+			tags["build"] = "43"
+
+			got, ok := cache.Tags("key")
+			Expect(ok).To(BeTrue())
+			Expect(got).To(Equal(map[string]string{"content-type": "application/gzip", "build": "42"}))
+
+			got["build"] = "44"
+			got, _ = cache.Tags("key")
+			Expect(got["build"]).To(Equal("42"))
+		})
+
+		It("has no tags for entries added without them", func() {
+			reader, err := cache.Add(logger, "key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+
+			got, ok := cache.Tags("key")
+			Expect(ok).To(BeTrue())
+			Expect(got).To(BeEmpty())
+
+			_, ok = cache.Tags("missing")
+			Expect(ok).To(BeFalse())
+		})
+
+		It("saves the tags with the entry", func() {
+			reader, err := cache.AddWithTags(logger, "key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{}, map[string]string{"origin": "https://example.com/a.tgz"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+			statePath := filepath.Join(cacheDir, "state.json")
+			Expect(cache.Save(logger, statePath)).To(Succeed())
+
+			cache = cacheddownloader.NewCache(cacheDir, maxSizeInBytes)
+			Expect(cache.Load(logger, statePath)).To(Succeed())
+			got, ok := cache.Tags("key")
+			Expect(ok).To(BeTrue())
+			Expect(got).To(Equal(map[string]string{"origin": "https://example.com/a.tgz"}))
+		})
+	})
+
+	Describe("NewTempCache", func() {
+		It("caches files in a temporary directory that Close removes", func() {
+			tempCache, err := cacheddownloader.NewTempCache(maxSizeInBytes)
+			Expect(err).NotTo(HaveOccurred())
+			dir := tempCache.Dir()
+			Expect(dir).To(BeADirectory())
+
+			reader, err := tempCache.Add(logger, "key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Name()).To(HavePrefix(dir))
+			Expect(reader.Close()).To(Succeed())
+
+			Expect(tempCache.Close(logger)).To(Succeed())
+			Expect(dir).NotTo(BeAnExistingFile())
+			Expect(tempCache.Close(logger)).To(Succeed())
+		})
+
+		It("creates a new directory for every cache", func() {
+			first, err := cacheddownloader.NewTempCache(maxSizeInBytes)
+			Expect(err).NotTo(HaveOccurred())
+			defer first.Close(logger)
+			second, err := cacheddownloader.NewTempCache(maxSizeInBytes)
+			Expect(err).NotTo(HaveOccurred())
+			defer second.Close(logger)
+
+			Expect(first.Dir()).NotTo(Equal(second.Dir()))
+		})
+	})
+
+	Describe("Fsck", func() {
+		BeforeEach(func() {
+			add("key-1", withExactContent("content-1"))
+			add("key-2", withExactContent("content-2"))
+		})
+
+		It("reports nothing for a consistent cache", func() {
+			report, err := cache.Fsck(logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(report).To(Equal(cacheddownloader.FsckReport{}))
+			Expect(cache.Keys()).To(ConsistOf("key-1", "key-2"))
+		})
+
+		It("drops entries whose file is missing", func() {
+			Expect(os.Remove(cache.Entries["key-1"].FilePath)).To(Succeed())
+
+			report, err := cache.Fsck(logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(report.MissingEntries).To(Equal([]string{"key-1"}))
+			Expect(cache.Keys()).To(ConsistOf("key-2"))
+			Expect(cache.UsedBytes()).To(BeEquivalentTo(len("content-2")))
+		})
+
+		It("removes cache files that no entry refers to", func() {
+			orphan := filepath.Join(cacheDir, "orphan-1-2")
+			Expect(os.WriteFile(orphan, []byte("orphan"), 0600)).To(Succeed())
+			state := filepath.Join(cacheDir, "saved_cache.json")
+			Expect(os.WriteFile(state, []byte("{}"), 0600)).To(Succeed())
+
+			report, err := cache.Fsck(logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(report.UntrackedFiles).To(Equal([]string{orphan}))
+			Expect(orphan).NotTo(BeAnExistingFile())
+			Expect(state).To(BeARegularFile())
+			Expect(cache.Entries["key-1"].FilePath).To(BeARegularFile())
+		})
+
+		It("corrects sizes that do not match the files", func() {
+			Expect(os.WriteFile(cache.Entries["key-2"].FilePath, []byte("grown-content-2"), 0600)).To(Succeed())
+
+			report, err := cache.Fsck(logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(report.ResizedEntries).To(Equal([]string{"key-2"}))
+			Expect(cache.Entries["key-2"].Size).To(BeEquivalentTo(len("grown-content-2")))
+			Expect(cache.UsedBytes()).To(BeEquivalentTo(len("content-1") + len("grown-content-2")))
+		})
+
+		It("evicts entries if the corrected sizes do not fit", func() {
+			cache.SetMaxSize(logger, int64(len("content-1")+len("content-2")))
+			Expect(os.WriteFile(cache.Entries["key-2"].FilePath, []byte("grown-content-2"), 0600)).To(Succeed())
+
+			report, err := cache.Fsck(logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(report.Evicted).To(Equal([]string{"key-1"}))
+			Expect(cache.Keys()).To(ConsistOf("key-2"))
+		})
+	})
+
+	Describe("ShardDepth", func() {
+		It("keeps files directly in the cache directory by default", func() {
+			add("key", withExactContent("key"))
+			Expect(filepath.Dir(cache.Entries["key"].FilePath)).To(Equal(cacheDir))
+		})
+
+		Context("when set", func() {
+			BeforeEach(func() {
+				cache.ShardDepth = 2
+			})
+
+			It("caches files in nested shard directories", func() {
+				add("key", withExactContent("key"))
+				path := cache.Entries["key"].FilePath
+				rel, err := filepath.Rel(cacheDir, path)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(filepath.ToSlash(rel)).To(MatchRegexp(`^[0-9a-f]{2}/[0-9a-f]{2}/key-\d+-\d+$`))
+
+				reader, _, err := cache.Get(logger, "key")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(io.ReadAll(reader)).To(Equal([]byte("key")))
+				Expect(reader.Close()).To(Succeed())
+			})
+
+			It("expands directories next to their file", func() {
+				dir, err := cache.AddDirectory(logger, "dir-key", sourceArchive.Name(), 100, cacheddownloader.CachingInfoType{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(filepath.Dir(dir)).To(Equal(filepath.Dir(cache.Entries["dir-key"].FilePath)))
+				Expect(filepath.Dir(dir)).NotTo(Equal(cacheDir))
+			})
+
+			It("walks the shards on Load", func() {
+				add("key", withExactContent("key"))
+				path := cache.Entries["key"].FilePath
+				orphan := filepath.Join(filepath.Dir(path), "orphan-1-2")
+				Expect(os.WriteFile(orphan, []byte("orphan"), 0600)).To(Succeed())
+				statePath := filepath.Join(cacheDir, "saved_cache.json")
+				Expect(cache.Save(logger, statePath)).To(Succeed())
+
+				cache = cacheddownloader.NewCache(cacheDir, maxSizeInBytes)
+				Expect(cache.Load(logger, statePath)).To(Succeed())
+				Expect(cache.Keys()).To(ConsistOf("key"))
+				Expect(path).To(BeARegularFile())
+				Expect(orphan).NotTo(BeAnExistingFile())
+			})
+
+			It("walks the shards on Fsck", func() {
+				add("key", withExactContent("key"))
+				path := cache.Entries["key"].FilePath
+				orphan := filepath.Join(filepath.Dir(path), "orphan-1-2")
+				Expect(os.WriteFile(orphan, []byte("orphan"), 0600)).To(Succeed())
+
+				report, err := cache.Fsck(logger)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(report.UntrackedFiles).To(Equal([]string{orphan}))
+				Expect(path).To(BeARegularFile())
+			})
+		})
+	})
+
+	Describe("Touch", func() {
+		It("returns the path and makes the entry the most recently used", func() {
+			clock := &fakeClock{now: time.Now()}
+			cache = cacheddownloader.NewCacheWithClock(cacheDir, 200, clock)
+			for _, cacheKey := range []string{"key-1", "key-2"} {
+				reader, err := cache.Add(logger, cacheKey, createSizedFile("cache-test-file", cacheKey, 100).Name(), 100, cacheddownloader.CachingInfoType{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(reader.Close()).To(Succeed())
+				clock.Advance(time.Second)
+			}
+
+			path, ok := cache.Touch("key-1")
+			Expect(ok).To(BeTrue())
+			Expect(path).To(Equal(cache.Entries["key-1"].FilePath))
+			Expect(path).To(BeARegularFile())
+
+			reader, err := cache.Add(logger, "key-3", createSizedFile("cache-test-file", "key-3", 100).Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+			Expect(cache.Keys()).To(ConsistOf("key-1", "key-3"))
+		})
+
+		It("does not create entries for missing keys", func() {
+			path, ok := cache.Touch("missing")
+			Expect(ok).To(BeFalse())
+			Expect(path).To(BeEmpty())
+			Expect(cache.ContainsKey("missing")).To(BeFalse())
+			Expect(cache.Len()).To(BeZero())
+		})
+
+		It("treats expired entries as missing", func() {
+			clock := &fakeClock{now: time.Now()}
+			cache = cacheddownloader.NewCacheWithClock(cacheDir, maxSizeInBytes, clock)
+			reader, err := cache.AddWithTTL(logger, "key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{}, time.Minute)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+			clock.Advance(time.Hour)
+
+			_, ok := cache.Touch("key")
+			Expect(ok).To(BeFalse())
+		})
+	})
+
+	Describe("ThrashDetected", func() {
+		var (
+			clock *fakeClock
+			rates []float64
+		)
+
+		BeforeEach(func() {
+			clock = &fakeClock{now: time.Now()}
+			rates = nil
+			cache = cacheddownloader.NewCacheWithClock(cacheDir, 100, clock)
+			cache.ThrashWindow = 10 * time.Second
+			cache.ThrashThreshold = 0.25
+			cache.ThrashDetected = func(rate float64) {
+				rates = append(rates, rate)
+			}
+			add("key-0")
+		})
+
+		It("is called once the eviction rate exceeds the threshold", func() {
+			add("key-1")
+			add("key-2")
+			Expect(rates).To(BeEmpty())
+
+			add("key-3")
+			Expect(rates).To(Equal([]float64{0.3}))
+		})
+
+		It("is called at most once per window", func() {
+			for i := 1; i <= 6; i++ {
+				clock.Advance(time.Second)
+				add(fmt.Sprintf("key-%d", i))
+			}
+			Expect(rates).To(HaveLen(1))
+
+			clock.Advance(10 * time.Second)
+			add("key-7")
+			Expect(rates).To(HaveLen(1))
+
+			for i := 8; i <= 10; i++ {
+				add(fmt.Sprintf("key-%d", i))
+			}
+			Expect(rates).To(HaveLen(2))
+		})
+
+		It("is not called for evictions that are not to make room", func() {
+			for i := 1; i <= 5; i++ {
+				Expect(cache.Remove(logger, "key-0")).To(Succeed())
+				add("key-0")
+			}
+			Expect(rates).To(BeEmpty())
+		})
+	})
+
+	Describe("adding a file that is already in the cache directory", func() {
+		var (
+			renames       [][2]string
+			restoreRename func()
+		)
+
+		BeforeEach(func() {
+			renames = nil
+			restoreRename = cacheddownloader.SetRename(func(oldpath, newpath string) error {
+				renames = append(renames, [2]string{oldpath, newpath})
+				return os.Rename(oldpath, newpath)
+			})
+		})
+
+		AfterEach(func() {
+			restoreRename()
+		})
+
+		It("renames it into place without staging it", func() {
+			tempFile, err := cache.TempFile("key")
+			Expect(err).NotTo(HaveOccurred())
+			_, err = tempFile.WriteString("content")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tempFile.Close()).To(Succeed())
+
+			reader, err := cache.Add(logger, "key", tempFile.Name(), 7, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+
+			cachedPath := cache.Entries["key"].FilePath
+			Expect(renames).To(Equal([][2]string{{tempFile.Name(), cachedPath}}))
+			Expect(tempFile.Name()).NotTo(BeAnExistingFile())
+			Expect(os.ReadFile(cachedPath)).To(Equal([]byte("content")))
+		})
+
+		It("does not rename it onto itself when it has the name the cache would pick", func() {
+			fixed := time.Unix(0, 1234)
+			defer cacheddownloader.SetNow(func() time.Time { return fixed })()
+			sourcePath := filepath.Join(cacheDir, fmt.Sprintf("key-%d-%d", fixed.UnixNano(), cache.Seq+1))
+			Expect(os.WriteFile(sourcePath, []byte("content"), 0600)).To(Succeed())
+
+			reader, err := cache.Add(logger, "key", sourcePath, 7, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+
+			cachedPath := cache.Entries["key"].FilePath
+			Expect(cachedPath).NotTo(Equal(sourcePath))
+			Expect(renames).To(Equal([][2]string{{sourcePath, cachedPath}}))
+			Expect(os.ReadFile(cachedPath)).To(Equal([]byte("content")))
+		})
+
+		It("leaves it where it was if the add fails", func() {
+			tempFile, err := cache.TempFile("key")
+			Expect(err).NotTo(HaveOccurred())
+			_, err = tempFile.WriteString("not an archive")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tempFile.Close()).To(Succeed())
+
+			_, err = cache.AddDirectory(logger, "key", tempFile.Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).To(HaveOccurred())
+			Expect(tempFile.Name()).To(BeARegularFile())
+			Expect(cache.Keys()).To(BeEmpty())
+		})
+	})
+
+	Describe("NewCacheWithTracer", func() {
+		It("traces adds, reads and evictions", func() {
+			tracer := &fakeTracer{}
+			cache = cacheddownloader.NewCacheWithTracer(cacheDir, 100, tracer)
+
+			reader, err := cache.Add(logger, "key-1", createSizedFile("cache-test-file", "key-1", 100).Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+			reader, _, err = cache.Get(logger, "key-1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+			reader, err = cache.Add(logger, "key-2", createSizedFile("cache-test-file", "key-2", 100).Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+
+			Expect(tracer.started).To(Equal([]string{"file-cache.add", "file-cache.get", "file-cache.add", "file-cache.evict"}))
+			Expect(tracer.ended).To(Equal([]string{"file-cache.add", "file-cache.get", "file-cache.evict", "file-cache.add"}))
+		})
+
+		It("traces adds however they are made and evictions under MaxEntries", func() {
+			tracer := &fakeTracer{}
+			cache = cacheddownloader.NewCacheWithTracer(cacheDir, 1000, tracer)
+			cache.MaxEntries = 1
+
+			added, _, err := cache.AddStream(logger, "key-1", strings.NewReader("key-1"), cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(added).To(BeTrue())
+			_, err = cache.AddBatch(logger, []cacheddownloader.AddItem{
+				{CacheKey: "key-2", SourcePath: createFile("cache-test-file", "key-2").Name(), Size: 5},
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(tracer.started).To(Equal([]string{"file-cache.add", "file-cache.add", "file-cache.evict"}))
+			Expect(tracer.ended).To(Equal([]string{"file-cache.add", "file-cache.evict", "file-cache.add"}))
+		})
+
+		It("does not need a tracer", func() {
+			cache = cacheddownloader.NewCacheWithTracer(cacheDir, 100, nil)
+			reader, err := cache.Add(logger, "key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+		})
+	})
+
+	Describe("BlockSize", func() {
+		BeforeEach(func() {
+			cache = cacheddownloader.NewCache(cacheDir, 4096*3)
+			cache.BlockSize = 4096
+		})
+
+		It("rounds the accounted sizes up to whole blocks", func() {
+			add("small")
+			add("exact", withSize(4096))
+			Expect(cache.Entries["small"].Size).To(BeEquivalentTo(4096))
+			Expect(cache.Entries["exact"].Size).To(BeEquivalentTo(4096))
+			Expect(cache.UsedBytes()).To(BeEquivalentTo(8192))
+		})
+
+		It("evicts by the rounded sizes", func() {
+			for _, cacheKey := range []string{"key-1", "key-2", "key-3", "key-4"} {
+				add(cacheKey)
+			}
+			Expect(cache.Keys()).To(ConsistOf("key-2", "key-3", "key-4"))
+			Expect(cache.UsedBytes()).To(BeEquivalentTo(4096 * 3))
+		})
+
+		It("keeps the rounded sizes through Fsck", func() {
+			add("key")
+
+			report, err := cache.Fsck(logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(report.ResizedEntries).To(BeEmpty())
+			Expect(cache.Entries["key"].Size).To(BeEquivalentTo(4096))
+		})
+	})
+
+	Describe("UpdateInfo", func() {
+		It("replaces the caching info without moving the file", func() {
+			reader, err := cache.Add(logger, "key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{ETag: "old-etag"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+			path := cache.Entries["key"].FilePath
+			access := cache.Entries["key"].Access
+
+			info := cacheddownloader.CachingInfoType{ETag: "new-etag", LastModified: "yesterday"}
+			Expect(cache.UpdateInfo("key", info)).To(BeTrue())
+
+			got, ok := cache.InfoOK("key")
+			Expect(ok).To(BeTrue())
+			Expect(got).To(Equal(info))
+			Expect(cache.Entries["key"].FilePath).To(Equal(path))
+			Expect(path).To(BeARegularFile())
+			Expect(cache.Entries["key"].Access).NotTo(BeTemporally("<", access))
+			Expect(cache.Entries["key"].AccessCount).To(BeEquivalentTo(2))
+		})
+
+		It("returns false for missing entries", func() {
+			Expect(cache.UpdateInfo("missing", cacheddownloader.CachingInfoType{ETag: "etag"})).To(BeFalse())
+			Expect(cache.ContainsKey("missing")).To(BeFalse())
+		})
+	})
+
+	Describe("AddOversized", func() {
+		BeforeEach(func() {
+			cache = cacheddownloader.NewCache(cacheDir, 100)
+			reader, err := cache.Add(logger, "existing", createSizedFile("cache-test-file", "existing", 100).Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+		})
+
+		It("adds files that fit like Add", func() {
+			reader, err := cache.AddOversized(logger, "key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+			Expect(cache.Keys()).To(ConsistOf("key"))
+		})
+
+		It("serves larger files from outside the cache until they are closed", func() {
+			reader, err := cache.AddOversized(logger, "key", sourceFile.Name(), 1000, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filepath.Dir(reader.Name())).To(Equal(filepath.Join(cacheDir, "oversized")))
+			Expect(sourceFile.Name()).NotTo(BeAnExistingFile())
+			Expect(io.ReadAll(reader)).To(Equal([]byte("the-file-content")))
+
+			Expect(cache.Keys()).To(ConsistOf("existing"))
+			Expect(cache.UsedBytes()).To(BeEquivalentTo(100))
+
+			Expect(reader.Close()).To(Succeed())
+			Expect(reader.Name()).NotTo(BeAnExistingFile())
+		})
+
+		It("leaves nothing behind after a restart", func() {
+			reader, err := cache.AddOversized(logger, "key", sourceFile.Name(), 1000, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			defer reader.Close()
+			statePath := filepath.Join(cacheDir, "saved_cache.json")
+			Expect(cache.Save(logger, statePath)).To(Succeed())
+
+			cache = cacheddownloader.NewCache(cacheDir, 100)
+			Expect(cache.Load(logger, statePath)).To(Succeed())
+			Expect(filepath.Join(cacheDir, "oversized")).NotTo(BeAnExistingFile())
+			Expect(cache.Keys()).To(ConsistOf("existing"))
+		})
+	})
+
+	Describe("EvictionOrder", func() {
+		var clock *fakeClock
+
+		BeforeEach(func() {
+			clock = &fakeClock{now: time.Now()}
+			cache = cacheddownloader.NewCacheWithClock(cacheDir, 1000, clock)
+			for _, cacheKey := range []string{"key-1", "key-2", "key-3", "key-4"} {
+				reader, err := cache.Add(logger, cacheKey, createSizedFile("cache-test-file", cacheKey, 100).Name(), 100, cacheddownloader.CachingInfoType{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(reader.Close()).To(Succeed())
+				clock.Advance(time.Second)
+			}
+		})
+
+		It("lists the keys in the order they would be evicted", func() {
+			_, ok := cache.Touch("key-1")
+			Expect(ok).To(BeTrue())
+
+			Expect(cache.EvictionOrder()).To(Equal([]string{"key-2", "key-3", "key-4", "key-1"}))
+			victims, _ := cache.WouldEvict(1000)
+			Expect(victims).To(Equal(cache.EvictionOrder()))
+		})
+
+		It("leaves out entries that cannot be evicted", func() {
+			reader, _, err := cache.Get(logger, "key-2")
+			Expect(err).NotTo(HaveOccurred())
+			defer reader.Close()
+			Expect(cache.Pin("key-3")).To(BeTrue())
+
+			Expect(cache.EvictionOrder()).To(Equal([]string{"key-1", "key-4"}))
+		})
+
+		It("is empty for an empty cache", func() {
+			cache = cacheddownloader.NewCache(cacheDir, 1000)
+			Expect(cache.EvictionOrder()).To(BeEmpty())
+		})
+	})
+
+	Describe("adding a source that is not a regular file", func() {
+		It("refuses the cache directory itself", func() {
+			_, err := cache.Add(logger, "key", cacheDir, 100, cacheddownloader.CachingInfoType{})
+			Expect(err).To(MatchError(cacheddownloader.InvalidSourceErr))
+			Expect(cacheDir).To(BeADirectory())
+			Expect(cache.Keys()).To(BeEmpty())
+		})
+
+		It("refuses a parent of the cache directory", func() {
+			parent := filepath.Dir(cacheDir)
+			_, err := cache.Add(logger, "key", parent, 100, cacheddownloader.CachingInfoType{})
+			Expect(err).To(MatchError(cacheddownloader.InvalidSourceErr))
+			Expect(cacheDir).To(BeADirectory())
+		})
+
+		It("refuses a symlink to a directory", func() {
+			dir, err := os.MkdirTemp("", "source-dir")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(dir)
+			link := filepath.Join(dir, "link")
+			Expect(os.Symlink(cacheDir, link)).To(Succeed())
+
+			_, err = cache.Add(logger, "key", link, 100, cacheddownloader.CachingInfoType{})
+			Expect(err).To(MatchError(cacheddownloader.InvalidSourceErr))
+			Expect(cacheDir).To(BeADirectory())
+		})
+
+		Context("when adding an expanded directory", func() {
+			It("refuses the cache directory and its parents", func() {
+				_, err := cache.AddExpandedDirectory(logger, "key", cacheDir, cacheddownloader.CachingInfoType{})
+				Expect(err).To(MatchError(cacheddownloader.InvalidSourceErr))
+				_, err = cache.AddExpandedDirectory(logger, "key", filepath.Dir(cacheDir), cacheddownloader.CachingInfoType{})
+				Expect(err).To(MatchError(cacheddownloader.InvalidSourceErr))
+				Expect(cacheDir).To(BeADirectory())
+				Expect(cache.Keys()).To(BeEmpty())
+			})
+
+			It("still adds other directories", func() {
+				dir, err := os.MkdirTemp("", "source-dir")
+				Expect(err).NotTo(HaveOccurred())
+				defer os.RemoveAll(dir)
+				Expect(os.WriteFile(filepath.Join(dir, "file"), []byte("content"), 0600)).To(Succeed())
+
+				_, err = cache.AddExpandedDirectory(logger, "key", dir, cacheddownloader.CachingInfoType{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(cache.Keys()).To(ConsistOf("key"))
+			})
+		})
+	})
+
+	Describe("NextVictim", func() {
+		var clock *fakeClock
+
+		BeforeEach(func() {
+			clock = &fakeClock{now: time.Now()}
+			cache = cacheddownloader.NewCacheWithClock(cacheDir, 1000, clock)
+			for _, cacheKey := range []string{"key-1", "key-2", "key-3"} {
+				reader, err := cache.Add(logger, cacheKey, createSizedFile("cache-test-file", cacheKey, 100).Name(), 100, cacheddownloader.CachingInfoType{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(reader.Close()).To(Succeed())
+				clock.Advance(time.Second)
+			}
+		})
+
+		It("returns the next victim without evicting it", func() {
+			cacheKey, size, ok := cache.NextVictim()
+			Expect(ok).To(BeTrue())
+			Expect(cacheKey).To(Equal("key-1"))
+			Expect(size).To(BeEquivalentTo(100))
+
+			Expect(cache.Keys()).To(ConsistOf("key-1", "key-2", "key-3"))
+			Expect(cache.EvictionOrder()).To(HaveExactElements("key-1", "key-2", "key-3"))
+		})
+
+		It("skips entries that are in use or pinned", func() {
+			reader, _, err := cache.Get(logger, "key-1")
+			Expect(err).NotTo(HaveOccurred())
+			defer reader.Close()
+			Expect(cache.Pin("key-2")).To(BeTrue())
+
+			cacheKey, _, ok := cache.NextVictim()
+			Expect(ok).To(BeTrue())
+			Expect(cacheKey).To(Equal("key-3"))
+		})
+
+		It("is not ok when nothing can be evicted", func() {
+			reader, _, err := cache.Get(logger, "key-1")
+			Expect(err).NotTo(HaveOccurred())
+			defer reader.Close()
+			Expect(cache.Pin("key-2")).To(BeTrue())
+			Expect(cache.Pin("key-3")).To(BeTrue())
+
+			_, _, ok := cache.NextVictim()
+			Expect(ok).To(BeFalse())
+		})
+	})
+
+	Describe("LastAccess", func() {
+		var clock *fakeClock
+
+		BeforeEach(func() {
+			clock = &fakeClock{now: time.Now()}
+			cache = cacheddownloader.NewCacheWithClock(cacheDir, 1000, clock)
+			reader, err := cache.Add(logger, "key", createSizedFile("cache-test-file", "content", 100).Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+		})
+
+		It("returns when the entry was last accessed", func() {
+			added := clock.Now()
+			access, ok := cache.LastAccess("key")
+			Expect(ok).To(BeTrue())
+			Expect(access).To(BeTemporally("==", added))
+
+			clock.Advance(time.Minute)
+			reader, _, err := cache.Get(logger, "key")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+
+			access, ok = cache.LastAccess("key")
+			Expect(ok).To(BeTrue())
+			Expect(access).To(BeTemporally("==", added.Add(time.Minute)))
+		})
+
+		It("does not count as an access", func() {
+			added, _ := cache.LastAccess("key")
+			clock.Advance(time.Minute)
+			access, _ := cache.LastAccess("key")
+			Expect(access).To(BeTemporally("==", added))
+		})
+
+		It("returns false for a missing key", func() {
+			_, ok := cache.LastAccess("missing")
+			Expect(ok).To(BeFalse())
+		})
+	})
+
+	Describe("MaxEntryBytes", func() {
+		BeforeEach(func() {
+			cache.MaxEntryBytes = 100
+		})
+
+		It("rejects files larger than it that would fit in the cache", func() {
+			sourceFile := createSizedFile("cache-test-file", "content", 101)
+			_, err := cache.Add(logger, "key", sourceFile.Name(), 101, cacheddownloader.CachingInfoType{})
+			Expect(err).To(MatchError(cacheddownloader.EntryTooLargeErr))
+			Expect(cache.Keys()).To(BeEmpty())
+			Expect(sourceFile.Name()).To(BeAnExistingFile())
+			Expect(filenamesInDir(cacheDir)).To(BeEmpty())
+		})
+
+		It("does not evict entries for a rejected file", func() {
+			reader, err := cache.Add(logger, "key-1", createSizedFile("cache-test-file", "content", 100).Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+
+			_, err = cache.Add(logger, "key-2", createSizedFile("cache-test-file", "content", 101).Name(), 101, cacheddownloader.CachingInfoType{})
+			Expect(err).To(MatchError(cacheddownloader.EntryTooLargeErr))
+			Expect(cache.Keys()).To(ConsistOf("key-1"))
+		})
+
+		It("accepts files up to it", func() {
+			reader, err := cache.Add(logger, "key", createSizedFile("cache-test-file", "content", 100).Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+			Expect(cache.Keys()).To(ConsistOf("key"))
+		})
+	})
+
+	Describe("Events", func() {
+		var clock *fakeClock
+
+		BeforeEach(func() {
+			clock = &fakeClock{now: time.Now()}
+			cache = cacheddownloader.NewCacheWithClock(cacheDir, 200, clock)
+		})
+
+		It("streams adds, hits, misses and evictions", func() {
+			events := cache.Events()
+
+			reader, err := cache.Add(logger, "key-1", createSizedFile("cache-test-file", "content", 100).Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+			reader, _, err = cache.Get(logger, "key-1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+			_, _, err = cache.Get(logger, "missing")
+			Expect(err).To(Equal(cacheddownloader.EntryNotFound))
+			Expect(cache.Remove(logger, "key-1")).To(Succeed())
+
+			Expect(<-events).To(Equal(cacheddownloader.CacheEvent{Type: cacheddownloader.EventAdd, CacheKey: "key-1", Size: 100, Time: clock.Now()}))
+			Expect(<-events).To(Equal(cacheddownloader.CacheEvent{Type: cacheddownloader.EventHit, CacheKey: "key-1", Size: 100, Time: clock.Now()}))
+			Expect(<-events).To(Equal(cacheddownloader.CacheEvent{Type: cacheddownloader.EventMiss, CacheKey: "missing", Time: clock.Now()}))
+			Expect(<-events).To(Equal(cacheddownloader.CacheEvent{Type: cacheddownloader.EventEvict, CacheKey: "key-1", Size: 100, Time: clock.Now()}))
+			Expect(events).NotTo(Receive())
+			Expect(cache.DroppedEvents()).To(BeZero())
+		})
+
+		It("returns the same channel every time", func() {
+			Expect(cache.Events()).To(Equal(cache.Events()))
+		})
+
+		It("drops and counts events once the channel is full", func() {
+			events := cache.Events()
+			for i := 0; i < cap(events)+3; i++ {
+				_, _, err := cache.Get(logger, "missing")
+				Expect(err).To(Equal(cacheddownloader.EntryNotFound))
+			}
+
+			Expect(events).To(HaveLen(cap(events)))
+			Expect(cache.DroppedEvents()).To(BeEquivalentTo(3))
+		})
+
+		It("closes the channel on Close", func() {
+			events := cache.Events()
+			_, _, err := cache.Get(logger, "missing")
+			Expect(err).To(Equal(cacheddownloader.EntryNotFound))
+			Expect(cache.Close(logger)).To(Succeed())
+
+			received := []cacheddownloader.CacheEvent{}
+			for event := range events {
+				received = append(received, event)
+			}
+			Expect(received).To(HaveLen(1))
+			Expect(cache.Events()).To(BeClosed())
+		})
+	})
+
+	Describe("FileMode and DirMode", func() {
+		mode := func(path string) os.FileMode {
+			info, err := os.Stat(path)
+			Expect(err).NotTo(HaveOccurred())
+			return info.Mode().Perm()
+		}
+
+		It("leaves the mode of cached files alone by default", func() {
+			sourceFile := createFile("cache-test-file", "content")
+			Expect(os.Chmod(sourceFile.Name(), 0644)).To(Succeed())
+
+			reader, err := cache.Add(logger, "key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			defer reader.Close()
+			Expect(mode(reader.Name())).To(Equal(os.FileMode(0644)))
+		})
+
+		Context("when they are set", func() {
+			BeforeEach(func() {
+				cache.FileMode = 0640
+				cache.DirMode = 0750
+			})
+
+			It("gives cached files FileMode", func() {
+				sourceFile := createFile("cache-test-file", "content")
+				Expect(os.Chmod(sourceFile.Name(), 0644)).To(Succeed())
+
+				reader, err := cache.Add(logger, "key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{})
+				Expect(err).NotTo(HaveOccurred())
+				defer reader.Close()
+				Expect(mode(reader.Name())).To(Equal(os.FileMode(0640)))
+			})
+
+			It("gives expanded directories DirMode and their files FileMode", func() {
+				dir, err := cache.AddDirectory(logger, "key", createArchive("cache-test-archive", "content").Name(), 100, cacheddownloader.CachingInfoType{})
+				Expect(err).NotTo(HaveOccurred())
+				defer cache.CloseDirectory(logger, "key", dir)
+
+				Expect(mode(dir)).To(Equal(os.FileMode(0750)))
+				Expect(mode(filepath.Join(dir, "testdir"))).To(Equal(os.FileMode(0750)))
+				Expect(mode(filepath.Join(dir, "testdir", "file.txt"))).To(Equal(os.FileMode(0640)))
+				Expect(mode(filepath.Join(dir, "diego.txt"))).To(Equal(os.FileMode(0640)))
+			})
+
+			It("applies them to added expanded directories", func() {
+				sourceDir, err := os.MkdirTemp("", "source-dir")
+				Expect(err).NotTo(HaveOccurred())
+				defer os.RemoveAll(sourceDir)
+				Expect(os.WriteFile(filepath.Join(sourceDir, "file"), []byte("content"), 0666)).To(Succeed())
+
+				dir, err := cache.AddExpandedDirectory(logger, "key", sourceDir, cacheddownloader.CachingInfoType{})
+				Expect(err).NotTo(HaveOccurred())
+				defer cache.CloseDirectory(logger, "key", dir)
+
+				Expect(mode(dir)).To(Equal(os.FileMode(0750)))
+				Expect(mode(filepath.Join(dir, "file"))).To(Equal(os.FileMode(0640)))
+			})
+		})
+	})
+
+	Describe("GetOrLoadByURL", func() {
+		var loads int32
+
+		loader := func(content string) func() (string, int64, cacheddownloader.CachingInfoType, error) {
+			return func() (string, int64, cacheddownloader.CachingInfoType, error) {
+				atomic.AddInt32(&loads, 1)
+				return createFile("cache-test-file", content).Name(), int64(len(content)), cacheddownloader.CachingInfoType{ETag: content}, nil
+			}
+		}
+
+		BeforeEach(func() {
+			atomic.StoreInt32(&loads, 0)
+		})
+
+		It("loads and acquires the file on a miss, recording its origin", func() {
+			path, err := cache.GetOrLoadByURL(logger, "key", "http://example.com/file", loader("loaded"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(os.ReadFile(path)).To(Equal([]byte("loaded")))
+			Expect(cache.Entries["key"].Origin).To(Equal("http://example.com/file"))
+			Expect(cache.Release(logger, "key", path)).To(Succeed())
+		})
+
+		Context("when another key is loading the same url", func() {
+			var restore func()
+
+			BeforeEach(func() {
+				restore = func() {}
+			})
+
+			AfterEach(func() {
+				restore()
+			})
+
+			getBoth := func() (string, string) {
+				events := cache.Events()
+				followerPath := make(chan string, 1)
+				leaderPath, err := cache.GetOrLoadByURL(logger, "key-1", "http://example.com/file", func() (string, int64, cacheddownloader.CachingInfoType, error) {
+					go func() {
+						defer GinkgoRecover()
+						path, err := cache.GetOrLoadByURL(logger, "key-2", "http://example.com/file", loader("reloaded"))
+						Expect(err).NotTo(HaveOccurred())
+						followerPath <- path
+					}()
+					Eventually(events).Should(Receive(HaveField("CacheKey", "key-2")))
+					time.Sleep(10 * time.Millisecond)
+					return loader("loaded")()
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				var path string
+				Eventually(followerPath).Should(Receive(&path))
+				return leaderPath, path
+			}
+
+			It("links the file it loaded into an entry for the other key", func() {
+				leaderPath, followerPath := getBoth()
+				defer cache.Release(logger, "key-1", leaderPath)
+				defer cache.Release(logger, "key-2", followerPath)
+
+				Expect(atomic.LoadInt32(&loads)).To(BeEquivalentTo(1))
+				Expect(followerPath).NotTo(Equal(leaderPath))
+				Expect(os.ReadFile(followerPath)).To(Equal([]byte("loaded")))
+
+				leaderInfo, err := os.Stat(leaderPath)
+				Expect(err).NotTo(HaveOccurred())
+				followerInfo, err := os.Stat(followerPath)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(os.SameFile(leaderInfo, followerInfo)).To(BeTrue())
+
+				Expect(cache.Entries["key-2"].Origin).To(Equal("http://example.com/file"))
+				Expect(cache.Entries["key-2"].CachingInfo.ETag).To(Equal("loaded"))
+			})
+
+			It("copies the file when it cannot be linked", func() {
+				restore = cacheddownloader.SetLink(func(oldname, newname string) error {
+					return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: syscall.EPERM}
+				})
+
+				leaderPath, followerPath := getBoth()
+				defer cache.Release(logger, "key-1", leaderPath)
+				defer cache.Release(logger, "key-2", followerPath)
+
+				Expect(atomic.LoadInt32(&loads)).To(BeEquivalentTo(1))
+				Expect(os.ReadFile(followerPath)).To(Equal([]byte("loaded")))
+
+				leaderInfo, err := os.Stat(leaderPath)
+				Expect(err).NotTo(HaveOccurred())
+				followerInfo, err := os.Stat(followerPath)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(os.SameFile(leaderInfo, followerInfo)).To(BeFalse())
+			})
+		})
+
+		It("does not share loads of different urls", func() {
+			path, err := cache.GetOrLoadByURL(logger, "key-1", "http://example.com/file-1", loader("loaded-1"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cache.Release(logger, "key-1", path)).To(Succeed())
+
+			path, err = cache.GetOrLoadByURL(logger, "key-2", "http://example.com/file-2", loader("loaded-2"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(os.ReadFile(path)).To(Equal([]byte("loaded-2")))
+			Expect(cache.Release(logger, "key-2", path)).To(Succeed())
+			Expect(atomic.LoadInt32(&loads)).To(BeEquivalentTo(2))
+		})
+
+		It("returns the loader's error", func() {
+			_, err := cache.GetOrLoadByURL(logger, "key", "http://example.com/file", func() (string, int64, cacheddownloader.CachingInfoType, error) {
+				return "", 0, cacheddownloader.CachingInfoType{}, errors.New("boom")
+			})
+			Expect(err).To(MatchError("boom"))
+			Expect(cache.ContainsKey("key")).To(BeFalse())
+		})
+	})
+
+	Describe("MeasuredSize", func() {
+		It("measures the file of the entry as it is now", func() {
+			reader, err := cache.Add(logger, "key", createSizedFile("cache-test-file", "content", 100).Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+			Expect(os.Truncate(cache.Entries["key"].FilePath, 50)).To(Succeed())
+
+			size, ok := cache.MeasuredSize("key")
+			Expect(ok).To(BeTrue())
+			Expect(size).To(BeEquivalentTo(50))
+			Expect(cache.Entries["key"].Size).To(BeEquivalentTo(100))
+		})
+
+		It("agrees with the accounted size when sizes are measured", func() {
+			reader, err := cache.Add(logger, "key", createSizedFile("cache-test-file", "content", 100).Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+
+			size, ok := cache.MeasuredSize("key")
+			Expect(ok).To(BeTrue())
+			Expect(size).To(Equal(cache.Entries["key"].Size))
+		})
+
+		It("measures the files of an expanded directory", func() {
+			sourceDir, err := os.MkdirTemp("", "source-dir")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(sourceDir)
+			Expect(os.MkdirAll(filepath.Join(sourceDir, "sub"), 0755)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(sourceDir, "file"), []byte("content"), 0600)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(sourceDir, "sub", "file"), []byte("more content"), 0600)).To(Succeed())
+
+			dir, err := cache.AddExpandedDirectory(logger, "key", sourceDir, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			defer cache.CloseDirectory(logger, "key", dir)
+
+			size, ok := cache.MeasuredSize("key")
+			Expect(ok).To(BeTrue())
+			Expect(size).To(BeEquivalentTo(len("content") + len("more content")))
+			Expect(size).To(Equal(cache.Entries["key"].Size))
+		})
+
+		It("returns false for a missing key", func() {
+			_, ok := cache.MeasuredSize("missing")
+			Expect(ok).To(BeFalse())
+		})
+	})
+
+	Describe("a cold tier", func() {
+		var tier *fakeColdTier
+
+		BeforeEach(func() {
+			tierDir, err := os.MkdirTemp("", "cold-tier")
+			Expect(err).NotTo(HaveOccurred())
+			tier = &fakeColdTier{dir: tierDir}
+			cache = cacheddownloader.NewCacheWithColdTier(cacheDir, 200, tier)
+
+			for _, cacheKey := range []string{"key-1", "key-2", "key-3"} {
+				reader, err := cache.Add(logger, cacheKey, createSizedFile("cache-test-file", "content-"+cacheKey, 100).Name(), 100, cacheddownloader.CachingInfoType{ETag: cacheKey})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(reader.Close()).To(Succeed())
+			}
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(tier.dir)
+		})
+
+		It("demotes entries evicted to make room", func() {
+			Expect(cache.Keys()).To(ConsistOf("key-2", "key-3"))
+			Expect(os.ReadFile(filepath.Join(tier.dir, "key-1"))).To(Equal([]byte(sizedContent("content-key-1", 100))))
+			Expect(filenamesInDir(cacheDir)).To(HaveLen(2))
+		})
+
+		It("promotes demoted entries on a miss", func() {
+			reader, cachingInfo, err := cache.Get(logger, "key-1")
+			Expect(err).NotTo(HaveOccurred())
+			defer reader.Close()
+			Expect(io.ReadAll(reader)).To(Equal([]byte(sizedContent("content-key-1", 100))))
+			Expect(cachingInfo.ETag).To(Equal("key-1"))
+
+			Expect(filepath.Join(tier.dir, "key-1")).NotTo(BeAnExistingFile())
+			Expect(cache.Keys()).To(ContainElement("key-1"))
+		})
+
+		It("still misses keys the tier does not have", func() {
+			_, _, err := cache.Get(logger, "missing")
+			Expect(err).To(Equal(cacheddownloader.EntryNotFound))
+		})
+
+		It("drops demoted content when the key is removed", func() {
+			Expect(cache.Remove(logger, "key-1")).To(Succeed())
+			Expect(filepath.Join(tier.dir, "key-1")).NotTo(BeAnExistingFile())
+
+			_, _, err := cache.Get(logger, "key-1")
+			Expect(err).To(Equal(cacheddownloader.EntryNotFound))
+		})
+
+		It("does not demote entries that are removed", func() {
+			Expect(cache.Remove(logger, "key-2")).To(Succeed())
+			Expect(filepath.Join(tier.dir, "key-2")).NotTo(BeAnExistingFile())
+		})
+
+		It("moves promoted content out of the tier without holding the lock", func() {
+			defer cacheddownloader.SetRename(func(oldpath, newpath string) error {
+				if strings.HasPrefix(oldpath, tier.dir) {
+					done := make(chan struct{})
+					go func() {
+						defer close(done)
+						cache.Len()
+					}()
+					Eventually(done).Should(BeClosed())
+				}
+				return os.Rename(oldpath, newpath)
+			})()
+
+			reader, _, err := cache.Get(logger, "key-1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+		})
+
+		It("leaves the content in the tier if it cannot be promoted", func() {
+			cache.MaxEntryBytes = 10
+			_, _, err := cache.Get(logger, "key-1")
+			Expect(err).To(Equal(cacheddownloader.EntryNotFound))
+			Expect(os.ReadFile(filepath.Join(tier.dir, "key-1"))).To(Equal([]byte(sizedContent("content-key-1", 100))))
+		})
+	})
+
+	Describe("AddWithDeadline", func() {
+		var readers []*cacheddownloader.CachedFile
+
+		BeforeEach(func() {
+			cache = cacheddownloader.NewCache(cacheDir, 200)
+			readers = nil
+			for _, cacheKey := range []string{"key-1", "key-2"} {
+				reader, err := cache.Add(logger, cacheKey, createSizedFile("cache-test-file", "content", 100).Name(), 100, cacheddownloader.CachingInfoType{})
+				Expect(err).NotTo(HaveOccurred())
+				readers = append(readers, reader)
+			}
+		})
+
+		AfterEach(func() {
+			for _, reader := range readers {
+				reader.Close()
+			}
+		})
+
+		It("fails with CacheBusyErr once the context is done", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+
+			sourceFile := createFile("cache-test-file", "content")
+			start := time.Now()
+			_, err := cache.AddWithDeadline(ctx, logger, "key-3", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).To(Equal(cacheddownloader.CacheBusyErr))
+			Expect(time.Since(start)).To(BeNumerically(">=", 50*time.Millisecond))
+			Expect(sourceFile.Name()).To(BeAnExistingFile())
+			Expect(cache.Keys()).To(ConsistOf("key-1", "key-2"))
+		})
+
+		It("adds the file once an entry is released", func() {
+			go func() {
+				defer GinkgoRecover()
+				time.Sleep(20 * time.Millisecond)
+				Expect(readers[0].Close()).To(Succeed())
+			}()
+
+			reader, err := cache.AddWithDeadline(context.Background(), logger, "key-3", createSizedFile("cache-test-file", "content", 100).Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+			Expect(cache.Keys()).To(ConsistOf("key-2", "key-3"))
+		})
+
+		It("adds the file once an entry is unpinned", func() {
+			Expect(readers[0].Close()).To(Succeed())
+			Expect(cache.Pin("key-1")).To(BeTrue())
+			go func() {
+				defer GinkgoRecover()
+				time.Sleep(20 * time.Millisecond)
+				Expect(cache.Unpin("key-1")).To(BeTrue())
+			}()
+
+			reader, err := cache.AddWithDeadline(context.Background(), logger, "key-3", createSizedFile("cache-test-file", "content", 100).Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+			Expect(cache.Keys()).To(ConsistOf("key-2", "key-3"))
+		})
+
+		It("adds the file once the cache is cleared", func() {
+			for _, cacheKey := range []string{"key-1", "key-2"} {
+				Expect(cache.Pin(cacheKey)).To(BeTrue())
+			}
+			for _, reader := range readers {
+				Expect(reader.Close()).To(Succeed())
+			}
+			go func() {
+				defer GinkgoRecover()
+				time.Sleep(20 * time.Millisecond)
+				Expect(cache.Clear(logger)).To(Succeed())
+			}()
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			reader, err := cache.AddWithDeadline(ctx, logger, "key-3", createSizedFile("cache-test-file", "content", 100).Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+			Expect(cache.Keys()).To(ConsistOf("key-3"))
+		})
+
+		It("fails straight away through Add", func() {
+			_, err := cache.Add(logger, "key-3", createSizedFile("cache-test-file", "content", 100).Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).To(Equal(cacheddownloader.CacheBusyErr))
+		})
+	})
+
+	Describe("validating cache keys", func() {
+		It("rejects empty and blank keys by default", func() {
+			for _, cacheKey := range []string{"", "  \t"} {
+				sourceFile := createSizedFile("cache-test-file", "content", 100)
+				_, err := cache.Add(logger, cacheKey, sourceFile.Name(), 100, cacheddownloader.CachingInfoType{})
+				Expect(err).To(Equal(cacheddownloader.EmptyCacheKeyErr))
+				Expect(sourceFile.Name()).To(BeAnExistingFile())
+			}
+			Expect(cache.Keys()).To(BeEmpty())
+			Expect(filenamesInDir(cacheDir)).To(BeEmpty())
+		})
+
+		It("rejects empty keys for expanded directories", func() {
+			sourceDir, err := os.MkdirTemp("", "source-dir")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(sourceDir)
+
+			_, err = cache.AddExpandedDirectory(logger, "", sourceDir, cacheddownloader.CachingInfoType{})
+			Expect(err).To(Equal(cacheddownloader.EmptyCacheKeyErr))
+			Expect(sourceDir).To(BeADirectory())
+		})
+
+		It("uses KeyValidator if set", func() {
+			cache.KeyValidator = func(cacheKey string) error {
+				if cacheKey != cacheddownloader.NormalizeKey(cacheKey) {
+					return errors.New("not normalized")
+				}
+				return nil
+			}
+
+			_, err := cache.Add(logger, " Key ", createFile("cache-test-file", "content").Name(), 7, cacheddownloader.CachingInfoType{})
+			Expect(err).To(MatchError("not normalized"))
+
+			reader, err := cache.Add(logger, "key", createFile("cache-test-file", "content").Name(), 7, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+			Expect(cache.Keys()).To(ConsistOf("key"))
+		})
+
+		It("agrees on keys that are the same once normalized", func() {
+			reader, err := cache.Add(logger, cacheddownloader.NormalizeKey(" Key "), createFile("cache-test-file", "first").Name(), 5, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+			reader, err = cache.Add(logger, cacheddownloader.NormalizeKey("KEY"), createFile("cache-test-file", "second").Name(), 6, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+
+			Expect(cache.Keys()).To(ConsistOf("key"))
+			reader, _, err = cache.Get(logger, cacheddownloader.NormalizeKey("key\n"))
+			Expect(err).NotTo(HaveOccurred())
+			defer reader.Close()
+			Expect(io.ReadAll(reader)).To(Equal([]byte("second")))
+		})
+	})
+
+	Describe("KeysWithContent", func() {
+		hashOf := func(content string) []byte {
+			hash := sha256.Sum256([]byte(content))
+			return hash[:]
+		}
+
+		BeforeEach(func() {
+			cache.Deduplicate = true
+			add("key-1", withExactContent("shared"))
+			add("key-2", withExactContent("shared"))
+			add("key-3", withExactContent("other"))
+		})
+
+		It("returns the keys of the entries with the content", func() {
+			Expect(cache.KeysWithContent(hashOf("shared"))).To(Equal([]string{"key-1", "key-2"}))
+			Expect(cache.KeysWithContent(hashOf("other"))).To(Equal([]string{"key-3"}))
+			Expect(cache.KeysWithContent(hashOf("missing"))).To(BeEmpty())
+		})
+
+		It("drops keys as their entries are removed or replaced", func() {
+			Expect(cache.Remove(logger, "key-1")).To(Succeed())
+			add("key-3", withExactContent("shared"))
+
+			Expect(cache.KeysWithContent(hashOf("shared"))).To(Equal([]string{"key-2", "key-3"}))
+			Expect(cache.KeysWithContent(hashOf("other"))).To(BeEmpty())
+		})
+
+		It("is empty for entries added without deduplication", func() {
+			cache.Deduplicate = false
+			add("key-4", withExactContent("plain"))
+			Expect(cache.KeysWithContent(hashOf("plain"))).To(BeEmpty())
+		})
+	})
+
+	Describe("when the cache directory is removed", func() {
+		BeforeEach(func() {
+			reader, err := cache.Add(logger, "key-1", createFile("cache-test-file", "content").Name(), 7, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+		})
+
+		It("recreates it and drops the entries that went with it", func() {
+			Expect(os.RemoveAll(cacheDir)).To(Succeed())
+
+			reader, err := cache.Add(logger, "key-2", createFile("cache-test-file", "content").Name(), 7, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			defer reader.Close()
+
+			Expect(cacheDir).To(BeADirectory())
+			Expect(cache.Keys()).To(ConsistOf("key-2"))
+			Expect(io.ReadAll(reader)).To(Equal([]byte("content")))
+		})
+
+		It("fails with CacheDirMissingErr if it cannot be recreated", func() {
+			Expect(os.RemoveAll(cacheDir)).To(Succeed())
+			parent := filepath.Join(cacheDir, "parent")
+			cache = cacheddownloader.NewCache(filepath.Join(parent, "cache"), 1000)
+			Expect(os.WriteFile(cacheDir, []byte("not a directory"), 0600)).To(Succeed())
+			defer os.Remove(cacheDir)
+
+			sourceFile := createSizedFile("cache-test-file", "content", 100)
+			_, err := cache.Add(logger, "key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).To(MatchError(cacheddownloader.CacheDirMissingErr))
+			Expect(sourceFile.Name()).To(BeAnExistingFile())
+		})
+	})
+
+	Describe("Evictor", func() {
+		Describe("NewLRUEvictor", func() {
+			var (
+				evictor cacheddownloader.Evictor
+				start   time.Time
+			)
+
+			victims := func() []string {
+				cacheKeys := []string{}
+				evictor.Victims(func(cacheKey string) bool {
+					cacheKeys = append(cacheKeys, cacheKey)
+					return true
+				})
+				return cacheKeys
+			}
+
+			BeforeEach(func() {
+				evictor = cacheddownloader.NewLRUEvictor()
+				start = time.Now()
+				for i, cacheKey := range []string{"key-1", "key-2", "key-3"} {
+					evictor.RecordAdd(cacheKey, cacheddownloader.EntryInfo{CacheKey: cacheKey, Access: start.Add(time.Duration(i) * time.Second)})
+				}
+			})
+
+			It("orders the keys from the least recently added or accessed", func() {
+				Expect(victims()).To(Equal([]string{"key-1", "key-2", "key-3"}))
+				evictor.RecordAccess("key-1")
+				Expect(victims()).To(Equal([]string{"key-2", "key-3", "key-1"}))
+			})
+
+			It("stops when visit returns false", func() {
+				visited := []string{}
+				evictor.Victims(func(cacheKey string) bool {
+					visited = append(visited, cacheKey)
+					return false
+				})
+				Expect(visited).To(Equal([]string{"key-1"}))
+			})
+
+			It("forgets removed keys", func() {
+				evictor.RecordRemove("key-1")
+				Expect(victims()).To(Equal([]string{"key-2", "key-3"}))
+			})
+
+			It("orders keys added out of order by their access time", func() {
+				evictor.RecordAdd("key-0", cacheddownloader.EntryInfo{CacheKey: "key-0", Access: start.Add(-time.Second)})
+				Expect(victims()).To(Equal([]string{"key-0", "key-1", "key-2", "key-3"}))
+			})
+
+			It("keeps the place of a key recounted with the same access time", func() {
+				access := start.Add(2 * time.Second)
+				evictor.RecordAdd("key-4", cacheddownloader.EntryInfo{CacheKey: "key-4", Access: access})
+				evictor.RecordAdd("key-3", cacheddownloader.EntryInfo{CacheKey: "key-3", Access: access.Round(0)})
+				Expect(victims()).To(Equal([]string{"key-1", "key-2", "key-3", "key-4"}))
+			})
+
+			It("orders keys with a lower cost per byte first", func() {
+				evictor.RecordAdd("key-1", cacheddownloader.EntryInfo{CacheKey: "key-1", Size: 10, Cost: 20, Access: start})
+				evictor.RecordAdd("key-4", cacheddownloader.EntryInfo{CacheKey: "key-4", Size: 10, Cost: 10, Access: start.Add(time.Hour)})
+				Expect(victims()).To(Equal([]string{"key-2", "key-3", "key-4", "key-1"}))
+
+				evictor.RecordRemove("key-4")
+				Expect(victims()).To(Equal([]string{"key-2", "key-3", "key-1"}))
+			})
+		})
+
+		Context("when the cache has an evictor", func() {
+			It("evicts the victims it picks", func() {
+				cache = cacheddownloader.NewCacheWithEvictor(cacheDir, 200, &mruEvictor{})
+				add("key-1")
+				add("key-2")
+				add("key-3")
+
+				Expect(cache.Keys()).To(ConsistOf("key-1", "key-3"))
+			})
+
+			It("evicts like the default policy with the LRU evictor", func() {
+				clock := &fakeClock{now: time.Now()}
+				defaultCache := cacheddownloader.NewCacheWithClock(cacheDir, 1000, clock)
+				cache = cacheddownloader.NewCache(cacheDir, 1000, cacheddownloader.WithClock(clock), cacheddownloader.WithEvictor(cacheddownloader.NewLRUEvictor()))
+				for _, c := range []*cacheddownloader.FileCache{defaultCache, cache} {
+					for _, cacheKey := range []string{"key-1", "key-2", "key-3", "key-4"} {
+						reader, err := c.Add(logger, cacheKey, createSizedFile("cache-test-file", "content", 100).Name(), 100, cacheddownloader.CachingInfoType{})
+						Expect(err).NotTo(HaveOccurred())
+						Expect(reader.Close()).To(Succeed())
+						clock.Advance(time.Second)
+					}
+					reader, _, err := c.Get(logger, "key-2")
+					Expect(err).NotTo(HaveOccurred())
+					Expect(reader.Close()).To(Succeed())
+					Expect(c.Pin("key-3")).To(BeTrue())
+				}
+
+				Expect(cache.EvictionOrder()).To(Equal([]string{"key-1", "key-4", "key-2"}))
+				Expect(cache.EvictionOrder()).To(Equal(defaultCache.EvictionOrder()))
+			})
+
+			It("walks the order of the evictor once to list the eviction order", func() {
+				evictor := &countingEvictor{Evictor: cacheddownloader.NewLRUEvictor()}
+				cache = cacheddownloader.NewCacheWithEvictor(cacheDir, 1000, evictor)
+				add("key-1")
+				add("key-2")
+				add("key-3")
+
+				Expect(cache.EvictionOrder()).To(Equal([]string{"key-1", "key-2", "key-3"}))
+				Expect(evictor.walks).To(Equal(1))
+			})
+		})
+	})
+
+	Describe("EvictFewest", func() {
+		evictionsForLargeAdd := func(evictFewest bool) []string {
+			clock := &fakeClock{now: time.Now()}
+			cache = cacheddownloader.NewCacheWithClock(cacheDir, 1000, clock)
+			cache.EvictFewest = evictFewest
+
+			sizes := []int64{50, 50, 300, 50, 50, 50, 50, 50, 50}
+			for i, size := range sizes {
+				reader, err := cache.Add(logger, fmt.Sprintf("key-%d", i), createSizedFile("cache-test-file", "content", size).Name(), size, cacheddownloader.CachingInfoType{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(reader.Close()).To(Succeed())
+				clock.Advance(time.Second)
+			}
+
+			evicted := []string{}
+			cache.OnEvict = func(cacheKey string, size int64, reason cacheddownloader.EvictReason) {
+				evicted = append(evicted, cacheKey)
+			}
+			reader, err := cache.Add(logger, "large", createSizedFile("cache-test-file", "content", 600).Name(), 600, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+			return evicted
+		}
+
+		It("evicts fewer entries than strict eviction order for a large add", func() {
+			Expect(evictionsForLargeAdd(false)).To(Equal([]string{"key-0", "key-1", "key-2"}))
+			Expect(evictionsForLargeAdd(true)).To(Equal([]string{"key-2"}))
+		})
+
+		It("only picks among the older half of the entries", func() {
+			clock := &fakeClock{now: time.Now()}
+			cache = cacheddownloader.NewCacheWithClock(cacheDir, 1000, clock)
+			cache.EvictFewest = true
+			for i, size := range []int64{100, 100, 100, 500} {
+				reader, err := cache.Add(logger, fmt.Sprintf("key-%d", i), createSizedFile("cache-test-file", "content", size).Name(), size, cacheddownloader.CachingInfoType{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(reader.Close()).To(Succeed())
+				clock.Advance(time.Second)
+			}
+
+			reader, err := cache.Add(logger, "large", createSizedFile("cache-test-file", "content", 500).Name(), 500, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+			Expect(cache.Keys()).To(ConsistOf("key-3", "large"))
+		})
+	})
+
+	Describe("StartAutosave", func() {
+		var stop func()
+
+		BeforeEach(func() {
+			cache.StatePath = filepath.Join(cacheDir, "saved_cache.json")
+		})
+
+		AfterEach(func() {
+			if stop != nil {
+				stop()
+			}
+		})
+
+		savedKeys := func() []string {
+			restored := cacheddownloader.NewCache(cacheDir, maxSizeInBytes)
+			Expect(restored.Load(logger, cache.StatePath)).To(Succeed())
+			return restored.Keys()
+		}
+
+		It("saves the metadata after it changes", func() {
+			stop = cache.StartAutosave(logger, 10*time.Millisecond)
+
+			reader, err := cache.Add(logger, "key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+
+			Eventually(cache.StatePath).Should(BeARegularFile())
+			Expect(savedKeys()).To(ConsistOf("key"))
+
+			Expect(cache.Remove(logger, "key")).To(Succeed())
+			Eventually(savedKeys).Should(BeEmpty())
+		})
+
+		It("does not save metadata that has not changed", func() {
+			reader, err := cache.Add(logger, "key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+
+			stop = cache.StartAutosave(logger, 10*time.Millisecond)
+			Eventually(cache.StatePath).Should(BeARegularFile())
+
+			Expect(os.Remove(cache.StatePath)).To(Succeed())
+			Consistently(cache.StatePath, 50*time.Millisecond).ShouldNot(BeAnExistingFile())
+		})
+
+		It("saves the paths of migrated files", func() {
+			reader, err := cache.Add(logger, "key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+			stop = cache.StartAutosave(logger, 10*time.Millisecond)
+			Eventually(cache.StatePath).Should(BeARegularFile())
+
+			Expect(cache.Migrate(logger, cacheddownloader.HashedFilename)).To(Succeed())
+			info, err := cache.Info("key")
+			Expect(err).NotTo(HaveOccurred())
+			savedState := func() string {
+				state, err := os.ReadFile(cache.StatePath)
+				Expect(err).NotTo(HaveOccurred())
+				return string(state)
+			}
+			Eventually(savedState).Should(ContainSubstring(info.FilePath))
+			stop()
+
+			restored := cacheddownloader.NewCache(cacheDir, maxSizeInBytes)
+			Expect(restored.Load(logger, cache.StatePath)).To(Succeed())
+			reader, _, err = restored.Get(logger, "key")
+			Expect(err).NotTo(HaveOccurred())
+			defer reader.Close()
+			Expect(io.ReadAll(reader)).To(Equal([]byte("the-file-content")))
+		})
+
+		It("is flushed by Close", func() {
+			stop = cache.StartAutosave(logger, time.Hour)
+
+			reader, err := cache.Add(logger, "key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+			Expect(cache.StatePath).NotTo(BeAnExistingFile())
+
+			Expect(cache.Close(logger)).To(Succeed())
+			Expect(savedKeys()).To(ConsistOf("key"))
+		})
+
+		It("does nothing without a StatePath", func() {
+			cache.StatePath = ""
+			stop = cache.StartAutosave(logger, time.Millisecond)
+
+			reader, err := cache.Add(logger, "key", sourceFile.Name(), 100, cacheddownloader.CachingInfoType{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.Close()).To(Succeed())
+			Consistently(filepath.Join(cacheDir, "saved_cache.json"), 20*time.Millisecond).ShouldNot(BeAnExistingFile())
+		})
+	})
+})
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+type fakeTracer struct {
+	started, ended []string
+}
+
+func (t *fakeTracer) StartSpan(name string) cacheddownloader.Span {
+	t.started = append(t.started, name)
+	return fakeSpan{tracer: t, name: name}
+}
+
+type fakeSpan struct {
+	tracer *fakeTracer
+	name   string
+}
+
+func (s fakeSpan) End() {
+	s.tracer.ended = append(s.tracer.ended, s.name)
+}
+
+// countingEvictor counts the walks of the order of the Evictor it wraps.
+type countingEvictor struct {
+	cacheddownloader.Evictor
+	walks int
+}
+
+func (e *countingEvictor) Victims(visit func(cacheKey string) bool) {
+	e.walks++
+	e.Evictor.Victims(visit)
+}
+
+// mruEvictor evicts the most recently added key.
+type mruEvictor struct {
+	cacheKeys []string
+}
+
+func (e *mruEvictor) RecordAdd(cacheKey string, entry cacheddownloader.EntryInfo) {
+	e.cacheKeys = append(e.cacheKeys, cacheKey)
+}
+
+func (e *mruEvictor) RecordAccess(cacheKey string) {}
+
+func (e *mruEvictor) RecordRemove(cacheKey string) {
+	for i, ck := range e.cacheKeys {
+		if ck == cacheKey {
+			e.cacheKeys = append(e.cacheKeys[:i], e.cacheKeys[i+1:]...)
+			return
+		}
+	}
+}
+
+func (e *mruEvictor) Victims(visit func(cacheKey string) bool) {
+	for i := len(e.cacheKeys) - 1; i >= 0; i-- {
+		if !visit(e.cacheKeys[i]) {
+			return
+		}
+	}
+}
+
+// fakeColdTier keeps demoted files in dir, named after their keys.
+type fakeColdTier struct {
+	dir string
+}
+
+func (t *fakeColdTier) Store(cacheKey, path string) error {
+	return os.Rename(path, filepath.Join(t.dir, cacheKey))
+}
+
+func (t *fakeColdTier) Fetch(cacheKey string) (string, bool, error) {
+	path := filepath.Join(t.dir, cacheKey)
+	_, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return "", false, nil
+	}
+	return path, err == nil, err
+}
+
+func (t *fakeColdTier) Remove(cacheKey string) {
+	os.Remove(filepath.Join(t.dir, cacheKey))
+}
+
+func createFile(filename string, content string) *os.File {
+	sourceFile, err := os.CreateTemp("", filename)
+	Expect(err).NotTo(HaveOccurred())
+	sourceFile.WriteString(content)
+	sourceFile.Close()
+
+	return sourceFile
+}
+
+// createSizedFile creates a file of size bytes starting with content, for
+// adds whose size matters to the cache's accounting.
+func createSizedFile(filename, content string, size int64) *os.File {
+	return createFile(filename, sizedContent(content, size))
+}
+
+// addSpec is the file added by the add fixture and how it is added.
+type addSpec struct {
+	content     string
+	size        int64
+	cachingInfo cacheddownloader.CachingInfoType
+	opts        cacheddownloader.AddOptions
+}
+
+// addOption changes what the add fixture adds.
+type addOption func(*addSpec)
+
+// withContent starts the added file with content.
+func withContent(content string) addOption {
+	return func(spec *addSpec) { spec.content = content }
+}
+
+// withExactContent makes the added file hold content and nothing else.
+func withExactContent(content string) addOption {
+	return func(spec *addSpec) { spec.content, spec.size = content, int64(len(content)) }
+}
+
+func withSize(size int64) addOption {
+	return func(spec *addSpec) { spec.size = size }
+}
+
+func withCachingInfo(cachingInfo cacheddownloader.CachingInfoType) addOption {
+	return func(spec *addSpec) { spec.cachingInfo = cachingInfo }
+}
+
+func withCost(cost float64) addOption {
+	return func(spec *addSpec) { spec.opts.Cost = cost }
+}
+
+func withTTL(ttl time.Duration) addOption {
+	return func(spec *addSpec) { spec.opts.TTL = ttl }
+}
+
+// sizedContent is the content of a file made by createSizedFile.
+func sizedContent(content string, size int64) string {
+	Expect(int64(len(content))).To(BeNumerically("<=", size))
+	return content + strings.Repeat(".", int(size)-len(content))
+}
+
+func fileSizeOf(file *os.File) int64 {
+	info, err := os.Stat(file.Name())
+	Expect(err).NotTo(HaveOccurred())
+	return info.Size()
+}
+
+func createTgz(tarPath string) *os.File {
+	tgzFile, err := os.CreateTemp("", "cache-test-tgz")
+	Expect(err).NotTo(HaveOccurred())
+	defer tgzFile.Close()
+
+	tarFile, err := os.Open(tarPath)
+	Expect(err).NotTo(HaveOccurred())
+	defer tarFile.Close()
+
+	gw := gzip.NewWriter(tgzFile)
+	_, err = io.Copy(gw, tarFile)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(gw.Close()).To(Succeed())
+	return tgzFile
+}
+
+func createZip(files map[string]string) *os.File {
+	zipFile, err := os.CreateTemp("", "cache-test-zip")
+	Expect(err).NotTo(HaveOccurred())
+	defer zipFile.Close()
+
+	zw := zip.NewWriter(zipFile)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = w.Write([]byte(content))
+		Expect(err).NotTo(HaveOccurred())
+	}
+	Expect(zw.Close()).To(Succeed())
+	return zipFile
+}
+
+// archiveEntry is an entry of an archive made by createTarEntries or
+// createZipEntries: a file with content, or a link when symlink or hardlink
+// is set.
+type archiveEntry struct {
+	name, content, symlink, hardlink string
+}
+
+func createTarEntries(entries ...archiveEntry) *os.File {
+	tarFile, err := os.CreateTemp("", "cache-test-tar")
+	Expect(err).NotTo(HaveOccurred())
+	defer tarFile.Close()
+
+	tw := tar.NewWriter(tarFile)
+	for _, entry := range entries {
+		hdr := &tar.Header{Name: entry.name, Mode: 0600, Typeflag: tar.TypeReg, Size: int64(len(entry.content))}
+		switch {
+		case entry.symlink != "":
+			hdr = &tar.Header{Name: entry.name, Mode: 0777, Typeflag: tar.TypeSymlink, Linkname: entry.symlink}
+		case entry.hardlink != "":
+			hdr = &tar.Header{Name: entry.name, Mode: 0600, Typeflag: tar.TypeLink, Linkname: entry.hardlink}
+		}
+		Expect(tw.WriteHeader(hdr)).To(Succeed())
+		_, err = tw.Write([]byte(entry.content))
+		Expect(err).NotTo(HaveOccurred())
+	}
+	Expect(tw.Close()).To(Succeed())
+	return tarFile
+}
+
+func createZipEntries(entries ...archiveEntry) *os.File {
+	zipFile, err := os.CreateTemp("", "cache-test-zip")
+	Expect(err).NotTo(HaveOccurred())
+	defer zipFile.Close()
+
+	zw := zip.NewWriter(zipFile)
+	for _, entry := range entries {
+		hdr := &zip.FileHeader{Name: entry.name, Method: zip.Deflate}
+		content := entry.content
+		hdr.SetMode(0600)
+		if entry.symlink != "" {
+			hdr.SetMode(os.ModeSymlink | 0777)
+			content = entry.symlink
+		}
+		w, err := zw.CreateHeader(hdr)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = w.Write([]byte(content))
+		Expect(err).NotTo(HaveOccurred())
+	}
+	Expect(zw.Close()).To(Succeed())
+	return zipFile
+}
+
+func createArchive(filename, sampleData string) *os.File {
+	sourceFile, err := os.CreateTemp("", filename)
+
+	Expect(err).NotTo(HaveOccurred())
+
+	// Create a new tar archive.
+	tw := tar.NewWriter(sourceFile)
+
+	// Add some files to the archive.
+	var files = []struct {
+		Name, Body string
+		Type       byte
+		Mode       int64
+	}{
+		{"bin/readme.txt", "This archive contains some text files.", tar.TypeReg, 0600},
+		{"diego.txt", "Diego names:\nVizzini\nGeoffrey\nPrincess Buttercup\n", tar.TypeReg, 0600},
+		{"testdir", "", tar.TypeDir, 0766},
+		{"testdir/file.txt", sampleData, tar.TypeReg, 0600},
+		{"testdir/fileLink.txt", "/diego.txt", tar.TypeSymlink, 0600},
+	}
+	for _, file := range files {
+		var hdr *tar.Header
+		if file.Type == tar.TypeSymlink {
+			hdr = &tar.Header{
+				Name:     file.Name,
+				Typeflag: file.Type,
+				Mode:     file.Mode,
+				Linkname: file.Body,
+			}
+			hdr.Mode &^= 040000 // c_ISDIR
+			hdr.Mode |= 0120000 // c_ISLNK
+		} else {
+			hdr = &tar.Header{
+				Name:     file.Name,
+				Typeflag: file.Type,
+				Mode:     file.Mode,
+				Size:     int64(len(file.Body)),
+			}
+		}
+		err := tw.WriteHeader(hdr)
+		Expect(err).NotTo(HaveOccurred())
+		if file.Type != tar.TypeSymlink {
+			_, err = tw.Write([]byte(file.Body))
+			Expect(err).NotTo(HaveOccurred())
+		}
+	}
+	// Make sure to check the error on Close.
+	err = tw.Close()
+	Expect(err).NotTo(HaveOccurred())
+	err = sourceFile.Close()
+	Expect(err).NotTo(HaveOccurred())
+	return sourceFile
+}
+
+func filenamesInDir(dir string) []string {
+	entries, err := os.ReadDir(dir)
+	Expect(err).NotTo(HaveOccurred())
+
+	result := []string{}
+	for _, entry := range entries {
+		result = append(result, entry.Name())
+	}
+
+	return result
+}
+
+func recursiveList(dir string) []string {
+	paths := []string{}
+	filepath.Walk(dir, func(path string, _ os.FileInfo, _ error) error {
+		path = strings.TrimPrefix(path, dir)
+		if path != "" {
+			paths = append(paths, filepath.ToSlash(path))
+		}
+		return nil
+	})
+	return paths
+}
+
+func BenchmarkFileCacheStats(b *testing.B) {
+	cacheDir, err := os.MkdirTemp("", "cache-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	logger := lager.NewLogger("bench")
+	cache := cacheddownloader.NewCache(cacheDir, 1024*1024)
+	for i := 0; i < 100; i++ {
+		source, err := os.CreateTemp("", "cache-bench-file")
+		if err != nil {
+			b.Fatal(err)
+		}
+		source.Close()
+
+		reader, err := cache.Add(logger, fmt.Sprintf("key-%d", i), source.Name(), 100, cacheddownloader.CachingInfoType{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		reader.Close()
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			cache.Stats()
+		}
+	})
+}
+
+func BenchmarkFileCacheScanResistance(b *testing.B) {
+	for _, policy := range []struct {
+		name   string
+		policy cacheddownloader.EvictionPolicy
+	}{
+		{"LRU", cacheddownloader.LRU},
+		{"SLRU", cacheddownloader.SLRU},
+	} {
+		b.Run(policy.name, func(b *testing.B) {
+			cacheDir, err := os.MkdirTemp("", "cache-bench")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.RemoveAll(cacheDir)
+
+			logger := lager.NewLogger("bench")
+			cache := cacheddownloader.NewCache(cacheDir, 10, cacheddownloader.WithPolicy(policy.policy))
+
+			// get the entry for cacheKey, adding it on a miss
+			access := func(cacheKey string) {
+				reader, _, err := cache.Get(logger, cacheKey)
+				if err == nil {
+					reader.Close()
+					return
+				}
+
+				source, err := os.CreateTemp("", "cache-bench-file")
+				if err != nil {
+					b.Fatal(err)
+				}
+				source.Close()
+				reader, err = cache.Add(logger, cacheKey, source.Name(), 1, cacheddownloader.CachingInfoType{})
+				if err != nil {
+					b.Fatal(err)
+				}
+				reader.Close()
+			}
+
+			scanned := 0
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// a hot working set that fits in the cache and is used twice,
+				// followed by a scan of more keys than fit that are used once
+				for j := 0; j < 10; j++ {
+					access(fmt.Sprintf("hot-%d", j%5))
+				}
+				for j := 0; j < 10; j++ {
+					access(fmt.Sprintf("scan-%d", scanned))
+					scanned++
+				}
+			}
+			b.StopTimer()
+
+			hits, misses := cache.HitMissCounts()
+			b.ReportMetric(float64(hits)/float64(hits+misses), "hit-ratio")
+		})
+	}
+}
+
+// countingReader counts the streams that were read from and blocks the first
+// read until release is closed.
+type countingReader struct {
+	io.Reader
+	reads   *int32
+	release chan struct{}
+	started bool
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	if !r.started {
+		r.started = true
+		atomic.AddInt32(r.reads, 1)
+		<-r.release
+	}
+	return r.Reader.Read(p)
+}
+
+type fakeMetricsEmitter struct {
+	values map[string]float64
+	units  map[string]string
+}
+
+func (e *fakeMetricsEmitter) SendValue(name string, value float64, unit string) {
+	e.values[name] = value
+	e.units[name] = unit
+}
+
+func BenchmarkFileCacheParallelAdd(b *testing.B) {
+	cacheDir, err := os.MkdirTemp("", "cache-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	// copy every file as if it came from another device
+	restore := cacheddownloader.SetRename(func(oldpath, newpath string) error {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+	})
+	defer restore()
+
+	logger := lager.NewLogger("bench")
+	cache := cacheddownloader.NewCache(cacheDir, 1024*1024*1024)
+	content := []byte(strings.Repeat("x", 1024*1024))
+	var keys atomic.Int64
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			source, err := os.CreateTemp("", "cache-bench-file")
+			if err != nil {
+				b.Fatal(err)
+			}
+			source.Write(content)
+			source.Close()
+
+			cacheKey := fmt.Sprintf("key-%d", keys.Add(1))
+			reader, err := cache.Add(logger, cacheKey, source.Name(), int64(len(content)), cacheddownloader.CachingInfoType{})
+			if err != nil {
+				b.Fatal(err)
+			}
+			reader.Close()
+			cache.Remove(logger, cacheKey)
+		}
+	})
+}
+
+func BenchmarkFileCacheNextVictim(b *testing.B) {
+	cacheDir, err := os.MkdirTemp("", "cache-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	cache := cacheddownloader.NewCache(cacheDir, 1024*1024)
+	cache.AddFakeEntries(50000)
+
+	for _, finder := range []struct {
+		name string
+		find func() string
+	}{
+		{"scan", cache.NextVictimByScan},
+		{"ordered", func() string {
+			cacheKey, _, _ := cache.NextVictim()
+			return cacheKey
+		}},
+	} {
+		b.Run(finder.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if finder.find() != "fake-0" {
+					b.Fatal("unexpected victim")
+				}
+			}
+		})
+	}
 }
@@ -0,0 +1,17 @@
+//go:build !windows
+
+package cacheddownloader
+
+import "syscall"
+
+// diskFreeBytes returns the number of bytes available to unprivileged users on
+// the filesystem containing path.
+func diskFreeBytes(path string) (int64, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(path, &stat)
+	if err != nil {
+		return 0, err
+	}
+	// #nosec G115 - block counts and sizes fit in an int64 for any real filesystem
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
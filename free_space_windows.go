@@ -0,0 +1,9 @@
+package cacheddownloader
+
+import "errors"
+
+// diskFreeBytes is not supported on Windows, so the free space reserve is not
+// enforced there.
+func diskFreeBytes(path string) (int64, error) {
+	return 0, errors.New("free disk space is not supported on windows")
+}
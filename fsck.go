@@ -0,0 +1,120 @@
+package cacheddownloader
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"code.cloudfoundry.org/lager/v3"
+)
+
+// FsckReport lists what Fsck fixed.
+type FsckReport struct {
+	// MissingEntries holds the keys of the entries that were dropped because
+	// their files were gone.
+	MissingEntries []string
+	// UntrackedFiles holds the cache files that no entry referred to, which
+	// were removed.
+	UntrackedFiles []string
+	// ResizedEntries holds the keys of the entries whose size was corrected
+	// to the size of their file.
+	ResizedEntries []string
+	// Evicted holds the keys evicted because the corrected sizes took the
+	// cache over its limit.
+	Evicted []string
+}
+
+// Fsck cross-checks the entries against the cache directory and repairs what
+// has diverged, for example after a crash. Entries whose file and directory
+// are both gone are dropped, cache files that no entry refers to, including
+// those in shard directories, are removed like RemoveFileIfUntracked does,
+// and the sizes of file entries are set to the sizes of their files, rounded
+// up to BlockSize, evicting entries if the cache ends up over its limit.
+// Files the cache did not create, such as saved state, are left alone.
+// Failures to fix something do not stop the check; they are returned together
+// with the report of what was fixed.
+func (c *FileCache) Fsck(logger lager.Logger) (FsckReport, error) {
+	logger = logger.Session("file-cache.fsck")
+	defer c.notifyEvictions()
+	lock.Lock()
+	defer lock.Unlock()
+
+	logger.Info("starting")
+	defer logger.Info("finished")
+
+	report := FsckReport{}
+	if c.closed {
+		return report, ClosedErr
+	}
+
+	cacheKeys := make([]string, 0, len(c.Entries))
+	for cacheKey := range c.Entries {
+		cacheKeys = append(cacheKeys, cacheKey)
+	}
+	sort.Strings(cacheKeys)
+
+	errs := []error{}
+	for _, cacheKey := range cacheKeys {
+		entry := c.Entries[cacheKey]
+		fileInfo, fileErr := stat(entry.FilePath)
+		_, dirErr := stat(entry.ExpandedDirectoryPath)
+		if os.IsNotExist(fileErr) && os.IsNotExist(dirErr) {
+			logger.Info("missing-entry", lager.Data{"cache_key": cacheKey})
+			c.remove(logger, cacheKey, EvictReasonMissing)
+			report.MissingEntries = append(report.MissingEntries, cacheKey)
+			continue
+		}
+		if fileErr != nil && !os.IsNotExist(fileErr) {
+			errs = append(errs, fmt.Errorf("could not check %s: %w", cacheKey, fileErr))
+			continue
+		}
+
+		if entry.ExpandedDirectoryPath != "" {
+			continue
+		}
+		size := c.roundToBlock(fileInfo.Size())
+		if size != entry.Size {
+			logger.Info("resized-entry", lager.Data{"cache_key": cacheKey, "size": entry.Size, "actual_size": fileInfo.Size()})
+			entry.Size = size
+			report.ResizedEntries = append(report.ResizedEntries, cacheKey)
+		}
+	}
+
+	if len(report.ResizedEntries) > 0 {
+		// entries sharing content are accounted together, so account for
+		// them all again rather than one at a time
+		c.recount()
+	}
+
+	paths, err := c.cacheFiles()
+	if err != nil && !os.IsNotExist(err) {
+		errs = append(errs, err)
+	}
+	trackedFiles := c.trackedFiles()
+	for _, path := range paths {
+		if !cacheFileName.MatchString(filepath.Base(path)) {
+			continue
+		}
+
+		removed, err := c.removeFileIfUntracked(path, trackedFiles)
+		if err != nil {
+			logger.Error("failed-to-remove-untracked-file", err, lager.Data{"path": path})
+			errs = append(errs, fmt.Errorf("could not remove %s: %w", path, err))
+		} else if removed {
+			report.UntrackedFiles = append(report.UntrackedFiles, path)
+		}
+	}
+
+	report.Evicted, _ = c.makeRoom(logger, 0, "")
+	return report, errors.Join(errs...)
+}
+
+// stat is os.Stat, failing with a not-exist error for an empty path.
+func stat(path string) (os.FileInfo, error) {
+	if path == "" {
+		return nil, os.ErrNotExist
+	}
+	return os.Stat(path)
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+
+package cacheddownloader
+
+import "os"
+
+// syncDir flushes the directory entries of dir to disk.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
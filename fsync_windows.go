@@ -0,0 +1,7 @@
+package cacheddownloader
+
+// syncDir does nothing on Windows, where directories cannot be flushed and
+// renames are made durable by the filesystem.
+func syncDir(dir string) error {
+	return nil
+}